@@ -0,0 +1,142 @@
+//    Copyright 2023, Google LLC
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/hanwen/allusersync/gitutil"
+)
+
+// diverged returns the refs in trans that another writer moved since
+// we read them.
+func diverged(repo *git.Repository, trans *RefTransaction) ([]string, error) {
+	var result []string
+	for name, u := range trans.updates {
+		cur, err := currentRef(repo.Storer, name)
+		if err != nil {
+			return nil, err
+		}
+		if cur != u.OldID {
+			result = append(result, fmt.Sprintf("%s (read %s, now %s)", name, u.OldID, cur))
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// currentRef returns the value of a ref, or the ZeroHash if it does not
+// exist.
+func currentRef(st storer.ReferenceStorer, name plumbing.ReferenceName) (plumbing.Hash, error) {
+	ref, err := st.Reference(name)
+	if err == plumbing.ErrReferenceNotFound {
+		return plumbing.ZeroHash, nil
+	} else if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return ref.Hash(), nil
+}
+
+// mergedNotesRefs are the notemaps that are merged rather than
+// rejected if they moved while syncing.
+var mergedNotesRefs = []plumbing.ReferenceName{externalIDsRef, gpgKeysRef, groupNamesRef}
+
+// mergeDivergedNotes replaces updates of notemaps that another writer
+// advanced since we read them by a merge of both sides.
+func mergeDivergedNotes(repo *git.Repository, trans *RefTransaction) error {
+	for _, name := range mergedNotesRefs {
+		u := trans.updates[name]
+		if u == nil || u.NewID.IsZero() {
+			continue
+		}
+		theirs, err := readRefCommit(repo, name)
+		if err != nil {
+			return err
+		}
+		if theirs == nil || theirs.Hash == u.OldID {
+			continue
+		}
+		ours, err := repo.CommitObject(u.NewID)
+		if err != nil {
+			return err
+		}
+		var base *object.Commit
+		if !u.OldID.IsZero() {
+			if base, err = repo.CommitObject(u.OldID); err != nil {
+				return err
+			}
+		}
+		merged, conflicts, err := mergeNotes(base, ours, theirs)
+		if err != nil {
+			return err
+		}
+		for _, n := range conflicts {
+			log.Printf("%s: note %s changed on both sides; keeping ours", name, n)
+		}
+		tree, err := merged.Write(repo.Storer)
+		if err != nil {
+			return err
+		}
+		sig := newSig()
+		id, err := gitutil.SaveCommit(repo.Storer, &object.Commit{
+			Author:       sig,
+			Committer:    sig,
+			Message:      "merge " + ours.Message,
+			TreeHash:     tree,
+			ParentHashes: []plumbing.Hash{theirs.Hash, ours.Hash},
+		})
+		if err != nil {
+			return err
+		}
+		log.Printf("%s moved while syncing; merged", name)
+		u.OldID = theirs.Hash
+		u.NewID = id
+	}
+	return nil
+}
+
+// applyTransaction updates the refs, unless another writer changed
+// one of them since we read it. Notemaps are merged instead. With
+// force, changes by other writers are overwritten.
+func applyTransaction(repo *git.Repository, trans *RefTransaction, force bool) error {
+	if force {
+		for name, u := range trans.updates {
+			cur, err := currentRef(repo.Storer, name)
+			if err != nil {
+				return err
+			}
+			u.OldID = cur
+		}
+	} else {
+		if err := mergeDivergedNotes(repo, trans); err != nil {
+			return err
+		}
+		moved, err := diverged(repo, trans)
+		if err != nil {
+			return err
+		}
+		if len(moved) > 0 {
+			return fmt.Errorf("refs changed while syncing; rerun, or use --force to overwrite:\n  %s", strings.Join(moved, "\n  "))
+		}
+	}
+	return UpdateRepo(repo.Storer, trans)
+}
@@ -0,0 +1,199 @@
+//    Copyright 2023, Google LLC
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/hanwen/allusersync/gitutil"
+)
+
+// checkProblem is an inconsistency found by the check command.
+type checkProblem struct {
+	// Kind is a short identifier, such as "wrong-note-name".
+	Kind      string `json:"kind"`
+	Note      string `json:"note,omitempty"`
+	AccountID int    `json:"accountId,omitempty"`
+	Message   string `json:"message"`
+}
+
+// checkExternalIDs performs the checks of Gerrit's
+// ExternalIdsConsistencyChecker on refs/meta/external-ids, and some
+// more. The problems are sorted by note name.
+func checkExternalIDs(repo *git.Repository, keys externalIDKeys) ([]checkProblem, error) {
+	c, err := readRefCommit(repo, externalIDsRef)
+	if err != nil {
+		return nil, err
+	}
+	tree := plumbing.ZeroHash
+	if c != nil {
+		tree = c.TreeHash
+	}
+	accounts, err := localAccountIDs(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []checkProblem
+	byEmail := map[string][]*localExternalID{}
+	byAccount := map[int][]*localExternalID{}
+	// The notes are listed from the tree, rather than as a NoteMap,
+	// to keep memory down for large sites.
+	var names []string
+	var ids []plumbing.Hash
+	if err := gitutil.ForEachNote(repo.Storer, tree, func(name string, id plumbing.Hash) error {
+		names = append(names, name)
+		ids = append(ids, id)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	err = parseExternalIDBlobs(repo.Storer, names, ids, func(name string, e *localExternalID, err error) error {
+		if err != nil {
+			problems = append(problems, checkProblem{Kind: "malformed-note", Note: name, Message: err.Error()})
+			return nil
+		}
+		if want := keys.noteName(e.Key); want != name {
+			problems = append(problems, checkProblem{Kind: "wrong-note-name", Note: name, AccountID: e.AccountID,
+				Message: fmt.Sprintf("external ID %s should be in note %s", e.Key, want)})
+		}
+		if !accounts[e.AccountID] {
+			problems = append(problems, checkProblem{Kind: "orphan", Note: name, AccountID: e.AccountID,
+				Message: fmt.Sprintf("external ID %s belongs to nonexistent account %d", e.Key, e.AccountID)})
+		}
+		if e.HasPassword && !strings.HasPrefix(e.Key, "username:") {
+			problems = append(problems, checkProblem{Kind: "password", Note: name, AccountID: e.AccountID,
+				Message: fmt.Sprintf("external ID %s has a password, but only username: IDs may", e.Key)})
+		}
+		if e.Email != "" {
+			byEmail[e.Email] = append(byEmail[e.Email], e)
+			if !validEmail(e.Email) {
+				problems = append(problems, checkProblem{Kind: "invalid-email", Note: name, AccountID: e.AccountID,
+					Message: fmt.Sprintf("external ID %s has invalid email %q", e.Key, e.Email)})
+			}
+		}
+		byAccount[e.AccountID] = append(byAccount[e.AccountID], e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Gerrit gives the login ID and mailto: ID of an account the
+	// same email, so only emails of several accounts are a problem.
+	for email, extIDs := range byEmail {
+		owners := idSet{}
+		for _, e := range extIDs {
+			owners[e.AccountID] = true
+		}
+		if len(owners) < 2 {
+			continue
+		}
+		var ids []string
+		for _, e := range extIDs {
+			ids = append(ids, e.Key)
+		}
+		sort.Strings(ids)
+		for _, e := range extIDs {
+			problems = append(problems, checkProblem{Kind: "duplicate-email", Note: e.Note, AccountID: e.AccountID,
+				Message: fmt.Sprintf("email %s is not unique, it is used by external IDs %s", email, strings.Join(ids, ", "))})
+		}
+	}
+
+	// Accounts that log in through LDAP or HTTP get a gerrit: and a
+	// username: ID; without the latter, the login name is free
+	// for other accounts to take.
+	for id, extIDs := range byAccount {
+		var gerritID *localExternalID
+		hasUsername := false
+		for _, e := range extIDs {
+			if strings.HasPrefix(e.Key, "gerrit:") {
+				gerritID = e
+			} else if strings.HasPrefix(e.Key, "username:") {
+				hasUsername = true
+			}
+		}
+		if gerritID != nil && !hasUsername {
+			problems = append(problems, checkProblem{Kind: "no-username", Note: gerritID.Note, AccountID: id,
+				Message: fmt.Sprintf("account %d has external ID %s but no username: ID", id, gerritID.Key)})
+		}
+	}
+
+	sort.Slice(problems, func(i, j int) bool {
+		if problems[i].Note != problems[j].Note {
+			return problems[i].Note < problems[j].Note
+		}
+		return problems[i].Kind < problems[j].Kind
+	})
+	return problems, nil
+}
+
+func checkMain(args []string) error {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	repoDir := fs.String("repo", "", "all-users repo")
+	var sf storageFlags
+	sf.register(fs)
+	caseInsensitiveUserNames := fs.Bool("username-case-insensitive", false, caseInsensitiveUserNamesUsage)
+	jsonOut := fs.Bool("json", false, "print the problems as a JSON list rather than one per line")
+	fs.Parse(args)
+	if *repoDir == "" {
+		return fmt.Errorf("must specify --repo")
+	}
+
+	repo, err := sf.open(*repoDir)
+	if err != nil {
+		return err
+	}
+	keys := externalIDKeys{CaseInsensitiveUserNames: *caseInsensitiveUserNames}
+	problems, err := checkExternalIDs(repo, keys)
+	if err != nil {
+		return err
+	}
+
+	refs, err := misplacedUserRefs(repo)
+	if err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		problems = append(problems, checkProblem{Kind: "misplaced-ref",
+			Message: fmt.Sprintf("%s is not in its shard; see the repair command", ref.Name())})
+	}
+
+	if *jsonOut {
+		if problems == nil {
+			problems = []checkProblem{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(problems); err != nil {
+			return err
+		}
+	} else {
+		for _, p := range problems {
+			fmt.Printf("%s\t%s\t%d\t%s\n", p.Kind, p.Note, p.AccountID, p.Message)
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("found %d problems", len(problems))
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+//    Copyright 2023, Google LLC
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// collisionPolicy decides what happens if several fetched accounts
+// claim the same external ID, eg. after merging Gerrit hosts.
+type collisionPolicy string
+
+const (
+	// preferLowerID gives the external ID to the lowest account ID.
+	preferLowerID collisionPolicy = "prefer-lower-id"
+
+	// skipCollisions leaves the note as it is in the repository.
+	skipCollisions collisionPolicy = "skip"
+
+	// failCollisions aborts the save.
+	failCollisions collisionPolicy = "fail"
+)
+
+func parseCollisionPolicy(s string) (collisionPolicy, error) {
+	switch p := collisionPolicy(s); p {
+	case preferLowerID, skipCollisions, failCollisions:
+		return p, nil
+	}
+	return "", fmt.Errorf("--collisions must be prefer-lower-id, skip or fail, got %q", s)
+}
+
+// externalIDCollisions returns the accounts per note name, for note
+// names claimed by more than one account. The account IDs are sorted.
+func externalIDCollisions(infos []*AccountInfo, keys externalIDKeys) map[string][]int {
+	claims := map[string][]int{}
+	for _, inf := range infos {
+		for _, e := range inf.extIDs {
+			n := keys.noteName(e.Identity)
+			claims[n] = append(claims[n], inf.account.AccountID)
+		}
+	}
+	result := map[string][]int{}
+	for n, ids := range claims {
+		if len(ids) > 1 {
+			sort.Ints(ids)
+			result[n] = ids
+		}
+	}
+	return result
+}
+
+// resolveCollisions reports the collisions, and returns per note name
+// the account that may write it; 0 means nobody does. With
+// failCollisions, an error is returned instead.
+func resolveCollisions(infos []*AccountInfo, keys externalIDKeys, policy collisionPolicy) (map[string]int, error) {
+	collisions := externalIDCollisions(infos, keys)
+	if len(collisions) == 0 {
+		return nil, nil
+	}
+	keyOf := map[string]string{}
+	for _, inf := range infos {
+		for _, e := range inf.extIDs {
+			keyOf[keys.noteName(e.Identity)] = e.Identity
+		}
+	}
+	var msgs []string
+	winners := map[string]int{}
+	for n, ids := range collisions {
+		msgs = append(msgs, fmt.Sprintf("external ID %s claimed by accounts %s", keyOf[n], strings.Trim(fmt.Sprint(ids), "[]")))
+		if policy == preferLowerID {
+			winners[n] = ids[0]
+		} else {
+			winners[n] = 0
+		}
+	}
+	sort.Strings(msgs)
+	if policy == failCollisions {
+		return nil, fmt.Errorf("external ID collisions:\n  %s", strings.Join(msgs, "\n  "))
+	}
+	for _, m := range msgs {
+		log.Printf("warning: %s (%s)", m, policy)
+	}
+	return winners, nil
+}
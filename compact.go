@@ -0,0 +1,187 @@
+//    Copyright 2023, Google LLC
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+	"github.com/hanwen/allusersync/gitutil"
+)
+
+// firstParentChain returns the commits from c along the first parent,
+// newest first.
+func firstParentChain(c *object.Commit) ([]*object.Commit, error) {
+	var chain []*object.Commit
+	for {
+		chain = append(chain, c)
+		if c.NumParents() == 0 {
+			return chain, nil
+		}
+		p, err := c.Parent(0)
+		if err != nil {
+			return nil, err
+		}
+		c = p
+	}
+}
+
+// compactRef rewrites the history of a ref so it only has the newest
+// keep commits, plus those newer than since if that is not zero. The
+// oldest kept commit becomes a root holding the squashed history. The
+// root keeps the committer of the original root, as Gerrit reads the
+// registration date of an account from it. Other parents of merges are dropped. It returns the number of commits
+// before and after.
+func compactRef(repo *git.Repository, trans *RefTransaction, name plumbing.ReferenceName, keep int, since time.Time) (int, int, error) {
+	head, err := readRefCommit(repo, name)
+	if err != nil || head == nil {
+		return 0, 0, err
+	}
+	chain, err := firstParentChain(head)
+	if err != nil {
+		return 0, 0, err
+	}
+	n := keep
+	for n < len(chain) && !since.IsZero() && chain[n].Committer.When.After(since) {
+		n++
+	}
+	if n < 1 {
+		n = 1
+	}
+	if n >= len(chain) {
+		return len(chain), len(chain), nil
+	}
+
+	var parent plumbing.Hash
+	for i := n - 1; i >= 0; i-- {
+		c := chain[i]
+		nc := &object.Commit{
+			Author:    c.Author,
+			Committer: c.Committer,
+			Message:   c.Message,
+			TreeHash:  c.TreeHash,
+		}
+		if i == n-1 {
+			nc.Message = fmt.Sprintf("compact history\n\nSquashes %d commits up to %s:\n\n%s", len(chain)-i, c.Hash, c.Message)
+			nc.Committer = chain[len(chain)-1].Committer
+		} else {
+			nc.ParentHashes = []plumbing.Hash{parent}
+		}
+		parent, err = gitutil.SaveCommit(repo.Storer, nc)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	trans.updates[name] = &RefUpdate{OldID: head.Hash, NewID: parent}
+	return len(chain), n, nil
+}
+
+func compactMain(args []string) error {
+	fs := flag.NewFlagSet("compact", flag.ExitOnError)
+	repoDir := fs.String("repo", "", "all-users repo")
+	var sf storageFlags
+	sf.register(fs)
+	refs := fs.String("refs", externalIDsRef.String(), "comma-separated refs to compact")
+	keep := fs.Int("keep", 10, "number of newest commits to keep")
+	keepSince := fs.Duration("keep-since", 0, "also keep commits younger than this")
+	repack := fs.Bool("repack", false, "repack the repository afterwards, dropping the squashed history")
+	fs.Parse(args)
+	if *repoDir == "" {
+		return fmt.Errorf("must specify --repo")
+	}
+	if *keep < 1 {
+		return fmt.Errorf("--keep must be at least 1")
+	}
+
+	repo, err := sf.open(*repoDir)
+	if err != nil {
+		return err
+	}
+	if err := finishPendingTransaction(repo.Storer); err != nil {
+		return err
+	}
+
+	var since time.Time
+	if *keepSince > 0 {
+		since = time.Now().Add(-*keepSince)
+	}
+	trans := newRefTransaction()
+	for _, r := range strings.Split(*refs, ",") {
+		name := plumbing.ReferenceName(strings.TrimSpace(r))
+		before, after, err := compactRef(repo, trans, name, *keep, since)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		log.Printf("%s: %d commits -> %d", name, before, after)
+	}
+	if err := UpdateRepo(repo.Storer, trans); err != nil {
+		return err
+	}
+	if *repack && len(trans.updates) > 0 {
+		// git keeps what the reflog points to, which would keep the
+		// squashed history.
+		for name := range trans.updates {
+			if err := dropReflog(repo.Storer, name); err != nil {
+				return err
+			}
+		}
+		if err := repackRepo(repo); err != nil {
+			return fmt.Errorf("repack: %v", err)
+		}
+		// The old commit-graph lists the squashed commits, and
+		// the multi-pack-index the removed packs.
+		if hasCommitGraph(repo) {
+			if err := writeCommitGraph(repo); err != nil {
+				return err
+			}
+		}
+		if err := writeMultiPackIndex(repo, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// repackRepo packs the objects reachable from the refs into one pack,
+// and removes the other packs and the loose objects that were packed.
+// go-git's RepackObjects fails on refs that point to blobs, such as
+// starred-changes refs, and needs the filesystem storage itself, so
+// this repacks the filesystem storage below the gitutil wrappers.
+func repackRepo(repo *git.Repository) error {
+	var st storage.Storer = repo.Storer
+	for {
+		if fs, ok := st.(*filesystem.Storage); ok {
+			id, err := gitutil.Repack(repo.Storer, fs)
+			if err != nil {
+				return err
+			}
+			log.Printf("repacked into pack-%s", id)
+			return nil
+		}
+		u, ok := st.(interface{ Unwrap() storage.Storer })
+		if !ok {
+			return git.ErrPackedObjectsNotSupported
+		}
+		st = u.Unwrap()
+	}
+}
@@ -0,0 +1,75 @@
+//    Copyright 2023, Google LLC
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/hanwen/allusersync/gitutil"
+)
+
+// convertNotesMain rewrites a notemap in another layout, in a single
+// commit on top of its history. Later writes keep the layout, as
+// LoadNoteMap detects it.
+func convertNotesMain(args []string) error {
+	fs := flag.NewFlagSet("convert-notes", flag.ExitOnError)
+	repoDir := fs.String("repo", "", "all-users repo")
+	var sf storageFlags
+	sf.register(fs)
+	ref := fs.String("ref", externalIDsRef.String(), "notemap to convert")
+	layoutFlag := fs.String("layout", "", "target layout: flat (all notes in the root), fanout (2 digit directories, as Gerrit writes for large maps) or auto. Syncs keep the layout")
+	fs.Parse(args)
+	if *repoDir == "" || *layoutFlag == "" {
+		return fmt.Errorf("usage: convert-notes --repo REPO --layout LAYOUT")
+	}
+	layout, err := gitutil.ParseNoteLayout(*layoutFlag)
+	if err != nil {
+		return err
+	}
+
+	repo, err := sf.open(*repoDir)
+	if err != nil {
+		return err
+	}
+	if err := finishPendingTransaction(repo.Storer); err != nil {
+		return err
+	}
+
+	name := plumbing.ReferenceName(*ref)
+	nr, err := loadNotesRef(repo, name)
+	if err != nil {
+		return err
+	}
+	if nr.parent == nil {
+		return fmt.Errorf("%s does not exist", name)
+	}
+	nr.notes.Layout = layout
+	trans := newRefTransaction()
+	if err := nr.commit(repo.Storer, trans, newSig(), fmt.Sprintf("convert notes to %s layout", *layoutFlag)); err != nil {
+		return err
+	}
+	if len(trans.updates) == 0 {
+		log.Printf("%s already has the %s layout", name, *layoutFlag)
+		return nil
+	}
+	log.Printf("converted %d notes in %s", nr.notes.Len(), name)
+	if layout == gitutil.FlatLayout && nr.notes.Len() <= gitutil.MaxLeafNotes {
+		log.Printf("warning: with up to %d notes, the flat layout is also the auto layout; it is split once it grows beyond", gitutil.MaxLeafNotes)
+	}
+	return UpdateRepo(repo.Storer, trans)
+}
@@ -0,0 +1,244 @@
+//    Copyright 2023, Google LLC
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/hanwen/allusersync/gitutil"
+	gerrit "github.com/hanwen/go-gerrit"
+	"golang.org/x/time/rate"
+)
+
+var draftCommentsRefRE = regexp.MustCompile(`^refs/draft-comments/[0-9]{2}/([0-9]+)/([0-9]+)$`)
+
+// draftCommentsRefName returns refs/draft-comments/CD/ABCD/ACCOUNTID.
+func draftCommentsRefName(change, account int) plumbing.ReferenceName {
+	return plumbing.ReferenceName(fmt.Sprintf("refs/draft-comments/%02d/%d/%d", change%100, change, account))
+}
+
+// getDraftComments returns the caller's drafts per change number, with
+// CommitID set on each comment. Gerrit only serves drafts to their
+// author, so this can only be used for the account we authenticate as.
+func getDraftComments(lim *rate.Limiter, cl *gerrit.Client) (map[int][]gerrit.CommentInfo, error) {
+	result := map[int][]gerrit.CommentInfo{}
+	for skip := 0; ; {
+		lim.Wait(context.Background())
+		changes, _, err := cl.Changes.QueryChanges(&gerrit.QueryChangeOptions{
+			QueryOptions:  gerrit.QueryOptions{Query: []string{"has:draft"}, Limit: accountQueryLimit},
+			Skip:          skip,
+			ChangeOptions: gerrit.ChangeOptions{AdditionalFields: []string{"ALL_REVISIONS"}},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if changes == nil || len(*changes) == 0 {
+			break
+		}
+
+		for _, ch := range *changes {
+			revs := map[int]string{}
+			for sha, r := range ch.Revisions {
+				revs[r.Number] = sha
+			}
+
+			lim.Wait(context.Background())
+			drafts, _, err := cl.Changes.ListChangeDrafts(strconv.Itoa(ch.Number))
+			if err != nil {
+				return nil, err
+			}
+			if drafts == nil {
+				continue
+			}
+			for path, comments := range *drafts {
+				for _, c := range comments {
+					c.Path = path
+					if c.CommitID == "" {
+						c.CommitID = revs[c.PatchSet]
+					}
+					if c.CommitID == "" {
+						return nil, fmt.Errorf("change %d: draft %s: unknown patchset %d", ch.Number, c.ID, c.PatchSet)
+					}
+					result[ch.Number] = append(result[ch.Number], c)
+				}
+			}
+		}
+
+		skip += len(*changes)
+		if !(*changes)[len(*changes)-1].MoreChanges {
+			break
+		}
+	}
+	return result, nil
+}
+
+// noteDbComment is the JSON representation of a comment in NoteDb,
+// following Gerrit's Comment class.
+type noteDbComment struct {
+	Key struct {
+		UUID       string `json:"uuid"`
+		Filename   string `json:"filename"`
+		PatchSetID int    `json:"patchSetId"`
+	} `json:"key"`
+	LineNbr    int            `json:"lineNbr"`
+	Author     noteDbAccount  `json:"author"`
+	RealAuthor *noteDbAccount `json:"realAuthor,omitempty"`
+	WrittenOn  string         `json:"writtenOn"`
+	Side       int            `json:"side"`
+	Message    string         `json:"message"`
+	ParentUUID string         `json:"parentUuid,omitempty"`
+	Range      *noteDbRange   `json:"range,omitempty"`
+	RevID      string         `json:"revId"`
+	Unresolved bool           `json:"unresolved"`
+}
+
+type noteDbAccount struct {
+	ID int `json:"id"`
+}
+
+type noteDbRange struct {
+	StartLine int `json:"startLine"`
+	StartChar int `json:"startChar"`
+	EndLine   int `json:"endLine"`
+	EndChar   int `json:"endChar"`
+}
+
+// draftNoteData renders the drafts on a single revision as a NoteDb
+// revision note.
+func draftNoteData(account int, comments []gerrit.CommentInfo) ([]byte, error) {
+	var data struct {
+		Comments []noteDbComment `json:"comments"`
+	}
+	for _, c := range comments {
+		var n noteDbComment
+		n.Key.UUID = c.ID
+		n.Key.Filename = c.Path
+		n.Key.PatchSetID = c.PatchSet
+		n.LineNbr = c.Line
+		n.Author.ID = account
+		if c.Updated != nil {
+			n.WrittenOn = c.Updated.UTC().Format(time.RFC3339Nano)
+		}
+		n.Side = 1
+		if c.Side == "PARENT" {
+			n.Side = 0
+		}
+		n.Message = c.Message
+		n.ParentUUID = c.InReplyTo
+		if c.Range != nil {
+			n.Range = &noteDbRange{
+				StartLine: c.Range.StartLine,
+				StartChar: c.Range.StartCharacter,
+				EndLine:   c.Range.EndLine,
+				EndChar:   c.Range.EndCharacter,
+			}
+		}
+		n.RevID = c.CommitID
+		n.Unresolved = c.Unresolved != nil && *c.Unresolved
+		data.Comments = append(data.Comments, n)
+	}
+	sort.Slice(data.Comments, func(i, j int) bool {
+		a, b := data.Comments[i], data.Comments[j]
+		if a.Key.Filename != b.Key.Filename {
+			return a.Key.Filename < b.Key.Filename
+		}
+		if a.LineNbr != b.LineNbr {
+			return a.LineNbr < b.LineNbr
+		}
+		return a.Key.UUID < b.Key.UUID
+	})
+	return json.MarshalIndent(&data, "", "  ")
+}
+
+// readDraftCommentsRefs returns the draft-comments refs per account ID.
+func readDraftCommentsRefs(repo *git.Repository) (map[int][]plumbing.ReferenceName, error) {
+	iter, err := repo.References()
+	if err != nil {
+		return nil, err
+	}
+	result := map[int][]plumbing.ReferenceName{}
+	if err := iter.ForEach(func(ref *plumbing.Reference) error {
+		m := draftCommentsRefRE.FindStringSubmatch(ref.Name().String())
+		if m == nil {
+			return nil
+		}
+		id, err := strconv.Atoi(m[2])
+		if err != nil {
+			return err
+		}
+		result[id] = append(result[id], ref.Name())
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// updateDraftCommentsRefs schedules updates so the account's
+// draft-comments refs hold the given drafts. Each ref has a notemap
+// from revision to the drafts on that revision.
+func updateDraftCommentsRefs(repo *git.Repository, trans *RefTransaction, sig object.Signature, account int, old []plumbing.ReferenceName, drafts map[int][]gerrit.CommentInfo) error {
+	want := map[plumbing.ReferenceName]bool{}
+	for change, comments := range drafts {
+		name := draftCommentsRefName(change, account)
+		want[name] = true
+
+		byRev := map[string][]gerrit.CommentInfo{}
+		for _, c := range comments {
+			byRev[c.CommitID] = append(byRev[c.CommitID], c)
+		}
+
+		nr, err := loadNotesRef(repo, name)
+		if err != nil {
+			return err
+		}
+		for _, n := range nr.notes.Names() {
+			nr.notes.Remove(n)
+		}
+		for rev, cs := range byRev {
+			data, err := draftNoteData(account, cs)
+			if err != nil {
+				return err
+			}
+			id, err := gitutil.SaveBlob(repo.Storer, data)
+			if err != nil {
+				return err
+			}
+			nr.notes.Set(rev, id)
+		}
+		if err := nr.commit(repo.Storer, trans, sig, "update draft comments"); err != nil {
+			return err
+		}
+	}
+	for _, name := range old {
+		if !want[name] {
+			ref, err := repo.Reference(name, false)
+			if err != nil {
+				return err
+			}
+			trans.updates[name] = &RefUpdate{OldID: ref.Hash()}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+//    Copyright 2023, Google LLC
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/config"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/hanwen/allusersync/gitutil"
+)
+
+// printConfigDiff prints the values of keys that changed from a to b,
+// the old ones with "-" and the new ones with "+".
+func printConfigDiff(w io.Writer, a, b *config.Config) {
+	for _, c := range gitutil.DiffConfig(a, b) {
+		for _, v := range c.Old {
+			fmt.Fprintf(w, "    -%s = %s\n", c.Key, v)
+		}
+		for _, v := range c.New {
+			fmt.Fprintf(w, "    +%s = %s\n", c.Key, v)
+		}
+	}
+}
+
+// notesDiff counts the notes added, removed and changed between two
+// notemap commits.
+func notesDiff(a, b *object.Commit) (added, removed, changed int, err error) {
+	load := func(c *object.Commit) (*gitutil.NoteMap, error) {
+		if c == nil {
+			return gitutil.LoadNoteMap(nil)
+		}
+		t, err := c.Tree()
+		if err != nil {
+			return nil, err
+		}
+		return gitutil.LoadNoteMap(t)
+	}
+	am, err := load(a)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	bm, err := load(b)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	for _, n := range bm.Names() {
+		id, _ := bm.Get(n)
+		old, ok := am.Get(n)
+		if !ok {
+			added++
+		} else if old != id {
+			changed++
+		}
+	}
+	for _, n := range am.Names() {
+		if _, ok := bm.Get(n); !ok {
+			removed++
+		}
+	}
+	return added, removed, changed, nil
+}
+
+// printPlan describes the ref updates in trans without applying them.
+func printPlan(w io.Writer, repo *git.Repository, trans *RefTransaction) error {
+	var names []string
+	for name := range trans.updates {
+		names = append(names, name.String())
+	}
+	sort.Strings(names)
+	if len(names) == 0 {
+		fmt.Fprintln(w, "no refs would change")
+	}
+
+	for _, n := range names {
+		name := plumbing.ReferenceName(n)
+		old, err := readRefCommit(repo, name)
+		if err != nil {
+			// Eg. starred-changes refs point to blobs.
+			old = nil
+		}
+		update := trans.updates[name]
+		switch {
+		case update.NewID.IsZero():
+			fmt.Fprintf(w, "delete %s\n", name)
+			continue
+		case old == nil:
+			fmt.Fprintf(w, "create %s %s\n", name, update.NewID)
+		default:
+			fmt.Fprintf(w, "update %s %s..%s\n", name, old.Hash, update.NewID)
+		}
+
+		if name == externalIDsRef {
+			c, err := repo.CommitObject(update.NewID)
+			if err != nil {
+				return err
+			}
+			added, removed, changed, err := notesDiff(old, c)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "    external IDs: %d added, %d removed, %d changed\n", added, removed, changed)
+		}
+		if userRefRE.MatchString(n) {
+			c, err := repo.CommitObject(update.NewID)
+			if err != nil {
+				return err
+			}
+			a, err := gitutil.LoadCommitConfig(repo.Storer, old, "account.config")
+			if err != nil {
+				return err
+			}
+			b, err := gitutil.LoadCommitConfig(repo.Storer, c, "account.config")
+			if err != nil {
+				return err
+			}
+			printConfigDiff(w, a, b)
+			var oldTree plumbing.Hash
+			if old != nil {
+				oldTree = old.TreeHash
+			}
+			changes, err := gitutil.DiffTrees(repo.Storer, oldTree, c.TreeHash)
+			if err != nil {
+				return err
+			}
+			for _, ch := range changes {
+				if p := ch.Path(); p != "account.config" {
+					fmt.Fprintf(w, "    %s %s\n", p, ch.Action)
+				}
+			}
+		}
+	}
+	return nil
+}
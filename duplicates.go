@@ -0,0 +1,66 @@
+//    Copyright 2023, Google LLC
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// emailDuplicate is a preferred email shared by several accounts.
+// Gerrit cannot resolve such an email to a reviewer.
+type emailDuplicate struct {
+	Email string
+
+	// Accounts holds the sorted account IDs.
+	Accounts []int
+}
+
+// duplicatePreferredEmails returns the preferred emails that are used
+// by more than one account, ignoring case, sorted by email.
+func duplicatePreferredEmails(accounts []*localAccount) []emailDuplicate {
+	byEmail := map[string][]int{}
+	for _, a := range accounts {
+		if email := a.option("preferredEmail"); email != "" {
+			k := strings.ToLower(email)
+			byEmail[k] = append(byEmail[k], a.ID)
+		}
+	}
+	var result []emailDuplicate
+	for email, ids := range byEmail {
+		if len(ids) > 1 {
+			sort.Ints(ids)
+			result = append(result, emailDuplicate{email, ids})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Email < result[j].Email })
+	return result
+}
+
+// writeDuplicateEmailReport writes one line per email: the email and
+// the account IDs, separated by tabs.
+func writeDuplicateEmailReport(name string, dups []emailDuplicate) error {
+	var buf bytes.Buffer
+	for _, d := range dups {
+		fmt.Fprint(&buf, d.Email)
+		for _, id := range d.Accounts {
+			fmt.Fprintf(&buf, "\t%d", id)
+		}
+		buf.WriteString("\n")
+	}
+	return writeFileAtomic(name, buf.Bytes())
+}
@@ -0,0 +1,142 @@
+//    Copyright 2023, Google LLC
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	gerrit "github.com/hanwen/go-gerrit"
+	"golang.org/x/time/rate"
+)
+
+const mailtoScheme = "mailto:"
+
+// getEmailExternalIDs lists the account's emails, and returns mailto:
+// external IDs for the confirmed ones that none of extIDs carry. Emails
+// pending confirmation have no external ID in Gerrit either, so they
+// are only logged.
+func getEmailExternalIDs(lim *rate.Limiter, cl *gerrit.Client, id string, extIDs []gerrit.AccountExternalIdInfo) ([]gerrit.AccountExternalIdInfo, error) {
+	lim.Wait(context.Background())
+	emails, _, err := cl.Accounts.ListAccountEmails(id)
+	if err != nil {
+		return nil, err
+	}
+	if emails == nil {
+		return nil, nil
+	}
+
+	have := map[string]bool{}
+	for _, e := range extIDs {
+		have[e.Identity] = true
+		if e.EmailAddress != "" {
+			have[mailtoScheme+e.EmailAddress] = true
+		}
+	}
+
+	var result []gerrit.AccountExternalIdInfo
+	for _, e := range *emails {
+		if e.PendingConfirmation {
+			log.Printf("account %s: skipping unconfirmed email %s", id, e.Email)
+			continue
+		}
+		key := mailtoScheme + e.Email
+		if have[key] {
+			continue
+		}
+		have[key] = true
+		result = append(result, gerrit.AccountExternalIdInfo{
+			Identity:     key,
+			EmailAddress: e.Email,
+			Trusted:      true,
+		})
+	}
+	return result, nil
+}
+
+// validEmail approximates the EmailValidator Gerrit uses for
+// account emails, with local domains allowed: an atom local part
+// (dot separated, at most 64 bytes) and a hostname.
+func validEmail(email string) bool {
+	at := strings.LastIndex(email, "@")
+	if at <= 0 || at > 64 {
+		return false
+	}
+	local, domain := email[:at], email[at+1:]
+	for _, atom := range strings.Split(local, ".") {
+		if atom == "" {
+			return false
+		}
+		for _, r := range atom {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("!#$%&'*+/=?^_`{|}~-", r)) {
+				return false
+			}
+		}
+	}
+	if domain == "" || len(domain) > 253 {
+		return false
+	}
+	labels := strings.Split(domain, ".")
+	for _, l := range labels {
+		if l == "" || len(l) > 63 || l[0] == '-' || l[len(l)-1] == '-' {
+			return false
+		}
+		for _, r := range l {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-') {
+				return false
+			}
+		}
+	}
+	// Top level domains are alphabetic.
+	tld := labels[len(labels)-1]
+	return len(labels) == 1 || strings.Trim(tld, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ") == ""
+}
+
+// invalidEmail is an email that the destination server would reject.
+type invalidEmail struct {
+	AccountID int
+
+	// Field is "preferredEmail" or the external ID key.
+	Field string
+	Email string
+}
+
+// invalidEmails returns the emails of the account that fail
+// validEmail.
+func invalidEmails(info *AccountInfo) []invalidEmail {
+	var result []invalidEmail
+	if e := info.account.Email; e != "" && !validEmail(e) {
+		result = append(result, invalidEmail{info.account.AccountID, "preferredEmail", e})
+	}
+	for _, x := range info.extIDs {
+		if x.EmailAddress != "" && !validEmail(x.EmailAddress) {
+			result = append(result, invalidEmail{info.account.AccountID, x.Identity, x.EmailAddress})
+		}
+	}
+	return result
+}
+
+// writeInvalidEmailReport writes one line per email: the account ID,
+// where the email is used, and the email, separated by tabs.
+func writeInvalidEmailReport(name string, emails []invalidEmail) error {
+	var buf bytes.Buffer
+	for _, e := range emails {
+		fmt.Fprintf(&buf, "%d\t%s\t%s\n", e.AccountID, e.Field, e.Email)
+	}
+	return writeFileAtomic(name, buf.Bytes())
+}
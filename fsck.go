@@ -0,0 +1,162 @@
+//    Copyright 2023, Google LLC
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/hanwen/allusersync/gitutil"
+)
+
+// userRefFiles are the files Gerrit reads from a user ref.
+var userRefFiles = map[string]bool{
+	"account.config":     true,
+	"preferences.config": true,
+	"watch.config":       true,
+	"authorized_keys":    true,
+}
+
+// fsckProblem is a user ref that does not have the layout Gerrit
+// expects.
+type fsckProblem struct {
+	Ref     plumbing.ReferenceName
+	Commit  plumbing.Hash
+	Message string
+}
+
+// fsckUserRef checks the history of a user ref, and the tree of its
+// head commit. With allowMerges, merge commits, as written by sync
+// --merge, are accepted.
+func fsckUserRef(repo *git.Repository, ref *plumbing.Reference, allowMerges bool) []fsckProblem {
+	var problems []fsckProblem
+	report := func(id plumbing.Hash, format string, args ...interface{}) {
+		problems = append(problems, fsckProblem{ref.Name(), id, fmt.Sprintf(format, args...)})
+	}
+
+	head, err := repo.CommitObject(ref.Hash())
+	if err != nil {
+		report(ref.Hash(), "head: %v", err)
+		return problems
+	}
+	problems = append(problems, fsckUserTree(repo, ref.Name(), head)...)
+
+	seen := map[plumbing.Hash]bool{head.Hash: true}
+	todo := []*object.Commit{head}
+	for len(todo) > 0 {
+		c := todo[len(todo)-1]
+		todo = todo[:len(todo)-1]
+		if len(c.ParentHashes) > 1 && !allowMerges {
+			report(c.Hash, "merge commit with %d parents; Gerrit writes linear history", len(c.ParentHashes))
+		}
+		for _, p := range c.ParentHashes {
+			if seen[p] {
+				continue
+			}
+			seen[p] = true
+			pc, err := repo.CommitObject(p)
+			if err != nil {
+				report(c.Hash, "parent %s: %v", p, err)
+				continue
+			}
+			todo = append(todo, pc)
+		}
+	}
+	return problems
+}
+
+// fsckUserTree checks that the tree of c only has known files, and
+// that account.config is valid.
+func fsckUserTree(repo *git.Repository, name plumbing.ReferenceName, c *object.Commit) []fsckProblem {
+	var problems []fsckProblem
+	report := func(format string, args ...interface{}) {
+		problems = append(problems, fsckProblem{name, c.Hash, fmt.Sprintf(format, args...)})
+	}
+	tree, err := c.Tree()
+	if err != nil {
+		report("tree: %v", err)
+		return problems
+	}
+	for _, e := range tree.Entries {
+		if !userRefFiles[e.Name] {
+			report("unknown file %q", e.Name)
+		} else if e.Mode != filemode.Regular {
+			report("%s has mode %s", e.Name, e.Mode)
+		}
+	}
+
+	cfg, err := gitutil.LoadCommitConfig(repo.Storer, c, "account.config")
+	if err != nil {
+		report("account.config: %v", err)
+	} else if cfg == nil {
+		report("no account.config")
+	} else if err := validateAccountConfig(cfg); err != nil {
+		report("account.config: %v", err)
+	}
+	for _, f := range []string{"preferences.config", "watch.config"} {
+		if _, err := gitutil.LoadCommitConfig(repo.Storer, c, f); err != nil {
+			report("%s: %v", f, err)
+		}
+	}
+	return problems
+}
+
+func fsckMain(args []string) error {
+	fs := flag.NewFlagSet("fsck", flag.ExitOnError)
+	repoDir := fs.String("repo", "", "all-users repo")
+	var sf storageFlags
+	sf.register(fs)
+	allowMerges := fs.Bool("allow-merges", false, "accept merge commits, as written by sync --merge")
+	fs.Parse(args)
+	if *repoDir == "" {
+		return fmt.Errorf("must specify --repo")
+	}
+
+	repo, err := sf.open(*repoDir)
+	if err != nil {
+		return err
+	}
+	iter, err := repo.References()
+	if err != nil {
+		return err
+	}
+	var refs []*plumbing.Reference
+	if err := iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() == plumbing.HashReference && anyUserRefRE.MatchString(ref.Name().String()) {
+			refs = append(refs, ref)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i].Name() < refs[j].Name() })
+
+	var n int
+	for _, ref := range refs {
+		for _, p := range fsckUserRef(repo, ref, *allowMerges) {
+			fmt.Printf("%s %s: %s\n", p.Ref, p.Commit, p.Message)
+			n++
+		}
+	}
+	if n > 0 {
+		return fmt.Errorf("found %d problems in %d user refs", n, len(refs))
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+// Copyright 2023 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitutil
+
+import (
+	"compress/zlib"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/storage"
+	"github.com/go-git/go-git/v5/storage/memory"
+)
+
+// packWindow is the number of objects considered as delta bases.
+const packWindow = 10
+
+// BatchStorer keeps new objects in memory, and writes them to the
+// underlying storage as a single packfile before a reference is set,
+// so refs never point to objects that are not written yet. Storages
+// that cannot write packfiles get the objects one by one.
+type BatchStorer struct {
+	storage.Storer
+	mem *memory.ObjectStorage
+
+	// Compression is the zlib level of the packfile. At other levels
+	// than the default, objects are written whole, skipping the
+	// search for deltas too.
+	Compression int
+
+	// FastImport, if set, is the git directory into which Flush
+	// pipes the objects through `git fast-import`, which is much
+	// faster than go-git for big imports. Objects that the stream
+	// cannot express are written as a packfile still.
+	FastImport string
+
+	// GitCLI, if set, is the git directory into which Flush writes
+	// the objects as loose objects with git's plumbing commands,
+	// for exact compatibility with the installed git.
+	GitCLI string
+}
+
+// NewBatchStorer batches the new objects for base. Callers that need
+// base itself, eg. to repack, find it with Unwrap.
+func NewBatchStorer(base storage.Storer) *BatchStorer {
+	return &BatchStorer{
+		Storer:      base,
+		mem:         &memory.NewStorage().ObjectStorage,
+		Compression: zlib.DefaultCompression,
+	}
+}
+
+// Unwrap returns the underlying storage.
+func (s *BatchStorer) Unwrap() storage.Storer {
+	return s.Storer
+}
+
+func (s *BatchStorer) NewEncodedObject() plumbing.EncodedObject {
+	return s.mem.NewEncodedObject()
+}
+
+func (s *BatchStorer) SetEncodedObject(obj plumbing.EncodedObject) (plumbing.Hash, error) {
+	if s.Storer.HasEncodedObject(obj.Hash()) == nil {
+		return obj.Hash(), nil
+	}
+	return s.mem.SetEncodedObject(obj)
+}
+
+func (s *BatchStorer) EncodedObject(t plumbing.ObjectType, id plumbing.Hash) (plumbing.EncodedObject, error) {
+	if obj, err := s.mem.EncodedObject(t, id); err == nil {
+		return obj, nil
+	}
+	return s.Storer.EncodedObject(t, id)
+}
+
+func (s *BatchStorer) HasEncodedObject(id plumbing.Hash) error {
+	if s.mem.HasEncodedObject(id) == nil {
+		return nil
+	}
+	return s.Storer.HasEncodedObject(id)
+}
+
+func (s *BatchStorer) EncodedObjectSize(id plumbing.Hash) (int64, error) {
+	if sz, err := s.mem.EncodedObjectSize(id); err == nil {
+		return sz, nil
+	}
+	return s.Storer.EncodedObjectSize(id)
+}
+
+// Pending returns the number of objects that are not written yet.
+func (s *BatchStorer) Pending() int {
+	return len(s.mem.Objects)
+}
+
+// Flush writes the pending objects.
+func (s *BatchStorer) Flush() error {
+	if len(s.mem.Objects) == 0 {
+		return nil
+	}
+	var err error
+	switch {
+	case s.GitCLI != "":
+		err = s.gitWrite(s.mem)
+	case s.FastImport != "":
+		var rest *memory.ObjectStorage
+		if rest, err = s.fastImport(s.mem); err == nil {
+			err = s.write(rest)
+		}
+	default:
+		err = s.write(s.mem)
+	}
+	if err != nil {
+		return err
+	}
+	s.mem = &memory.NewStorage().ObjectStorage
+	return nil
+}
+
+func (s *BatchStorer) write(mem *memory.ObjectStorage) error {
+	if len(mem.Objects) == 0 {
+		return nil
+	}
+	if pw, ok := s.Storer.(storer.PackfileWriter); ok {
+		var ids []plumbing.Hash
+		var objs []plumbing.EncodedObject
+		for id, obj := range mem.Objects {
+			ids = append(ids, id)
+			objs = append(objs, obj)
+		}
+		w, err := pw.PackfileWriter()
+		if err != nil {
+			return err
+		}
+		if s.Compression == zlib.DefaultCompression {
+			_, err = packfile.NewEncoder(w, mem, false).Encode(ids, packWindow)
+		} else {
+			err = writePack(w, objs, s.Compression)
+		}
+		if err != nil {
+			w.Close()
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+	} else {
+		for _, obj := range mem.Objects {
+			if _, err := s.Storer.SetEncodedObject(obj); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *BatchStorer) SetReference(ref *plumbing.Reference) error {
+	if err := s.Flush(); err != nil {
+		return err
+	}
+	return s.Storer.SetReference(ref)
+}
+
+func (s *BatchStorer) CheckAndSetReference(ref, old *plumbing.Reference) error {
+	if err := s.Flush(); err != nil {
+		return err
+	}
+	return s.Storer.CheckAndSetReference(ref, old)
+}
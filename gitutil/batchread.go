@@ -0,0 +1,172 @@
+// Copyright 2023 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitutil
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/idxfile"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+)
+
+// ObjectReader reads many blobs at once, like `git cat-file --batch`.
+// go-git looks for every object as a loose file first, and then
+// reopens the pack that has it; ObjectReader loads the pack indexes
+// once, and reads each pack front to back with one open file.
+// Objects outside the packs, such as loose ones or those not yet
+// flushed, are read from the storage one by one.
+type ObjectReader struct {
+	st storer.EncodedObjectStorer
+	fs billy.Filesystem
+
+	loaded bool
+	names  []string
+	idxs   []*idxfile.MemoryIndex
+}
+
+// NewObjectReader reads objects of st, using the packs in the git
+// directory fs. If fs is nil, all objects are read from st.
+func NewObjectReader(st storer.EncodedObjectStorer, fs billy.Filesystem) *ObjectReader {
+	return &ObjectReader{st: st, fs: fs}
+}
+
+// packedObject is where ReadBlobs finds an object.
+type packedObject struct {
+	id     plumbing.Hash
+	pack   int
+	offset int64
+}
+
+func (r *ObjectReader) load() error {
+	if r.loaded || r.fs == nil {
+		return nil
+	}
+	names, err := ListPacks(r.fs)
+	if err != nil {
+		return err
+	}
+	for _, n := range names {
+		idx, err := openPackIndex(r.fs, n)
+		if err != nil {
+			return err
+		}
+		r.names = append(r.names, n)
+		r.idxs = append(r.idxs, idx)
+	}
+	r.loaded = true
+	return nil
+}
+
+// ReadBlobs calls fn with the content of each distinct blob in ids,
+// or with the error if the object is missing or not a blob. The blobs
+// are passed in the order of the packs, not of ids. An error from fn
+// stops the read.
+func (r *ObjectReader) ReadBlobs(ids []plumbing.Hash, fn func(id plumbing.Hash, data []byte, err error) error) error {
+	if err := r.load(); err != nil {
+		return err
+	}
+	seen := map[plumbing.Hash]bool{}
+	var packed []packedObject
+	var rest []plumbing.Hash
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		found := false
+		for i, idx := range r.idxs {
+			off, err := idx.FindOffset(id)
+			if err == plumbing.ErrObjectNotFound {
+				continue
+			} else if err != nil {
+				return err
+			}
+			packed = append(packed, packedObject{id: id, pack: i, offset: off})
+			found = true
+			break
+		}
+		if !found {
+			rest = append(rest, id)
+		}
+	}
+	sort.Slice(packed, func(i, j int) bool {
+		if packed[i].pack != packed[j].pack {
+			return packed[i].pack < packed[j].pack
+		}
+		return packed[i].offset < packed[j].offset
+	})
+
+	for i := 0; i < len(packed); {
+		j := i
+		for j < len(packed) && packed[j].pack == packed[i].pack {
+			j++
+		}
+		if err := r.readPack(packed[i:j], fn); err != nil {
+			return err
+		}
+		i = j
+	}
+	for _, id := range rest {
+		data, err := LoadBlob(r.st, id)
+		if err := fn(id, data, err); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readPack reads objs, which are sorted by offset in one pack.
+func (r *ObjectReader) readPack(objs []packedObject, fn func(id plumbing.Hash, data []byte, err error) error) error {
+	name := strings.TrimSuffix(r.names[objs[0].pack], ".idx") + ".pack"
+	f, err := r.fs.Open(path.Join("objects/pack", name))
+	if err != nil {
+		return err
+	}
+	p := packfile.NewPackfile(r.idxs[objs[0].pack], r.fs, f, 0)
+	defer p.Close()
+	for _, o := range objs {
+		data, err := readPacked(p, o.offset)
+		if err != nil {
+			err = fmt.Errorf("%s: %v", name, err)
+		}
+		if err := fn(o.id, data, err); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readPacked(p *packfile.Packfile, offset int64) ([]byte, error) {
+	obj, err := p.GetByOffset(offset)
+	if err != nil {
+		return nil, err
+	}
+	if obj.Type() != plumbing.BlobObject {
+		return nil, plumbing.ErrInvalidType
+	}
+	rd, err := obj.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer rd.Close()
+	return io.ReadAll(rd)
+}
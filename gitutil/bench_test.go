@@ -0,0 +1,129 @@
+// Copyright 2023 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitutil_test
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/hanwen/allusersync/gitutil"
+)
+
+// benchSizes are the entry counts of the benchmarks; the largest is
+// about the number of external IDs of a big site.
+var benchSizes = []int{10_000, 100_000, 1_000_000}
+
+func benchSizesRun(b *testing.B, fn func(b *testing.B, n int)) {
+	for _, n := range benchSizes {
+		b.Run(fmt.Sprintf("%d", n), func(b *testing.B) {
+			if testing.Short() && n > 100_000 {
+				b.Skip("skipped with -short")
+			}
+			fn(b, n)
+		})
+	}
+}
+
+// benchNotes returns n note entries, sorted, that all point to one
+// blob in st.
+func benchNotes(b *testing.B, st *memory.Storage, n int) []object.TreeEntry {
+	blob, err := gitutil.SaveBlob(st, []byte("[externalId \"username:bob\"]\n\taccountId = 1000\n"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	es := make([]object.TreeEntry, n)
+	for i := range es {
+		es[i] = object.TreeEntry{Name: gitutil.NoteName(strconv.Itoa(i)), Mode: filemode.Regular, Hash: blob}
+	}
+	gitutil.SortTreeEntries(es)
+	return es
+}
+
+// benchNoteMap returns a notes tree of n notes, written with layout.
+func benchNoteMap(b *testing.B, st *memory.Storage, n int, layout gitutil.NoteLayout) *object.Tree {
+	m, err := gitutil.LoadNoteMap(nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	m.Layout = layout
+	for _, e := range benchNotes(b, st, n) {
+		m.Set(e.Name, e.Hash)
+	}
+	id, err := m.Write(st)
+	if err != nil {
+		b.Fatal(err)
+	}
+	t, err := object.GetTree(st, id)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return t
+}
+
+// BenchmarkSaveTree writes a flat tree of n entries.
+func BenchmarkSaveTree(b *testing.B) {
+	benchSizesRun(b, func(b *testing.B, n int) {
+		st := memory.NewStorage()
+		es := benchNotes(b, st, n)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := gitutil.SaveTree(st, es); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkPatchTree changes one note in a fanout tree of n notes, as
+// a sync does for a changed external ID.
+func BenchmarkPatchTree(b *testing.B) {
+	benchSizesRun(b, func(b *testing.B, n int) {
+		st := memory.NewStorage()
+		t := benchNoteMap(b, st, n, gitutil.FanoutLayout)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			name := gitutil.NoteName(strconv.Itoa(i % n))
+			blob := gitutil.HashBlob([]byte(strconv.Itoa(i)))
+			changes := []object.TreeEntry{{Name: name[:2] + "/" + name[2:], Mode: filemode.Regular, Hash: blob}}
+			if _, err := gitutil.PatchTree(st, t, changes); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkNoteMapWrite changes one note of n, and writes the map in
+// the automatic layout.
+func BenchmarkNoteMapWrite(b *testing.B) {
+	benchSizesRun(b, func(b *testing.B, n int) {
+		st := memory.NewStorage()
+		m, err := gitutil.LoadNoteMap(benchNoteMap(b, st, n, gitutil.AutoLayout))
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			m.Set(gitutil.NoteName(strconv.Itoa(i%n)), plumbing.ComputeHash(plumbing.BlobObject, []byte(strconv.Itoa(i))))
+			if _, err := m.Write(st); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,228 @@
+// Copyright 2023 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitutil
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/commitgraph"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+)
+
+// CommitGraphFile is the commit-graph in the git directory. git reads
+// it in preference to a split commit-graph chain.
+const CommitGraphFile = "objects/info/commit-graph"
+
+// maxGeneration is the largest generation number that the commit-graph
+// format stores; deeper commits are capped.
+const maxGeneration = 0x3fffffff
+
+// WriteCommitGraph replaces the commit-graph in the git directory fs
+// with one for all commits reachable from tips, and returns the number
+// of commits. Tips that are annotated tags are peeled; tips that are
+// not commits are skipped. Commits that the old commit-graph has are
+// taken from there, so only new commits are read from st; the file
+// itself is rewritten in full.
+func WriteCommitGraph(st storer.EncodedObjectStorer, fs billy.Filesystem, tips []plumbing.Hash) (int, error) {
+	commits, err := readCommits(st, fs, tips)
+	if err != nil {
+		return 0, err
+	}
+	if err := generations(commits); err != nil {
+		return 0, err
+	}
+	idx := commitgraph.NewMemoryIndex()
+	octopus := 0
+	for id, d := range commits {
+		if len(d.ParentHashes) > 2 {
+			octopus++
+		}
+		idx.Add(id, d)
+	}
+	// go-git sizes the extra edge list by the first octopus merge
+	// only.
+	if octopus > 1 {
+		return 0, fmt.Errorf("commit-graph: %d octopus merges; go-git can only encode one", octopus)
+	}
+
+	lock := CommitGraphFile + ".lock"
+	f, err := fs.OpenFile(lock, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o444)
+	if os.IsExist(err) {
+		return 0, fmt.Errorf("%s: locked by another process; remove %s if it is stale", CommitGraphFile, lock)
+	} else if err != nil {
+		return 0, err
+	}
+	if err := commitgraph.NewEncoder(f).Encode(idx); err != nil {
+		f.Close()
+		fs.Remove(lock)
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		fs.Remove(lock)
+		return 0, err
+	}
+	if err := fs.Rename(lock, CommitGraphFile); err != nil {
+		fs.Remove(lock)
+		return 0, err
+	}
+	return len(commits), nil
+}
+
+// readCommits returns the commit-graph data of all commits reachable
+// from tips, with zero Generations for the commits that the old
+// commit-graph of fs lacks.
+func readCommits(st storer.EncodedObjectStorer, fs billy.Filesystem, tips []plumbing.Hash) (map[plumbing.Hash]*commitgraph.CommitData, error) {
+	old, oldFile := openCommitGraph(fs)
+	if oldFile != nil {
+		defer oldFile.Close()
+	}
+	var todo []plumbing.Hash
+	for _, t := range tips {
+		if old != nil {
+			if _, err := old.GetIndexByHash(t); err == nil {
+				todo = append(todo, t)
+				continue
+			}
+		}
+		id, err := peelToCommit(st, t)
+		if err != nil {
+			return nil, err
+		}
+		if !id.IsZero() {
+			todo = append(todo, id)
+		}
+	}
+
+	commits := map[plumbing.Hash]*commitgraph.CommitData{}
+	for len(todo) > 0 {
+		id := todo[len(todo)-1]
+		todo = todo[:len(todo)-1]
+		if commits[id] != nil {
+			continue
+		}
+		d, err := commitData(st, old, id)
+		if err != nil {
+			return nil, err
+		}
+		commits[id] = d
+		todo = append(todo, d.ParentHashes...)
+	}
+
+	return commits, nil
+}
+
+// peelToCommit follows annotated tags from id, and returns the commit
+// it ends at, or the ZeroHash for other objects.
+func peelToCommit(st storer.EncodedObjectStorer, id plumbing.Hash) (plumbing.Hash, error) {
+	for {
+		obj, err := st.EncodedObject(plumbing.AnyObject, id)
+		if err != nil {
+			return plumbing.ZeroHash, fmt.Errorf("%s: %w", id, err)
+		}
+		switch obj.Type() {
+		case plumbing.CommitObject:
+			return id, nil
+		case plumbing.TagObject:
+			t, err := object.DecodeTag(st, obj)
+			if err != nil {
+				return plumbing.ZeroHash, err
+			}
+			id = t.Target
+		default:
+			return plumbing.ZeroHash, nil
+		}
+	}
+}
+
+// openCommitGraph opens the commit-graph of fs. It returns nils if
+// there is none, or it cannot be read; then WriteCommitGraph reads all
+// commits.
+func openCommitGraph(fs billy.Filesystem) (commitgraph.Index, billy.File) {
+	f, err := fs.Open(CommitGraphFile)
+	if err != nil {
+		return nil, nil
+	}
+	idx, err := commitgraph.OpenFileIndex(f)
+	if err != nil {
+		f.Close()
+		return nil, nil
+	}
+	return idx, f
+}
+
+// commitData returns the commit-graph data of id, from old if it has
+// the commit, and otherwise from st, with a zero Generation.
+func commitData(st storer.EncodedObjectStorer, old commitgraph.Index, id plumbing.Hash) (*commitgraph.CommitData, error) {
+	if old != nil {
+		if i, err := old.GetIndexByHash(id); err == nil {
+			if d, err := old.GetCommitDataByIndex(i); err == nil {
+				return d, nil
+			}
+		}
+	}
+	c, err := object.GetCommit(st, id)
+	if err != nil {
+		return nil, fmt.Errorf("commit %s: %w", id, err)
+	}
+	return &commitgraph.CommitData{
+		TreeHash:     c.TreeHash,
+		ParentHashes: c.ParentHashes,
+		When:         c.Committer.When,
+	}, nil
+}
+
+// generations fills in the zero Generations of commits with the
+// topological levels that commit-graph stores: 1 for root commits,
+// else one more than the highest parent. It doesn't recurse, as ref
+// histories may be long chains.
+func generations(commits map[plumbing.Hash]*commitgraph.CommitData) error {
+	for start := range commits {
+		stack := []plumbing.Hash{start}
+		for len(stack) > 0 {
+			id := stack[len(stack)-1]
+			d := commits[id]
+			if d.Generation > 0 {
+				stack = stack[:len(stack)-1]
+				continue
+			}
+			gen, done := 1, true
+			for _, p := range d.ParentHashes {
+				pd := commits[p]
+				if pd == nil {
+					return fmt.Errorf("commit %s: parent %s missing", id, p)
+				}
+				if pd.Generation == 0 {
+					stack = append(stack, p)
+					done = false
+				} else if pd.Generation+1 > gen {
+					gen = pd.Generation + 1
+				}
+			}
+			if !done {
+				continue
+			}
+			if gen > maxGeneration {
+				gen = maxGeneration
+			}
+			d.Generation = gen
+			stack = stack[:len(stack)-1]
+		}
+	}
+	return nil
+}
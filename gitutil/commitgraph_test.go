@@ -0,0 +1,141 @@
+// Copyright 2023 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitutil_test
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/hanwen/allusersync/gitutil"
+)
+
+// countingStorer records the commits read.
+type countingStorer struct {
+	storer.EncodedObjectStorer
+	commits map[plumbing.Hash]bool
+}
+
+func (s *countingStorer) EncodedObject(t plumbing.ObjectType, id plumbing.Hash) (plumbing.EncodedObject, error) {
+	obj, err := s.EncodedObjectStorer.EncodedObject(t, id)
+	if err == nil && obj.Type() == plumbing.CommitObject {
+		s.commits[id] = true
+	}
+	return obj, err
+}
+
+// commitChain writes n commits named name on top of parent, and
+// returns the last.
+func commitChain(t *testing.T, st storer.EncodedObjectStorer, name string, parent plumbing.Hash, n int) plumbing.Hash {
+	tree, err := gitutil.SaveTree(st, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := object.Signature{Name: "a", Email: "a@example.com", When: time.Unix(1234567890, 0).UTC()}
+	for i := 0; i < n; i++ {
+		c := &object.Commit{Author: sig, Committer: sig, Message: fmt.Sprintf("%s %d\n", name, i), TreeHash: tree}
+		if !parent.IsZero() {
+			c.ParentHashes = []plumbing.Hash{parent}
+		}
+		if parent, err = gitutil.SaveCommit(st, c); err != nil {
+			t.Fatal(err)
+		}
+		sig.When = sig.When.Add(time.Minute)
+	}
+	return parent
+}
+
+func TestWriteCommitGraphReusesOld(t *testing.T) {
+	mem := memory.NewStorage()
+	st := &countingStorer{EncodedObjectStorer: mem, commits: map[plumbing.Hash]bool{}}
+	fs := memfs.New()
+	a := commitChain(t, mem, "a", plumbing.ZeroHash, 50)
+	if n, err := gitutil.WriteCommitGraph(st, fs, []plumbing.Hash{a}); err != nil || n != 50 {
+		t.Fatalf("got %d, %v; want 50 commits", n, err)
+	}
+
+	b := commitChain(t, mem, "b", a, 5)
+	c := commitChain(t, mem, "c", plumbing.ZeroHash, 3)
+	st.commits = map[plumbing.Hash]bool{}
+	if n, err := gitutil.WriteCommitGraph(st, fs, []plumbing.Hash{b, c}); err != nil || n != 58 {
+		t.Fatalf("got %d, %v; want 58 commits", n, err)
+	}
+	if len(st.commits) != 8 {
+		t.Errorf("read %d commits, want only the 8 new ones", len(st.commits))
+	}
+
+	// The result must be what a write from scratch gives.
+	incremental, err := util.ReadFile(fs, gitutil.CommitGraphFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fresh := memfs.New()
+	if _, err := gitutil.WriteCommitGraph(mem, fresh, []plumbing.Hash{b, c}); err != nil {
+		t.Fatal(err)
+	}
+	want, err := util.ReadFile(fresh, gitutil.CommitGraphFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(incremental, want) {
+		t.Error("incremental commit-graph differs from a fresh one")
+	}
+}
+
+func TestWriteCommitGraphGitVerify(t *testing.T) {
+	r := newGitRepo(t)
+	env := []string{
+		"GIT_AUTHOR_NAME=a", "GIT_AUTHOR_EMAIL=a@example.com",
+		"GIT_COMMITTER_NAME=a", "GIT_COMMITTER_EMAIL=a@example.com",
+	}
+	tree := r.mktree(nil)
+	tip := plumbing.NewHash(r.run(env, "", "commit-tree", "-m", "root", tree))
+	for i := 0; i < 3; i++ {
+		tip = plumbing.NewHash(r.run(env, "", "commit-tree", "-m", fmt.Sprint(i), "-p", tip.String(), tree))
+	}
+	r.run(nil, "", "update-ref", "refs/heads/main", tip.String())
+	// git writes the old commit-graph.
+	r.run(nil, "", "commit-graph", "write", "--reachable")
+	tip = plumbing.NewHash(r.run(env, "", "commit-tree", "-m", "new", "-p", tip.String(), tree))
+
+	st := memory.NewStorage()
+	for _, id := range bytes.Fields([]byte(r.run(nil, "", "rev-list", tip.String()))) {
+		data := r.run(nil, "", "cat-file", "commit", string(id))
+		obj := st.NewEncodedObject()
+		obj.SetType(plumbing.CommitObject)
+		w, _ := obj.Writer()
+		w.Write([]byte(data + "\n"))
+		w.Close()
+		if _, err := st.SetEncodedObject(obj); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, err := gitutil.WriteCommitGraph(st, osfs.New(r.dir), []plumbing.Hash{tip}); err != nil || n != 5 {
+		t.Fatalf("got %d, %v; want 5 commits", n, err)
+	}
+	cmd := exec.Command("git", "--git-dir", r.dir, "commit-graph", "verify")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf("git commit-graph verify: %v\n%s", err, out)
+	}
+}
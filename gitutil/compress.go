@@ -0,0 +1,152 @@
+// Copyright 2023 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitutil
+
+import (
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"path"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/storage"
+)
+
+// CheckCompression returns an error if level is not a zlib level
+// that we can write with: -1 (the default) or 0 to 9.
+func CheckCompression(level int) error {
+	if level < zlib.DefaultCompression || level > zlib.BestCompression {
+		return fmt.Errorf("compression level must be -1 to 9, got %d", level)
+	}
+	return nil
+}
+
+// LooseStorer writes loose objects at a zlib level of choice; go-git
+// always uses the default level. Level 0 stores objects uncompressed,
+// which is cheapest on CPU, for repacking later. go-git caches the
+// object list with ExclusiveAccess, so it would miss the objects we
+// write.
+type LooseStorer struct {
+	storage.Storer
+	fs    billy.Filesystem
+	level int
+}
+
+// NewLooseStorer writes the objects of base to the git directory fs
+// at the given zlib level.
+func NewLooseStorer(base storage.Storer, fs billy.Filesystem, level int) *LooseStorer {
+	return &LooseStorer{Storer: base, fs: fs, level: level}
+}
+
+// Unwrap returns the underlying storage.
+func (s *LooseStorer) Unwrap() storage.Storer {
+	return s.Storer
+}
+
+func (s *LooseStorer) SetEncodedObject(obj plumbing.EncodedObject) (plumbing.Hash, error) {
+	id := obj.Hash()
+	hex := id.String()
+	p := path.Join("objects", hex[:2], hex[2:])
+	if _, err := s.fs.Stat(p); err == nil {
+		return id, nil
+	}
+
+	if err := s.fs.MkdirAll(path.Dir(p), 0o755); err != nil {
+		return id, err
+	}
+	f, err := util.TempFile(s.fs, path.Dir(p), "tmp_obj_")
+	if err != nil {
+		return id, err
+	}
+	defer s.fs.Remove(f.Name())
+	zw, err := zlib.NewWriterLevel(f, s.level)
+	if err != nil {
+		f.Close()
+		return id, err
+	}
+	err = writeObject(zw, obj, true)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return id, err
+	}
+	return id, s.fs.Rename(f.Name(), p)
+}
+
+// writeObject writes the content of obj to w, after the "TYPE SIZE\0"
+// header of loose objects if header is set.
+func writeObject(w io.Writer, obj plumbing.EncodedObject, header bool) error {
+	if header {
+		if _, err := fmt.Fprintf(w, "%s %d\x00", obj.Type(), obj.Size()); err != nil {
+			return err
+		}
+	}
+	r, err := obj.Reader()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	_, err = io.Copy(w, r)
+	return err
+}
+
+// writePack writes objs as a version 2 packfile, without deltas, with
+// the data compressed at the given zlib level.
+func writePack(w io.Writer, objs []plumbing.EncodedObject, level int) error {
+	h := sha1.New()
+	out := io.MultiWriter(w, h)
+	if _, err := out.Write([]byte("PACK")); err != nil {
+		return err
+	}
+	if err := binary.Write(out, binary.BigEndian, [2]uint32{2, uint32(len(objs))}); err != nil {
+		return err
+	}
+
+	zw, err := zlib.NewWriterLevel(out, level)
+	if err != nil {
+		return err
+	}
+	for _, obj := range objs {
+		// The object header has the type in bits 4-6 of the first
+		// byte, and the size in 4 bits there and 7 bits in each
+		// following byte.
+		sz := uint64(obj.Size())
+		hdr := []byte{byte(obj.Type())<<4 | byte(sz&0xf)}
+		for sz >>= 4; sz > 0; sz >>= 7 {
+			hdr[len(hdr)-1] |= 0x80
+			hdr = append(hdr, byte(sz&0x7f))
+		}
+		if _, err := out.Write(hdr); err != nil {
+			return err
+		}
+		zw.Reset(out)
+		if err := writeObject(zw, obj, false); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+	}
+	_, err = w.Write(h.Sum(nil))
+	return err
+}
@@ -0,0 +1,293 @@
+// Copyright 2023 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitutil
+
+import (
+	"sync"
+
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/index"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/storage"
+)
+
+// LockedStorer serializes all access to a storer that is not safe for
+// concurrent use, such as the filesystem storage, so it can be shared
+// between goroutines. Encoding and hashing in SaveBlob and friends
+// happen outside the lock, as do the callbacks of iterators.
+type LockedStorer struct {
+	storage.Storer
+	mu sync.Mutex
+}
+
+func NewLockedStorer(st storage.Storer) *LockedStorer {
+	return &LockedStorer{Storer: st}
+}
+
+// Unwrap returns the underlying storage.
+func (s *LockedStorer) Unwrap() storage.Storer {
+	return s.Storer
+}
+
+func (s *LockedStorer) NewEncodedObject() plumbing.EncodedObject {
+	return &plumbing.MemoryObject{}
+}
+
+func (s *LockedStorer) SetEncodedObject(obj plumbing.EncodedObject) (plumbing.Hash, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Storer.SetEncodedObject(obj)
+}
+
+func (s *LockedStorer) EncodedObject(t plumbing.ObjectType, id plumbing.Hash) (plumbing.EncodedObject, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Storer.EncodedObject(t, id)
+}
+
+func (s *LockedStorer) HasEncodedObject(id plumbing.Hash) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Storer.HasEncodedObject(id)
+}
+
+func (s *LockedStorer) EncodedObjectSize(id plumbing.Hash) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Storer.EncodedObjectSize(id)
+}
+
+func (s *LockedStorer) Reference(name plumbing.ReferenceName) (*plumbing.Reference, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Storer.Reference(name)
+}
+
+func (s *LockedStorer) SetReference(ref *plumbing.Reference) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Storer.SetReference(ref)
+}
+
+func (s *LockedStorer) CheckAndSetReference(ref, old *plumbing.Reference) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Storer.CheckAndSetReference(ref, old)
+}
+
+func (s *LockedStorer) RemoveReference(name plumbing.ReferenceName) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Storer.RemoveReference(name)
+}
+
+// IterEncodedObjects returns an iterator that takes the lock for each
+// object.
+func (s *LockedStorer) IterEncodedObjects(t plumbing.ObjectType) (storer.EncodedObjectIter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	it, err := s.Storer.IterEncodedObjects(t)
+	if err != nil {
+		return nil, err
+	}
+	return &lockedObjectIter{it: it, mu: &s.mu}, nil
+}
+
+type lockedObjectIter struct {
+	it storer.EncodedObjectIter
+	mu *sync.Mutex
+}
+
+func (it *lockedObjectIter) Next() (plumbing.EncodedObject, error) {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	return it.it.Next()
+}
+
+func (it *lockedObjectIter) ForEach(cb func(plumbing.EncodedObject) error) error {
+	return storer.ForEachIterator(it, cb)
+}
+
+func (it *lockedObjectIter) Close() {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	it.it.Close()
+}
+
+// IterReferences reads all references under the lock.
+func (s *LockedStorer) IterReferences() (storer.ReferenceIter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	it, err := s.Storer.IterReferences()
+	if err != nil {
+		return nil, err
+	}
+	var refs []*plumbing.Reference
+	err = it.ForEach(func(r *plumbing.Reference) error {
+		refs = append(refs, r)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return storer.NewReferenceSliceIter(refs), nil
+}
+
+func (s *LockedStorer) CountLooseRefs() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Storer.CountLooseRefs()
+}
+
+func (s *LockedStorer) PackRefs() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Storer.PackRefs()
+}
+
+func (s *LockedStorer) Shallow() ([]plumbing.Hash, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Storer.Shallow()
+}
+
+func (s *LockedStorer) SetShallow(ids []plumbing.Hash) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Storer.SetShallow(ids)
+}
+
+func (s *LockedStorer) Index() (*index.Index, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Storer.Index()
+}
+
+func (s *LockedStorer) SetIndex(idx *index.Index) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Storer.SetIndex(idx)
+}
+
+func (s *LockedStorer) Config() (*config.Config, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Storer.Config()
+}
+
+func (s *LockedStorer) SetConfig(cfg *config.Config) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Storer.SetConfig(cfg)
+}
+
+// Module returns the submodule storage of the underlying storage,
+// which is not locked.
+func (s *LockedStorer) Module(name string) (storage.Storer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Storer.Module(name)
+}
+
+// WritePool runs object writing tasks on a fixed number of goroutines.
+// The storer passed to the tasks must be safe for concurrent use, eg.
+// a LockedStorer.
+type WritePool struct {
+	st    storer.EncodedObjectStorer
+	tasks chan func(storer.EncodedObjectStorer) error
+	wg    sync.WaitGroup
+
+	mu  sync.Mutex
+	err error
+}
+
+// NewWritePool starts workers goroutines, at least one.
+func NewWritePool(st storer.EncodedObjectStorer, workers int) *WritePool {
+	if workers < 1 {
+		workers = 1
+	}
+	p := &WritePool{
+		st:    st,
+		tasks: make(chan func(storer.EncodedObjectStorer) error, workers),
+	}
+	p.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+func (p *WritePool) work() {
+	defer p.wg.Done()
+	for task := range p.tasks {
+		if p.failed() {
+			// Drain the queue.
+			continue
+		}
+		if err := task(p.st); err != nil {
+			p.mu.Lock()
+			if p.err == nil {
+				p.err = err
+			}
+			p.mu.Unlock()
+		}
+	}
+}
+
+func (p *WritePool) failed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err != nil
+}
+
+// Go queues a task. It blocks if all workers are busy. After a task
+// has failed, the remaining ones are skipped.
+func (p *WritePool) Go(task func(st storer.EncodedObjectStorer) error) {
+	p.tasks <- task
+}
+
+// SaveBlob queues writing data. done is called with the ID from the
+// worker goroutine.
+func (p *WritePool) SaveBlob(data []byte, done func(plumbing.Hash)) {
+	p.Go(func(st storer.EncodedObjectStorer) error {
+		id, err := SaveBlob(st, data)
+		if err == nil && done != nil {
+			done(id)
+		}
+		return err
+	})
+}
+
+// SaveTree queues writing a tree. The pool owns entries until done is
+// called.
+func (p *WritePool) SaveTree(entries []object.TreeEntry, done func(plumbing.Hash)) {
+	p.Go(func(st storer.EncodedObjectStorer) error {
+		id, err := SaveTree(st, entries)
+		if err == nil && done != nil {
+			done(id)
+		}
+		return err
+	})
+}
+
+// Wait waits for all tasks, stops the workers, and returns the first
+// error. The pool cannot be used afterwards.
+func (p *WritePool) Wait() error {
+	close(p.tasks)
+	p.wg.Wait()
+	return p.err
+}
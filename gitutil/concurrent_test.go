@@ -0,0 +1,129 @@
+// Copyright 2023 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitutil_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/hanwen/allusersync/gitutil"
+)
+
+// TestWritePoolLockedStorer writes objects and refs on a pool, while
+// other goroutines iterate over them; run with -race.
+func TestWritePoolLockedStorer(t *testing.T) {
+	st := gitutil.NewLockedStorer(memory.NewStorage())
+
+	done := make(chan struct{})
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			for {
+				select {
+				case <-done:
+					errs <- nil
+					return
+				default:
+				}
+				refs, err := st.IterReferences()
+				if err == nil {
+					err = refs.ForEach(func(*plumbing.Reference) error { return nil })
+				}
+				var objs storer.EncodedObjectIter
+				if err == nil {
+					objs, err = st.IterEncodedObjects(plumbing.TreeObject)
+				}
+				if err == nil {
+					// The callback may use the storer.
+					err = objs.ForEach(func(obj plumbing.EncodedObject) error {
+						return st.HasEncodedObject(obj.Hash())
+					})
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+
+	pool := gitutil.NewWritePool(st, 8)
+	const n = 200
+	var mu sync.Mutex
+	trees := map[int]plumbing.Hash{}
+	for i := 0; i < n; i++ {
+		i := i
+		pool.Go(func(eos storer.EncodedObjectStorer) error {
+			blob, err := gitutil.SaveBlob(eos, []byte(fmt.Sprint(i)))
+			if err != nil {
+				return err
+			}
+			tree, err := gitutil.SaveTree(eos, []object.TreeEntry{{Name: "f", Mode: filemode.Regular, Hash: blob}})
+			if err != nil {
+				return err
+			}
+			mu.Lock()
+			trees[i] = tree
+			mu.Unlock()
+			return st.SetReference(plumbing.NewHashReference(plumbing.ReferenceName(fmt.Sprintf("refs/t/%d", i)), tree))
+		})
+	}
+	err := pool.Wait()
+	close(done)
+	for i := 0; i < 2; i++ {
+		if ierr := <-errs; ierr != nil {
+			t.Errorf("iterating: %v", ierr)
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < n; i++ {
+		ref, err := st.Reference(plumbing.ReferenceName(fmt.Sprintf("refs/t/%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ref.Hash() != trees[i] {
+			t.Errorf("refs/t/%d: got %s, want %s", i, ref.Hash(), trees[i])
+		}
+		if _, err := object.GetTree(st, trees[i]); err != nil {
+			t.Errorf("tree %d: %v", i, err)
+		}
+	}
+}
+
+func TestWritePoolError(t *testing.T) {
+	pool := gitutil.NewWritePool(gitutil.NewLockedStorer(memory.NewStorage()), 2)
+	want := fmt.Errorf("fail")
+	for i := 0; i < 10; i++ {
+		i := i
+		pool.Go(func(storer.EncodedObjectStorer) error {
+			if i == 3 {
+				return want
+			}
+			return nil
+		})
+	}
+	if err := pool.Wait(); err != want {
+		t.Errorf("got %v, want %v", err, want)
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2023 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitutil
+
+import (
+	"github.com/go-git/go-git/v5/plumbing/format/config"
+)
+
+// ConfigKey names a config option. Subsection is empty for options
+// directly in the section.
+type ConfigKey struct {
+	Section    string
+	Subsection string
+	Name       string
+}
+
+// String returns the key as in git config, eg. "externalId.mailto:x.accountId".
+func (k ConfigKey) String() string {
+	if k.Subsection == "" {
+		return k.Section + "." + k.Name
+	}
+	return k.Section + "." + k.Subsection + "." + k.Name
+}
+
+// SectionKeys returns ConfigKeys for the given names in a section.
+func SectionKeys(section string, names ...string) []ConfigKey {
+	var keys []ConfigKey
+	for _, n := range names {
+		keys = append(keys, ConfigKey{Section: section, Name: n})
+	}
+	return keys
+}
+
+// values returns the values of k in cfg.
+func values(cfg *config.Config, k ConfigKey) []string {
+	if !cfg.HasSection(k.Section) {
+		return nil
+	}
+	sec := cfg.Section(k.Section)
+	if k.Subsection == "" {
+		return sec.OptionAll(k.Name)
+	}
+	if !sec.HasSubsection(k.Subsection) {
+		return nil
+	}
+	return sec.Subsection(k.Subsection).OptionAll(k.Name)
+}
+
+// MergeConfig overlays the owned keys of ours onto base: each owned
+// key gets the values it has in ours, or is removed if ours lacks it.
+// Everything else in base is kept. Base is modified and returned; if
+// it is nil, ours is returned.
+func MergeConfig(base, ours *config.Config, owned []ConfigKey) *config.Config {
+	if base == nil {
+		return ours
+	}
+	for _, k := range owned {
+		vals := values(ours, k)
+		if len(vals) == 0 && len(values(base, k)) == 0 {
+			// Don't add empty sections.
+			continue
+		}
+		opts := &base.Section(k.Section).Options
+		if k.Subsection != "" {
+			opts = &base.Section(k.Section).Subsection(k.Subsection).Options
+		}
+		// Subsection.SetOption takes several values, and keeps
+		// unchanged ones in place, so an unchanged config
+		// encodes the same.
+		tmp := &config.Subsection{Options: *opts}
+		if len(vals) > 0 {
+			tmp.SetOption(k.Name, vals...)
+		} else {
+			tmp.RemoveOption(k.Name)
+		}
+		*opts = tmp.Options
+	}
+	return base
+}
+
+// ConfigChange is a key whose values differ between two configs.
+type ConfigChange struct {
+	Key ConfigKey
+
+	// Old and New are the values; an empty list means the key is
+	// absent.
+	Old, New []string
+}
+
+// configValues returns the values per key, and the keys in order of
+// appearance.
+func configValues(cfg *config.Config) (map[ConfigKey][]string, []ConfigKey) {
+	m := map[ConfigKey][]string{}
+	var order []ConfigKey
+	if cfg == nil {
+		return m, nil
+	}
+	add := func(k ConfigKey, v string) {
+		if _, ok := m[k]; !ok {
+			order = append(order, k)
+		}
+		m[k] = append(m[k], v)
+	}
+	for _, sec := range cfg.Sections {
+		for _, o := range sec.Options {
+			add(ConfigKey{Section: sec.Name, Name: o.Key}, o.Value)
+		}
+		for _, sub := range sec.Subsections {
+			for _, o := range sub.Options {
+				add(ConfigKey{Section: sec.Name, Subsection: sub.Name, Name: o.Key}, o.Value)
+			}
+		}
+	}
+	return m, order
+}
+
+// DiffConfig returns the keys that differ between a and b, in the
+// order they appear in a, followed by the keys only in b. A nil config
+// is empty. Sections without options, and the order of keys, are
+// ignored.
+func DiffConfig(a, b *config.Config) []ConfigChange {
+	av, aOrder := configValues(a)
+	bv, bOrder := configValues(b)
+	var result []ConfigChange
+	for _, k := range aOrder {
+		if !equalValues(av[k], bv[k]) {
+			result = append(result, ConfigChange{Key: k, Old: av[k], New: bv[k]})
+		}
+	}
+	for _, k := range bOrder {
+		if _, ok := av[k]; !ok {
+			result = append(result, ConfigChange{Key: k, New: bv[k]})
+		}
+	}
+	return result
+}
+
+func equalValues(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,97 @@
+// Copyright 2023 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitutil
+
+import (
+	"container/list"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/storage"
+)
+
+// DedupStorer remembers the IDs of objects recently written or found
+// to exist, so that writing the same object again, or asking whether
+// it exists, doesn't go to the underlying storage. It assumes objects
+// are not deleted while it is in use. Like the other wrappers, it is
+// not safe for concurrent use; see LockedStorer.
+type DedupStorer struct {
+	storage.Storer
+
+	size  int
+	order *list.List // of plumbing.Hash, most recent first
+	ids   map[plumbing.Hash]*list.Element
+
+	// Hits counts the lookups answered from the cache.
+	Hits int
+}
+
+// NewDedupStorer remembers up to size IDs.
+func NewDedupStorer(base storage.Storer, size int) *DedupStorer {
+	return &DedupStorer{
+		Storer: base,
+		size:   size,
+		order:  list.New(),
+		ids:    map[plumbing.Hash]*list.Element{},
+	}
+}
+
+// Unwrap returns the underlying storage.
+func (s *DedupStorer) Unwrap() storage.Storer {
+	return s.Storer
+}
+
+func (s *DedupStorer) known(id plumbing.Hash) bool {
+	e, ok := s.ids[id]
+	if ok {
+		s.order.MoveToFront(e)
+		s.Hits++
+	}
+	return ok
+}
+
+func (s *DedupStorer) add(id plumbing.Hash) {
+	if _, ok := s.ids[id]; ok || s.size <= 0 {
+		return
+	}
+	s.ids[id] = s.order.PushFront(id)
+	if s.order.Len() > s.size {
+		last := s.order.Back()
+		s.order.Remove(last)
+		delete(s.ids, last.Value.(plumbing.Hash))
+	}
+}
+
+func (s *DedupStorer) SetEncodedObject(obj plumbing.EncodedObject) (plumbing.Hash, error) {
+	id := obj.Hash()
+	if s.known(id) {
+		return id, nil
+	}
+	id, err := s.Storer.SetEncodedObject(obj)
+	if err == nil {
+		s.add(id)
+	}
+	return id, err
+}
+
+func (s *DedupStorer) HasEncodedObject(id plumbing.Hash) error {
+	if s.known(id) {
+		return nil
+	}
+	err := s.Storer.HasEncodedObject(id)
+	if err == nil {
+		s.add(id)
+	}
+	return err
+}
@@ -0,0 +1,158 @@
+// Copyright 2023 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitutil
+
+import (
+	"path"
+	"sort"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+)
+
+// ChangeAction is the kind of a TreeChange.
+type ChangeAction int
+
+const (
+	// Added is an entry that only the new tree has.
+	Added ChangeAction = iota
+	// Removed is an entry that only the old tree has.
+	Removed
+	// Modified is an entry whose mode or ID differs.
+	Modified
+)
+
+// String returns the action as a lower case word, eg. "added".
+func (a ChangeAction) String() string {
+	switch a {
+	case Added:
+		return "added"
+	case Removed:
+		return "removed"
+	}
+	return "modified"
+}
+
+// TreeChange is a difference between two trees. Entry names are full
+// paths. For Added, From is empty; for Removed, To is empty.
+type TreeChange struct {
+	Action ChangeAction
+	From   object.TreeEntry
+	To     object.TreeEntry
+}
+
+// Path returns the path of the changed entry.
+func (c *TreeChange) Path() string {
+	if c.Action == Added {
+		return c.To.Name
+	}
+	return c.From.Name
+}
+
+// DiffTrees returns the changes to files (not directories) from tree a
+// to tree b, sorted by path. The ZeroHash stands for the empty tree.
+// Subtrees with the same ID are not read. A file replaced by a
+// directory, or vice versa, shows as a removal plus additions.
+func DiffTrees(st storer.EncodedObjectStorer, a, b plumbing.Hash) ([]TreeChange, error) {
+	var result []TreeChange
+	if err := diffTrees(st, "", a, b, &result); err != nil {
+		return nil, err
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Path() < result[j].Path() })
+	return result, nil
+}
+
+func readEntries(st storer.EncodedObjectStorer, id plumbing.Hash) (map[string]object.TreeEntry, error) {
+	m := map[string]object.TreeEntry{}
+	if id == plumbing.ZeroHash {
+		return m, nil
+	}
+	t, err := object.GetTree(st, id)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range t.Entries {
+		m[e.Name] = e
+	}
+	return m, nil
+}
+
+func diffTrees(st storer.EncodedObjectStorer, dir string, a, b plumbing.Hash, out *[]TreeChange) error {
+	if a == b {
+		return nil
+	}
+	ae, err := readEntries(st, a)
+	if err != nil {
+		return err
+	}
+	be, err := readEntries(st, b)
+	if err != nil {
+		return err
+	}
+
+	for name, from := range ae {
+		from.Name = path.Join(dir, name)
+		to, ok := be[name]
+		to.Name = from.Name
+		switch {
+		case !ok:
+			if err := diffEntries(st, &from, nil, out); err != nil {
+				return err
+			}
+		case (from.Mode == filemode.Dir) != (to.Mode == filemode.Dir):
+			if err := diffEntries(st, &from, nil, out); err != nil {
+				return err
+			}
+			if err := diffEntries(st, nil, &to, out); err != nil {
+				return err
+			}
+		case from.Mode == filemode.Dir:
+			if err := diffTrees(st, from.Name, from.Hash, to.Hash, out); err != nil {
+				return err
+			}
+		case from.Hash != to.Hash || from.Mode != to.Mode:
+			*out = append(*out, TreeChange{Action: Modified, From: from, To: to})
+		}
+	}
+	for name, to := range be {
+		if _, ok := ae[name]; ok {
+			continue
+		}
+		to.Name = path.Join(dir, name)
+		if err := diffEntries(st, nil, &to, out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// diffEntries records the removal of from or the addition of to,
+// recursing into directories.
+func diffEntries(st storer.EncodedObjectStorer, from, to *object.TreeEntry, out *[]TreeChange) error {
+	if from != nil {
+		if from.Mode == filemode.Dir {
+			return diffTrees(st, from.Name, from.Hash, plumbing.ZeroHash, out)
+		}
+		*out = append(*out, TreeChange{Action: Removed, From: *from})
+		return nil
+	}
+	if to.Mode == filemode.Dir {
+		return diffTrees(st, to.Name, plumbing.ZeroHash, to.Hash, out)
+	}
+	*out = append(*out, TreeChange{Action: Added, To: *to})
+	return nil
+}
@@ -0,0 +1,124 @@
+// Copyright 2023 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitutil
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/go-git/go-git/v5/plumbing/format/config"
+)
+
+// EncodeConfig encodes the config as JGit's Config.toText does, so
+// rewriting a config that Gerrit wrote yields the same blob. Unlike
+// go-git's encoder, JGit escapes quotes, backslashes, tabs and
+// newlines without quoting the value; it only quotes values that
+// start or end with a space, or contain a comment character.
+func EncodeConfig(cfg *config.Config) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, s := range cfg.Sections {
+		if len(s.Options) > 0 {
+			fmt.Fprintf(&buf, "[%s]\n", s.Name)
+			if err := encodeOptions(&buf, s.Options); err != nil {
+				return nil, fmt.Errorf("section %s: %v", s.Name, err)
+			}
+		}
+		for _, sub := range s.Subsections {
+			name, err := escapeSubsection(sub.Name)
+			if err != nil {
+				return nil, err
+			}
+			fmt.Fprintf(&buf, "[%s \"%s\"]\n", s.Name, name)
+			if err := encodeOptions(&buf, sub.Options); err != nil {
+				return nil, fmt.Errorf("section %s %q: %v", s.Name, sub.Name, err)
+			}
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func encodeOptions(buf *bytes.Buffer, opts config.Options) error {
+	for _, o := range opts {
+		v, err := escapeValue(o.Value)
+		if err != nil {
+			return fmt.Errorf("%s: %v", o.Key, err)
+		}
+		if v == "" {
+			// JGit writes no space after '=' for empty values.
+			fmt.Fprintf(buf, "\t%s =\n", o.Key)
+			continue
+		}
+		fmt.Fprintf(buf, "\t%s = %s\n", o.Key, v)
+	}
+	return nil
+}
+
+// escapeSubsection is JGit's Config.escapeSubsection.
+func escapeSubsection(s string) (string, error) {
+	if strings.ContainsAny(s, "\x00\r\n") {
+		return "", fmt.Errorf("subsection %q: newline, carriage return or NUL cannot be stored", s)
+	}
+	if !utf8.ValidString(s) {
+		return "", fmt.Errorf("subsection %q: invalid UTF-8 cannot be stored", s)
+	}
+	if s == "" {
+		// Git accepts this, but go-git cannot read it back.
+		return "", fmt.Errorf("empty subsection name")
+	}
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s), nil
+}
+
+// escapeValue is JGit's Config.escapeValue.
+func escapeValue(v string) (string, error) {
+	if v == "" {
+		return "", nil
+	}
+	if !utf8.ValidString(v) {
+		// JGit's configs are text, and go-git refuses to read it.
+		return "", fmt.Errorf("value %q: invalid UTF-8 cannot be stored", v)
+	}
+	quote := v[0] == ' ' || v[len(v)-1] == ' '
+	var r strings.Builder
+	for _, c := range v {
+		switch c {
+		case 0:
+			return "", fmt.Errorf("value %q: NUL cannot be stored", v)
+		case '\r':
+			// JGit writes it as is, and git then drops it.
+			return "", fmt.Errorf("value %q: carriage return cannot be stored", v)
+		case '\n':
+			r.WriteString(`\n`)
+		case '\t':
+			r.WriteString(`\t`)
+		case '\b':
+			r.WriteString(`\b`)
+		case '\\':
+			r.WriteString(`\\`)
+		case '"':
+			r.WriteString(`\"`)
+		case '#', ';':
+			quote = true
+			r.WriteRune(c)
+		default:
+			r.WriteRune(c)
+		}
+	}
+	if quote {
+		return `"` + r.String() + `"`, nil
+	}
+	return r.String(), nil
+}
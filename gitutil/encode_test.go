@@ -0,0 +1,151 @@
+// Copyright 2023 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitutil_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing/format/config"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/hanwen/allusersync/gitutil"
+)
+
+// TestEncodeConfigJGit checks that configs as JGit writes them are
+// encoded back to the same bytes. The files in testdata/jgit follow
+// the output of JGit's Config.toText.
+func TestEncodeConfigJGit(t *testing.T) {
+	files, err := filepath.Glob("testdata/jgit/*.config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no testdata/jgit/*.config files")
+	}
+	for _, f := range files {
+		want, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := gitutil.ParseConfig(want)
+		if err != nil {
+			t.Errorf("%s: %v", f, err)
+			continue
+		}
+		got, err := gitutil.EncodeConfig(cfg)
+		if err != nil {
+			t.Errorf("%s: EncodeConfig: %v", f, err)
+		} else if !bytes.Equal(got, want) {
+			t.Errorf("%s: got\n%s\nwant\n%s", f, got, want)
+		}
+	}
+}
+
+func TestExternalIDSubsectionEscaping(t *testing.T) {
+	for _, tc := range []struct {
+		identity string
+		// header is the section header that JGit writes.
+		header string
+	}{
+		{"username:bob", `[externalId "username:bob"]`},
+		{`username:a"b`, `[externalId "username:a\"b"]`},
+		{`username:a\b`, `[externalId "username:a\\b"]`},
+		{`username:\"`, `[externalId "username:\\\""]`},
+		{"mailto:jörg@example.com", `[externalId "mailto:jörg@example.com"]`},
+		{"username:日本", `[externalId "username:日本"]`},
+		{"username:a\tb", "[externalId \"username:a\tb\"]"},
+		{"gerrit:a b", `[externalId "gerrit:a b"]`},
+		{"username:#;[]", `[externalId "username:#;[]"]`},
+	} {
+		cfg := config.New()
+		cfg.Section("externalId").Subsection(tc.identity).SetOption("accountId", "1000")
+		data, err := gitutil.EncodeConfig(cfg)
+		if err != nil {
+			t.Errorf("%q: EncodeConfig: %v", tc.identity, err)
+			continue
+		}
+		if want := tc.header + "\n\taccountId = 1000\n"; string(data) != want {
+			t.Errorf("%q: got %q, want %q", tc.identity, data, want)
+		}
+
+		got, err := gitutil.ParseConfig(data)
+		if err != nil {
+			t.Errorf("%q: ParseConfig: %v", tc.identity, err)
+			continue
+		}
+		subs := got.Section("externalId").Subsections
+		if len(subs) != 1 || subs[0].Name != tc.identity {
+			t.Errorf("%q: read back %v", tc.identity, subs)
+		} else if v := subs[0].Option("accountId"); v != "1000" {
+			t.Errorf("%q: accountId %q", tc.identity, v)
+		}
+	}
+}
+
+func TestExternalIDSubsectionUnstorable(t *testing.T) {
+	for _, identity := range []string{"", "username:a\nb", "username:a\rb", "username:a\x00b", "username:\xb6"} {
+		cfg := config.New()
+		cfg.Section("externalId").Subsection(identity).SetOption("accountId", "1000")
+		if data, err := gitutil.EncodeConfig(cfg); err == nil {
+			t.Errorf("%q: got %q, want error", identity, data)
+		}
+	}
+}
+
+// FuzzConfigRoundTrip stores an external ID and an account name with
+// SaveConfig, and checks that LoadConfig reads them back unchanged.
+// SaveConfig may refuse input, but must not store it wrongly.
+func FuzzConfigRoundTrip(f *testing.F) {
+	for _, seed := range [][2]string{
+		{"username:bob", "Bob"},
+		{`username:a"b\c`, `J. "Bob" \o/`},
+		{"mailto:jörg@example.com", " Jörg "},
+		{"gerrit:a\tb", "a#b;c"},
+		{"username:x", "line\nbreak\b"},
+		{"username:y", ""},
+	} {
+		f.Add(seed[0], seed[1])
+	}
+	f.Fuzz(func(t *testing.T, identity, name string) {
+		cfg := config.New()
+		cfg.Section("externalId").Subsection(identity).SetOption("accountId", "1000")
+		cfg.Section("account").SetOption("fullName", name)
+		st := memory.NewStorage()
+		id, err := gitutil.SaveConfig(st, cfg)
+		if err != nil {
+			return
+		}
+		got, err := gitutil.LoadConfig(st, id)
+		if err != nil {
+			t.Fatalf("LoadConfig: %v", err)
+		}
+		subs := got.Section("externalId").Subsections
+		if len(subs) != 1 || subs[0].Name != identity {
+			t.Errorf("identity %q read back as %v", identity, subs)
+		} else if v := subs[0].Option("accountId"); v != "1000" {
+			t.Errorf("identity %q: accountId %q", identity, v)
+		}
+		if v := got.Section("account").Option("fullName"); v != name {
+			t.Errorf("name %q read back as %q", name, v)
+		}
+
+		// Saving what was read must give the same blob.
+		if again, err := gitutil.SaveConfig(st, got); err != nil || again != id {
+			t.Errorf("re-saved as %s, %v; want %s", again, err, id)
+		}
+	})
+}
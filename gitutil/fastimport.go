@@ -0,0 +1,312 @@
+// Copyright 2023 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitutil
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/storage"
+	"github.com/go-git/go-git/v5/storage/memory"
+)
+
+// fastImportRef is the ref that a fast-import stream builds commits
+// on. Each commit starts from a reset, so the ref is never written.
+const fastImportRef = "refs/allusersync/fast-import"
+
+// fastImportEncoder writes objects in the git fast-import format.
+// fast-import cannot write trees by themselves; each commit lists the
+// entries of its tree, and refers to subtrees that exist already by
+// ID, so later commits only list what changed.
+type fastImportEncoder struct {
+	w  *bufio.Writer
+	st storer.EncodedObjectStorer
+
+	// added holds the objects of the stream; built holds the added
+	// trees that fast-import has written for an earlier commit.
+	added map[plumbing.Hash]plumbing.ObjectType
+	built map[plumbing.Hash]bool
+
+	// marks numbers the commits written. fast-import finds objects
+	// of the stream by ID in tree entries, but "from" needs a mark.
+	marks map[plumbing.Hash]int
+}
+
+// WriteFastImport writes objs, which st can read too, as a stream for
+// `git fast-import` to w, followed by resetting refs to the commits
+// they point to. Objects that objs refer to must be in objs or in the
+// repository that reads the stream. Tags, and trees that no commit of
+// objs has, are skipped; the stream cannot express them.
+func WriteFastImport(w io.Writer, st storer.EncodedObjectStorer, objs []plumbing.EncodedObject, refs []*plumbing.Reference) error {
+	e := &fastImportEncoder{
+		w:     bufio.NewWriter(w),
+		st:    st,
+		added: map[plumbing.Hash]plumbing.ObjectType{},
+		built: map[plumbing.Hash]bool{},
+		marks: map[plumbing.Hash]int{},
+	}
+	var commits []plumbing.Hash
+	for _, obj := range objs {
+		e.added[obj.Hash()] = obj.Type()
+		if obj.Type() == plumbing.CommitObject {
+			commits = append(commits, obj.Hash())
+		}
+	}
+
+	e.w.WriteString("feature done\n")
+	for _, obj := range objs {
+		if obj.Type() == plumbing.BlobObject {
+			if err := e.writeBlob(obj); err != nil {
+				return err
+			}
+		}
+	}
+	order, err := e.sortCommits(commits)
+	if err != nil {
+		return err
+	}
+	for _, c := range order {
+		if err := e.writeCommit(c); err != nil {
+			return err
+		}
+	}
+	for _, r := range refs {
+		obj, err := st.EncodedObject(plumbing.AnyObject, r.Hash())
+		if err != nil {
+			return fmt.Errorf("%s: %w", r.Name(), err)
+		}
+		if obj.Type() != plumbing.CommitObject {
+			return fmt.Errorf("%s: fast-import can only set refs to commits, not to a %s", r.Name(), obj.Type())
+		}
+		fmt.Fprintf(e.w, "reset %s\nfrom %s\n\n", r.Name(), e.commitRef(r.Hash()))
+	}
+	fmt.Fprintf(e.w, "reset %s\n\ndone\n", fastImportRef)
+	return e.w.Flush()
+}
+
+func (e *fastImportEncoder) writeData(data []byte) {
+	fmt.Fprintf(e.w, "data %d\n", len(data))
+	e.w.Write(data)
+	e.w.WriteString("\n")
+}
+
+func (e *fastImportEncoder) writeBlob(obj plumbing.EncodedObject) error {
+	r, err := obj.Reader()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	fmt.Fprintf(e.w, "blob\ndata %d\n", obj.Size())
+	if _, err := io.Copy(e.w, r); err != nil {
+		return err
+	}
+	_, err = e.w.WriteString("\n")
+	return err
+}
+
+// sortCommits orders commits so parents come before their children.
+func (e *fastImportEncoder) sortCommits(commits []plumbing.Hash) ([]plumbing.Hash, error) {
+	// Sort first for a stable stream.
+	sort.Slice(commits, func(i, j int) bool { return bytes.Compare(commits[i][:], commits[j][:]) < 0 })
+	done := map[plumbing.Hash]bool{}
+	var order []plumbing.Hash
+	for _, start := range commits {
+		stack := []plumbing.Hash{start}
+		for len(stack) > 0 {
+			id := stack[len(stack)-1]
+			if done[id] {
+				stack = stack[:len(stack)-1]
+				continue
+			}
+			c, err := object.GetCommit(e.st, id)
+			if err != nil {
+				return nil, fmt.Errorf("commit %s: %w", id, err)
+			}
+			ready := true
+			for _, p := range c.ParentHashes {
+				if e.added[p] == plumbing.CommitObject && !done[p] {
+					stack = append(stack, p)
+					ready = false
+				}
+			}
+			if ready {
+				done[id] = true
+				order = append(order, id)
+				stack = stack[:len(stack)-1]
+			}
+		}
+	}
+	return order, nil
+}
+
+func (e *fastImportEncoder) writeCommit(id plumbing.Hash) error {
+	c, err := object.GetCommit(e.st, id)
+	if err != nil {
+		return err
+	}
+	if c.PGPSignature != "" {
+		return fmt.Errorf("commit %s: fast-import cannot write signed commits", id)
+	}
+	// fast-import writes commits in the same layout as go-git; check
+	// that go-git didn't drop headers, such as an encoding, in
+	// decoding.
+	re := &plumbing.MemoryObject{}
+	if err := c.Encode(re); err != nil {
+		return err
+	}
+	if re.Hash() != id {
+		return fmt.Errorf("commit %s: does not round-trip through go-git", id)
+	}
+
+	e.marks[id] = len(e.marks) + 1
+	fmt.Fprintf(e.w, "reset %s\ncommit %s\nmark :%d\n", fastImportRef, fastImportRef, e.marks[id])
+	fmt.Fprintf(e.w, "author %s\ncommitter %s\n", fastImportSig(c.Author), fastImportSig(c.Committer))
+	e.writeData([]byte(c.Message))
+	for i, p := range c.ParentHashes {
+		if i == 0 {
+			fmt.Fprintf(e.w, "from %s\n", e.commitRef(p))
+		} else {
+			fmt.Fprintf(e.w, "merge %s\n", e.commitRef(p))
+		}
+	}
+	e.w.WriteString("deleteall\n")
+	if err := e.writeTree(c.TreeHash, ""); err != nil {
+		return fmt.Errorf("commit %s: %w", id, err)
+	}
+	_, err = e.w.WriteString("\n")
+	return err
+}
+
+// commitRef returns the mark of a commit in the stream, or else its
+// ID.
+func (e *fastImportEncoder) commitRef(id plumbing.Hash) string {
+	if m, ok := e.marks[id]; ok {
+		return fmt.Sprintf(":%d", m)
+	}
+	return id.String()
+}
+
+// writeTree lists the entries of tree id below dir. Subtrees that
+// fast-import knows are given by ID; added ones are expanded.
+func (e *fastImportEncoder) writeTree(id plumbing.Hash, dir string) error {
+	t, err := object.GetTree(e.st, id)
+	if err != nil {
+		return err
+	}
+	// fast-import drops empty directories, so it would write a
+	// different parent tree.
+	if len(t.Entries) == 0 && dir != "" {
+		return fmt.Errorf("%s: fast-import cannot write empty trees", dir)
+	}
+	for _, ent := range t.Entries {
+		p := path.Join(dir, ent.Name)
+		switch ent.Mode {
+		case filemode.Dir:
+			if e.added[ent.Hash] == plumbing.TreeObject && !e.built[ent.Hash] {
+				if err := e.writeTree(ent.Hash, p); err != nil {
+					return err
+				}
+				continue
+			}
+		case filemode.Regular, filemode.Executable, filemode.Symlink, filemode.Submodule:
+		default:
+			// fast-import would normalize the mode.
+			return fmt.Errorf("%s: mode %o not supported by fast-import", p, uint32(ent.Mode))
+		}
+		fmt.Fprintf(e.w, "M %06o %s %s\n", uint32(ent.Mode), ent.Hash, fastImportPath(p))
+	}
+	e.built[id] = true
+	return nil
+}
+
+// fastImportSig formats a signature for the raw date format, which
+// is what go-git writes into commits too.
+func fastImportSig(s object.Signature) string {
+	return fmt.Sprintf("%s <%s> %d %s", s.Name, s.Email, s.When.Unix(), s.When.Format("-0700"))
+}
+
+// fastImportPath quotes p in C style if fast-import would misread it.
+func fastImportPath(p string) string {
+	if !strings.ContainsAny(p, "\"\\\n") {
+		return p
+	}
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	return `"` + r.Replace(p) + `"`
+}
+
+// fastImport writes the objects of mem to the repository in
+// s.FastImport with `git fast-import`, and returns the objects that
+// did not come out identical, for writing otherwise.
+func (s *BatchStorer) fastImport(mem *memory.ObjectStorage) (*memory.ObjectStorage, error) {
+	args := []string{"--git-dir", s.FastImport}
+	if s.Compression != zlib.DefaultCompression {
+		args = append(args, "-c", fmt.Sprintf("pack.compression=%d", s.Compression))
+	}
+	args = append(args, "fast-import", "--quiet", "--done")
+	cmd := exec.Command("git", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	objs := make([]plumbing.EncodedObject, 0, len(mem.Objects))
+	for _, obj := range mem.Objects {
+		objs = append(objs, obj)
+	}
+	// Without the final "done", fast-import discards the stream.
+	werr := WriteFastImport(in, s, objs, nil)
+	in.Close()
+	err = cmd.Wait()
+	if werr != nil {
+		return nil, werr
+	} else if err != nil {
+		return nil, fmt.Errorf("git fast-import: %w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	// go-git loads the pack indexes once; have it see the new pack.
+	for st := s.Storer; ; {
+		if r, ok := st.(interface{ Reindex() }); ok {
+			r.Reindex()
+			break
+		}
+		u, ok := st.(interface{ Unwrap() storage.Storer })
+		if !ok {
+			break
+		}
+		st = u.Unwrap()
+	}
+	rest := &memory.NewStorage().ObjectStorage
+	for id, obj := range mem.Objects {
+		if s.Storer.HasEncodedObject(id) != nil {
+			rest.Objects[id] = obj
+		}
+	}
+	return rest, nil
+}
@@ -0,0 +1,176 @@
+// Copyright 2023 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitutil
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/memory"
+)
+
+// gitWrite writes the objects of mem to the repository in s.GitCLI
+// with git's plumbing: trees with `git mktree`, and other objects with
+// `git unpack-objects`. It fails if git computes another ID than go-git
+// did.
+func (s *BatchStorer) gitWrite(mem *memory.ObjectStorage) error {
+	var config []string
+	if s.Compression != zlib.DefaultCompression {
+		config = []string{"-c", fmt.Sprintf("core.looseCompression=%d", s.Compression)}
+	}
+	var blobs, others []plumbing.Hash
+	for id, obj := range mem.Objects {
+		switch obj.Type() {
+		case plumbing.BlobObject:
+			blobs = append(blobs, id)
+		case plumbing.CommitObject, plumbing.TagObject:
+			others = append(others, id)
+		}
+	}
+	// mktree checks that entries exist, so blobs go first, and
+	// commits and tags, which may point to trees, last.
+	if err := s.unpackObjects(mem, config, blobs); err != nil {
+		return err
+	}
+	if err := s.makeTrees(mem, config); err != nil {
+		return err
+	}
+	return s.unpackObjects(mem, config, others)
+}
+
+// unpackObjects writes objects of mem with `git unpack-objects`, from
+// a pack without deltas streamed to its stdin, so git hashes and stores
+// each object itself. `git cat-file --batch-check` then checks that
+// git has them under the IDs go-git computed.
+func (s *BatchStorer) unpackObjects(mem *memory.ObjectStorage, config []string, ids []plumbing.Hash) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	sort.Slice(ids, func(i, j int) bool { return bytes.Compare(ids[i][:], ids[j][:]) < 0 })
+	var pack bytes.Buffer
+	if _, err := packfile.NewEncoder(&pack, mem, false).Encode(ids, 0); err != nil {
+		return err
+	}
+	if _, err := runGit(s.GitCLI, pack.Bytes(), append(config, "unpack-objects", "-q")...); err != nil {
+		return err
+	}
+
+	var in bytes.Buffer
+	for _, id := range ids {
+		in.WriteString(id.String() + "\n")
+	}
+	out, err := runGit(s.GitCLI, in.Bytes(), "cat-file", "--batch-check")
+	if err != nil {
+		return err
+	}
+	lines := strings.Split(strings.TrimSuffix(string(out), "\n"), "\n")
+	if len(lines) != len(ids) {
+		return fmt.Errorf("git unpack-objects: checked %d objects, want %d", len(lines), len(ids))
+	}
+	for i, id := range ids {
+		if want := fmt.Sprintf("%s %s ", id, mem.Objects[id].Type()); !strings.HasPrefix(lines[i], want) {
+			return fmt.Errorf("git unpack-objects: object %s: got %q", id, lines[i])
+		}
+	}
+	return nil
+}
+
+// makeTrees writes the trees of mem with `git mktree --batch`,
+// subtrees before the trees that contain them.
+func (s *BatchStorer) makeTrees(mem *memory.ObjectStorage, config []string) error {
+	var ids []plumbing.Hash
+	for id, obj := range mem.Objects {
+		if obj.Type() == plumbing.TreeObject {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	sort.Slice(ids, func(i, j int) bool { return bytes.Compare(ids[i][:], ids[j][:]) < 0 })
+
+	done := map[plumbing.Hash]bool{}
+	var order []plumbing.Hash
+	var in bytes.Buffer
+	for _, start := range ids {
+		stack := []plumbing.Hash{start}
+		for len(stack) > 0 {
+			id := stack[len(stack)-1]
+			if done[id] {
+				stack = stack[:len(stack)-1]
+				continue
+			}
+			t, err := object.DecodeTree(mem, mem.Objects[id])
+			if err != nil {
+				return fmt.Errorf("tree %s: %w", id, err)
+			}
+			ready := true
+			for _, e := range t.Entries {
+				if e.Mode == filemode.Dir && mem.Objects[e.Hash] != nil && !done[e.Hash] {
+					stack = append(stack, e.Hash)
+					ready = false
+				}
+			}
+			if !ready {
+				continue
+			}
+			for _, e := range t.Entries {
+				// The -z input takes names as they are.
+				fmt.Fprintf(&in, "%06o %s %s\t%s\x00", uint32(e.Mode), entryType(e.Mode), e.Hash, e.Name)
+			}
+			in.WriteByte(0)
+			done[id] = true
+			order = append(order, id)
+			stack = stack[:len(stack)-1]
+		}
+	}
+	out, err := runGit(s.GitCLI, in.Bytes(), append(config, "mktree", "-z", "--batch")...)
+	if err != nil {
+		return err
+	}
+	return checkGitIDs("mktree", order, out)
+}
+
+// entryType is the object type of a tree entry, as ls-tree shows it.
+func entryType(m filemode.FileMode) plumbing.ObjectType {
+	switch m {
+	case filemode.Dir:
+		return plumbing.TreeObject
+	case filemode.Submodule:
+		return plumbing.CommitObject
+	}
+	return plumbing.BlobObject
+}
+
+// checkGitIDs checks that git printed want, one ID per line.
+func checkGitIDs(cmd string, want []plumbing.Hash, out []byte) error {
+	got := strings.Fields(string(out))
+	if len(got) != len(want) {
+		return fmt.Errorf("git %s: wrote %d objects, want %d", cmd, len(got), len(want))
+	}
+	for i, id := range want {
+		if got[i] != id.String() {
+			return fmt.Errorf("git %s: wrote %s for object %s", cmd, got[i], id)
+		}
+	}
+	return nil
+}
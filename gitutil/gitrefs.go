@@ -0,0 +1,265 @@
+// Copyright 2023 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitutil
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/config"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/storage"
+)
+
+// RefStorage returns the ref storage format of the git directory fs,
+// from extensions.refStorage: "files" (loose and packed refs) or
+// "reftable".
+func RefStorage(fs billy.Filesystem) (string, error) {
+	f, err := fs.Open("config")
+	if os.IsNotExist(err) {
+		return "files", nil
+	} else if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	cfg := config.New()
+	if err := config.NewDecoder(f).Decode(cfg); err != nil {
+		return "", fmt.Errorf("config: %v", err)
+	}
+	format := strings.ToLower(cfg.Section("extensions").Option("refStorage"))
+	switch format {
+	case "":
+		return "files", nil
+	case "files", "reftable":
+		return format, nil
+	}
+	return "", fmt.Errorf("unknown ref storage format %q", format)
+}
+
+// InitReftable creates a bare repository with reftable ref storage
+// at dir, with git; go-git cannot write reftables.
+func InitReftable(dir string) error {
+	_, err := runGit(dir, nil, "init", "--bare", "--quiet", "--object-format=sha1", "--ref-format=reftable")
+	return err
+}
+
+// GitRefStorer reads and writes refs by running git, for ref
+// storage formats that go-git doesn't know, such as reftable. Objects
+// go to the underlying storage. Each ref lookup runs a git process.
+type GitRefStorer struct {
+	storage.Storer
+	gitDir string
+
+	// ReflogMessage is recorded in the reflog for ref updates.
+	ReflogMessage string
+}
+
+// NewGitRefStorer keeps the refs of base with git, in the git
+// directory gitDir.
+func NewGitRefStorer(base storage.Storer, gitDir string) *GitRefStorer {
+	return &GitRefStorer{Storer: base, gitDir: gitDir}
+}
+
+// Unwrap returns the underlying storage.
+func (s *GitRefStorer) Unwrap() storage.Storer {
+	return s.Storer
+}
+
+// git runs a git command in the git directory of s.
+func (s *GitRefStorer) git(stdin []byte, args ...string) ([]byte, error) {
+	return runGit(s.gitDir, stdin, args...)
+}
+
+// runGit runs a git command in gitDir with stdin as input, and returns
+// its output. The error includes git's complaint.
+func runGit(gitDir string, stdin []byte, args ...string) ([]byte, error) {
+	cmd := exec.Command("git", append([]string{"--git-dir", gitDir}, args...)...)
+	cmd.Env = append(os.Environ(),
+		"GIT_COMMITTER_NAME=allusersync",
+		"GIT_COMMITTER_EMAIL=allusersync@invalid")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		// Name the subcommand, after any "-c KEY=VALUE".
+		i := 0
+		for i+2 < len(args) && args[i] == "-c" {
+			i += 2
+		}
+		name := args[i]
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("git %s: %w: %s", name, err, msg)
+		}
+		return nil, fmt.Errorf("git %s: %w", name, err)
+	}
+	return stdout.Bytes(), nil
+}
+
+// listRefs lists the refs matching the for-each-ref patterns.
+func (s *GitRefStorer) listRefs(patterns ...string) ([]*plumbing.Reference, error) {
+	out, err := s.git(nil, append([]string{"for-each-ref", "--format=%(objectname) %(refname) %(symref)"}, patterns...)...)
+	if err != nil {
+		return nil, err
+	}
+	var refs []*plumbing.Reference
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		switch len(fields) {
+		case 2:
+			refs = append(refs, plumbing.NewHashReference(plumbing.ReferenceName(fields[1]), plumbing.NewHash(fields[0])))
+		case 3:
+			refs = append(refs, plumbing.NewSymbolicReference(plumbing.ReferenceName(fields[1]), plumbing.ReferenceName(fields[2])))
+		default:
+			return nil, fmt.Errorf("for-each-ref: malformed line %q", sc.Text())
+		}
+	}
+	return refs, sc.Err()
+}
+
+// notFound returns whether a git command with -q failed only because
+// it found nothing, as opposed to git dying.
+func notFound(err error) bool {
+	var exit *exec.ExitError
+	return errors.As(err, &exit) && exit.ExitCode() == 1
+}
+
+// head reads HEAD, which for-each-ref doesn't list.
+func (s *GitRefStorer) head() (*plumbing.Reference, error) {
+	out, err := s.git(nil, "symbolic-ref", "-q", "HEAD")
+	if err == nil {
+		return plumbing.NewSymbolicReference(plumbing.HEAD, plumbing.ReferenceName(strings.TrimSpace(string(out)))), nil
+	} else if !notFound(err) {
+		return nil, err
+	}
+	out, err = s.git(nil, "rev-parse", "-q", "--verify", "HEAD")
+	if notFound(err) {
+		return nil, plumbing.ErrReferenceNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return plumbing.NewHashReference(plumbing.HEAD, plumbing.NewHash(strings.TrimSpace(string(out)))), nil
+}
+
+func (s *GitRefStorer) Reference(name plumbing.ReferenceName) (*plumbing.Reference, error) {
+	if name == plumbing.HEAD {
+		return s.head()
+	}
+	// The pattern also matches refs below name.
+	refs, err := s.listRefs(name.String())
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range refs {
+		if r.Name() == name {
+			return r, nil
+		}
+	}
+	return nil, plumbing.ErrReferenceNotFound
+}
+
+func (s *GitRefStorer) IterReferences() (storer.ReferenceIter, error) {
+	refs, err := s.listRefs()
+	if err != nil {
+		return nil, err
+	}
+	if h, err := s.head(); err == nil {
+		refs = append([]*plumbing.Reference{h}, refs...)
+	} else if err != plumbing.ErrReferenceNotFound {
+		return nil, err
+	}
+	return storer.NewReferenceSliceIter(refs), nil
+}
+
+func (s *GitRefStorer) SetReference(ref *plumbing.Reference) error {
+	if ref.Type() == plumbing.SymbolicReference {
+		if err := flushObjects(s.Storer); err != nil {
+			return err
+		}
+		args := []string{"symbolic-ref"}
+		if s.ReflogMessage != "" {
+			args = append(args, "-m", s.ReflogMessage)
+		}
+		_, err := s.git(nil, append(args, ref.Name().String(), ref.Target().String())...)
+		return err
+	}
+	return s.UpdateRefs([]RefChange{{Name: ref.Name(), New: ref.Hash(), Force: true}})
+}
+
+func (s *GitRefStorer) CheckAndSetReference(ref, old *plumbing.Reference) error {
+	if old == nil {
+		return s.SetReference(ref)
+	}
+	if ref.Type() != plumbing.HashReference || old.Type() != plumbing.HashReference {
+		return fmt.Errorf("%s: can only check and set hash refs", ref.Name())
+	}
+	return s.UpdateRefs([]RefChange{{Name: ref.Name(), Old: old.Hash(), New: ref.Hash()}})
+}
+
+func (s *GitRefStorer) RemoveReference(name plumbing.ReferenceName) error {
+	return s.UpdateRefs([]RefChange{{Name: name, Force: true}})
+}
+
+// CountLooseRefs returns 0: git stores the refs.
+func (s *GitRefStorer) CountLooseRefs() (int, error) {
+	return 0, nil
+}
+
+// PackRefs lets git compact the refs.
+func (s *GitRefStorer) PackRefs() error {
+	_, err := s.git(nil, "pack-refs", "--all")
+	return err
+}
+
+// UpdateRefs applies the changes atomically with git update-ref
+// --stdin. If a ref is not at its Old value, it returns
+// storage.ErrReferenceHasChanged.
+func (s *GitRefStorer) UpdateRefs(changes []RefChange) error {
+	if err := flushObjects(s.Storer); err != nil {
+		return err
+	}
+	var cmds bytes.Buffer
+	for _, c := range changes {
+		switch {
+		case c.New.IsZero() && c.Force:
+			fmt.Fprintf(&cmds, "delete %s\n", c.Name)
+		case c.New.IsZero() && c.Old.IsZero():
+			fmt.Fprintf(&cmds, "verify %s %s\n", c.Name, c.Old)
+		case c.New.IsZero():
+			fmt.Fprintf(&cmds, "delete %s %s\n", c.Name, c.Old)
+		case c.Force:
+			fmt.Fprintf(&cmds, "update %s %s\n", c.Name, c.New)
+		default:
+			fmt.Fprintf(&cmds, "update %s %s %s\n", c.Name, c.New, c.Old)
+		}
+	}
+	args := []string{"update-ref", "--stdin", "--no-deref", "--create-reflog"}
+	if s.ReflogMessage != "" {
+		args = append(args, "-m", s.ReflogMessage)
+	}
+	_, err := s.git(cmds.Bytes(), args...)
+	if err != nil && strings.Contains(err.Error(), "cannot lock ref") {
+		return fmt.Errorf("%w: %v", storage.ErrReferenceHasChanged, err)
+	}
+	return err
+}
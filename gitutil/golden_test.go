@@ -0,0 +1,217 @@
+// Copyright 2023 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitutil_test
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/hanwen/allusersync/gitutil"
+)
+
+// gitRepo is a scratch repository for running the git CLI.
+type gitRepo struct {
+	t   *testing.T
+	dir string
+}
+
+func newGitRepo(t *testing.T) *gitRepo {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not in PATH")
+	}
+	r := &gitRepo{t: t, dir: t.TempDir()}
+	r.run(nil, "", "init", "-q", "--bare")
+	return r
+}
+
+// run runs git with stdin, and returns the trimmed output.
+func (r *gitRepo) run(env []string, stdin string, args ...string) string {
+	r.t.Helper()
+	cmd := exec.Command("git", append([]string{"--git-dir", r.dir}, args...)...)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdin = strings.NewReader(stdin)
+	out, err := cmd.Output()
+	if err != nil {
+		if ee, ok := err.(*exec.ExitError); ok {
+			r.t.Fatalf("git %v: %v: %s", args, err, ee.Stderr)
+		}
+		r.t.Fatalf("git %v: %v", args, err)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// mktree writes es with git mktree, in the given order.
+func (r *gitRepo) mktree(es []object.TreeEntry) string {
+	var in strings.Builder
+	for _, e := range es {
+		typ := "blob"
+		switch e.Mode {
+		case filemode.Dir:
+			typ = "tree"
+		case filemode.Submodule:
+			typ = "commit"
+		}
+		fmt.Fprintf(&in, "%06o %s %s\t%s\n", uint32(e.Mode), typ, e.Hash, e.Name)
+	}
+	return r.run(nil, in.String(), "mktree", "--missing")
+}
+
+func TestGoldenBlob(t *testing.T) {
+	r := newGitRepo(t)
+	st := memory.NewStorage()
+	for _, data := range []string{"", "a", "no newline", "line\n", "\x00binary\xff"} {
+		id, err := gitutil.SaveBlob(st, []byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := r.run(nil, data, "hash-object", "-w", "--stdin"); id.String() != want {
+			t.Errorf("%q: got %s, git has %s", data, id, want)
+		}
+	}
+}
+
+// goldenEntries has entries of all modes, with names whose order
+// depends on the '/' that git appends to directory names:
+// "a-b" < "a.b" < "a/" < "a0", and "b.txt" < "b/".
+func goldenEntries(r *gitRepo) []object.TreeEntry {
+	blob := plumbing.NewHash(r.run(nil, "content", "hash-object", "-w", "--stdin"))
+	sub := plumbing.NewHash(r.mktree([]object.TreeEntry{{Name: "f", Mode: filemode.Regular, Hash: blob}}))
+	return []object.TreeEntry{
+		{Name: "a-b", Mode: filemode.Regular, Hash: blob},
+		{Name: "a.b", Mode: filemode.Executable, Hash: blob},
+		{Name: "a", Mode: filemode.Dir, Hash: sub},
+		{Name: "a0", Mode: filemode.Symlink, Hash: blob},
+		{Name: "ab", Mode: filemode.Submodule, Hash: plumbing.NewHash("0123456789abcdef0123456789abcdef01234567")},
+		{Name: "b.txt", Mode: filemode.Regular, Hash: blob},
+		{Name: "b", Mode: filemode.Dir, Hash: sub},
+	}
+}
+
+func entryNames(es []object.TreeEntry) string {
+	var names []string
+	for _, e := range es {
+		names = append(names, e.Name)
+	}
+	return strings.Join(names, " ")
+}
+
+func TestGoldenSortTreeEntries(t *testing.T) {
+	r := newGitRepo(t)
+	want := goldenEntries(r)
+	id := r.mktree(want)
+	if got := r.run(nil, "", "ls-tree", "--name-only", id); got != strings.ReplaceAll(entryNames(want), " ", "\n") {
+		t.Fatalf("git orders the tree as %q, the test expects %q", got, entryNames(want))
+	}
+
+	es := goldenEntries(r)
+	for i, j := 0, len(es)-1; i < j; i, j = i+1, j-1 {
+		es[i], es[j] = es[j], es[i]
+	}
+	gitutil.SortTreeEntries(es)
+	if got := entryNames(es); got != entryNames(want) {
+		t.Errorf("got %q, want %q", got, entryNames(want))
+	}
+}
+
+func TestGoldenSaveTree(t *testing.T) {
+	r := newGitRepo(t)
+	st := memory.NewStorage()
+	es := goldenEntries(r)
+	for _, tc := range []struct {
+		name    string
+		entries []object.TreeEntry
+	}{
+		{"empty", nil},
+		{"file", es[:1]},
+		{"all", es},
+	} {
+		id, err := gitutil.SaveTree(st, append([]object.TreeEntry(nil), tc.entries...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := r.mktree(tc.entries); id.String() != want {
+			t.Errorf("%s: got %s, git has %s", tc.name, id, want)
+		}
+	}
+}
+
+func TestGoldenSaveCommit(t *testing.T) {
+	r := newGitRepo(t)
+	st := memory.NewStorage()
+	tree := plumbing.NewHash(r.mktree(goldenEntries(r)))
+	author := object.Signature{Name: "Jörg Author", Email: "jorg@example.com",
+		When: time.Unix(1234567890, 0).In(time.FixedZone("", 2*3600))}
+	committer := object.Signature{Name: "Gerrit Code Review", Email: "gerrit@example.com",
+		When: time.Unix(1234567990, 0).In(time.FixedZone("", -90*60))}
+	env := []string{
+		"GIT_AUTHOR_NAME=" + author.Name,
+		"GIT_AUTHOR_EMAIL=" + author.Email,
+		"GIT_AUTHOR_DATE=1234567890 +0200",
+		"GIT_COMMITTER_NAME=" + committer.Name,
+		"GIT_COMMITTER_EMAIL=" + committer.Email,
+		"GIT_COMMITTER_DATE=1234567990 -0130",
+	}
+
+	var parents []plumbing.Hash
+	for _, tc := range []struct {
+		name    string
+		message string
+		headers gitutil.CommitHeaders
+	}{
+		{"root", "Create account\n", gitutil.CommitHeaders{}},
+		{"child", "Update account\n\nWith a body.\n", gitutil.CommitHeaders{}},
+		{"no newline", "Update account", gitutil.CommitHeaders{}},
+		{"encoding", "Update account\n", gitutil.CommitHeaders{Encoding: "ISO-8859-1"}},
+	} {
+		c := &object.Commit{
+			Author:       author,
+			Committer:    committer,
+			Message:      tc.message,
+			TreeHash:     tree,
+			ParentHashes: parents,
+		}
+		id, err := gitutil.SaveCommitHeaders(st, c, tc.headers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.headers == (gitutil.CommitHeaders{}) {
+			if plain, err := gitutil.SaveCommit(st, c); err != nil || plain != id {
+				t.Errorf("%s: SaveCommit gives %s, %v; SaveCommitHeaders %s", tc.name, plain, err, id)
+			}
+		}
+
+		args := []string{"commit-tree", tree.String()}
+		if tc.headers.Encoding != "" {
+			args = append([]string{"-c", "i18n.commitEncoding=" + tc.headers.Encoding}, args...)
+		}
+		for _, p := range parents {
+			args = append(args, "-p", p.String())
+		}
+		want := r.run(env, tc.message, args...)
+		if id.String() != want {
+			t.Errorf("%s: got %s, git has %s", tc.name, id, want)
+		}
+		// Chain the commits, so parents are checked too.
+		parents = []plumbing.Hash{plumbing.NewHash(want)}
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2023 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitutil
+
+import (
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+)
+
+// WalkHistory calls fn for start and all its ancestors, each once,
+// newest committer time first. If fn returns storer.ErrStop, the walk
+// ends without error.
+func WalkHistory(st storer.EncodedObjectStorer, start plumbing.Hash, fn func(*object.Commit) error) error {
+	c, err := object.GetCommit(st, start)
+	if err != nil {
+		return err
+	}
+	it := object.NewCommitIterCTime(c, nil, nil)
+	defer it.Close()
+	return it.ForEach(fn)
+}
+
+// WalkRef is WalkHistory starting from the commit that ref points to.
+func WalkRef(st storer.Storer, ref plumbing.ReferenceName, fn func(*object.Commit) error) error {
+	r, err := storer.ResolveReference(st, ref)
+	if err != nil {
+		return err
+	}
+	return WalkHistory(st, r.Hash(), fn)
+}
+
+// pathHash returns the ID of the file or directory at p in c, or the
+// ZeroHash if it does not exist.
+func pathHash(st storer.EncodedObjectStorer, c *object.Commit, p string) (plumbing.Hash, error) {
+	if p == "" {
+		return c.TreeHash, nil
+	}
+	tree, err := object.GetTree(st, c.TreeHash)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	e, err := tree.FindEntry(p)
+	if err == object.ErrEntryNotFound || err == object.ErrDirectoryNotFound {
+		return plumbing.ZeroHash, nil
+	} else if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return e.Hash, nil
+}
+
+// LastChange returns the newest commit along the first parents of
+// start that changed, added or removed the file or directory at p, or
+// nil if p never existed.
+func LastChange(st storer.EncodedObjectStorer, start plumbing.Hash, p string) (*object.Commit, error) {
+	c, err := object.GetCommit(st, start)
+	if err != nil {
+		return nil, err
+	}
+	id, err := pathHash(st, c, p)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if c.NumParents() == 0 {
+			if id == plumbing.ZeroHash {
+				return nil, nil
+			}
+			return c, nil
+		}
+		parent, err := object.GetCommit(st, c.ParentHashes[0])
+		if err != nil {
+			return nil, err
+		}
+		parentID, err := pathHash(st, parent, p)
+		if err != nil {
+			return nil, err
+		}
+		if parentID != id {
+			return c, nil
+		}
+		c = parent
+	}
+}
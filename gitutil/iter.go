@@ -0,0 +1,110 @@
+// Copyright 2023 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitutil
+
+import (
+	"io"
+	"path"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+)
+
+type iterFrame struct {
+	dir     string
+	entries []object.TreeEntry
+}
+
+// TreeIter returns the files of a tree, depth first in tree order.
+// Subtrees are read when the iteration reaches them, so only the trees
+// on the path to the current file are in memory.
+type TreeIter struct {
+	st    storer.EncodedObjectStorer
+	root  plumbing.Hash
+	stack []*iterFrame
+}
+
+// NewTreeIter iterates over the tree root. The ZeroHash is the empty
+// tree.
+func NewTreeIter(st storer.EncodedObjectStorer, root plumbing.Hash) *TreeIter {
+	return &TreeIter{st: st, root: root}
+}
+
+func (it *TreeIter) push(dir string, id plumbing.Hash) error {
+	t, err := object.GetTree(it.st, id)
+	if err != nil {
+		return err
+	}
+	it.stack = append(it.stack, &iterFrame{dir: dir, entries: t.Entries})
+	return nil
+}
+
+// Next returns the next file; its entry name is the full path. At the
+// end, it returns io.EOF.
+func (it *TreeIter) Next() (object.TreeEntry, error) {
+	if it.root != plumbing.ZeroHash {
+		root := it.root
+		it.root = plumbing.ZeroHash
+		if err := it.push("", root); err != nil {
+			return object.TreeEntry{}, err
+		}
+	}
+	for len(it.stack) > 0 {
+		top := it.stack[len(it.stack)-1]
+		if len(top.entries) == 0 {
+			it.stack = it.stack[:len(it.stack)-1]
+			continue
+		}
+		e := top.entries[0]
+		top.entries = top.entries[1:]
+		e.Name = path.Join(top.dir, e.Name)
+		if e.Mode == filemode.Dir {
+			if err := it.push(e.Name, e.Hash); err != nil {
+				return object.TreeEntry{}, err
+			}
+			continue
+		}
+		return e, nil
+	}
+	return object.TreeEntry{}, io.EOF
+}
+
+// ForEachNote calls fn for each note in a notes tree of either layout,
+// without loading the whole tree. Files that are not notes are
+// skipped. If fn returns storer.ErrStop, the iteration ends without
+// error.
+func ForEachNote(st storer.EncodedObjectStorer, tree plumbing.Hash, fn func(name string, id plumbing.Hash) error) error {
+	it := NewTreeIter(st, tree)
+	for {
+		e, err := it.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		name := strings.ReplaceAll(e.Name, "/", "")
+		if !IsNoteName(name) {
+			continue
+		}
+		if err := fn(name, e.Hash); err == storer.ErrStop {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
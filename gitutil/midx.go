@@ -0,0 +1,237 @@
+// Copyright 2023 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitutil
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/idxfile"
+)
+
+// MultiPackIndexFile is the multi-pack-index in the git directory.
+const MultiPackIndexFile = "objects/pack/multi-pack-index"
+
+// ListPacks returns the names of the pack indexes in the git directory
+// fs that have a packfile, eg. "pack-123.idx", in lexicographic
+// order.
+func ListPacks(fs billy.Filesystem) ([]string, error) {
+	fis, err := fs.ReadDir("objects/pack")
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, fi := range fis {
+		n := fi.Name()
+		if !strings.HasPrefix(n, "pack-") || !strings.HasSuffix(n, ".idx") {
+			continue
+		}
+		if _, err := fs.Stat(path.Join("objects/pack", strings.TrimSuffix(n, ".idx")+".pack")); err != nil {
+			continue
+		}
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// midxObject is where the multi-pack-index finds an object.
+type midxObject struct {
+	id     plumbing.Hash
+	pack   uint32
+	offset uint64
+}
+
+// openPackIndex reads the pack index of the given name, eg.
+// "pack-123.idx".
+func openPackIndex(fs billy.Filesystem, name string) (*idxfile.MemoryIndex, error) {
+	f, err := fs.Open(path.Join("objects/pack", name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	idx := idxfile.NewMemoryIndex()
+	if err := idxfile.NewDecoder(f).Decode(idx); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return idx, nil
+}
+
+// loadPackIndex reads the objects of a pack index.
+func loadPackIndex(fs billy.Filesystem, name string, pack uint32) ([]midxObject, error) {
+	idx, err := openPackIndex(fs, name)
+	if err != nil {
+		return nil, err
+	}
+	it, err := idx.Entries()
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+	var objs []midxObject
+	for {
+		e, err := it.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		objs = append(objs, midxObject{id: e.Hash, pack: pack, offset: e.Offset})
+	}
+	return objs, nil
+}
+
+// WriteMultiPackIndex replaces the multi-pack-index in the git
+// directory fs with one covering all packs, so git looks up objects in
+// one index rather than in every pack. It returns the number of packs
+// and objects. An object in several packs is found in the newest
+// pack, as git does.
+func WriteMultiPackIndex(fs billy.Filesystem) (packs, objects int, err error) {
+	names, err := ListPacks(fs)
+	if err != nil {
+		return 0, 0, err
+	}
+	mtimes := make([]time.Time, len(names))
+	var objs []midxObject
+	for i, n := range names {
+		fi, err := fs.Stat(path.Join("objects/pack", strings.TrimSuffix(n, ".idx")+".pack"))
+		if err != nil {
+			return 0, 0, err
+		}
+		mtimes[i] = fi.ModTime()
+		po, err := loadPackIndex(fs, n, uint32(i))
+		if err != nil {
+			return 0, 0, err
+		}
+		objs = append(objs, po...)
+	}
+	sort.Slice(objs, func(i, j int) bool {
+		if c := bytes.Compare(objs[i].id[:], objs[j].id[:]); c != 0 {
+			return c < 0
+		}
+		return mtimes[objs[i].pack].After(mtimes[objs[j].pack])
+	})
+	uniq := objs[:0]
+	for i, o := range objs {
+		if i == 0 || o.id != objs[i-1].id {
+			uniq = append(uniq, o)
+		}
+	}
+	objs = uniq
+
+	var buf bytes.Buffer
+	encodeMultiPackIndex(&buf, names, objs)
+
+	lock := MultiPackIndexFile + ".lock"
+	f, err := fs.OpenFile(lock, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o444)
+	if os.IsExist(err) {
+		return 0, 0, fmt.Errorf("%s: locked by another process; remove %s if it is stale", MultiPackIndexFile, lock)
+	} else if err != nil {
+		return 0, 0, err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		fs.Remove(lock)
+		return 0, 0, err
+	}
+	if err := f.Close(); err != nil {
+		fs.Remove(lock)
+		return 0, 0, err
+	}
+	if err := fs.Rename(lock, MultiPackIndexFile); err != nil {
+		fs.Remove(lock)
+		return 0, 0, err
+	}
+	return len(names), len(objs), nil
+}
+
+type midxChunk struct {
+	id   string
+	data *bytes.Buffer
+}
+
+// encodeMultiPackIndex writes version 1 of the format, with SHA-1
+// object IDs, and without reverse index or bitmaps.
+func encodeMultiPackIndex(w *bytes.Buffer, names []string, objs []midxObject) {
+	var pnam, oidf, oidl, ooff, loff bytes.Buffer
+	for _, n := range names {
+		pnam.WriteString(n)
+		pnam.WriteByte(0)
+	}
+	for pnam.Len()%4 != 0 {
+		pnam.WriteByte(0)
+	}
+
+	var fanout [256]uint32
+	for _, o := range objs {
+		fanout[o.id[0]]++
+	}
+	for i := 1; i < len(fanout); i++ {
+		fanout[i] += fanout[i-1]
+	}
+	binary.Write(&oidf, binary.BigEndian, fanout)
+
+	nlarge := uint32(0)
+	for _, o := range objs {
+		oidl.Write(o.id[:])
+		off := uint32(o.offset)
+		if o.offset >= 1<<31 {
+			off = 1<<31 | nlarge
+			nlarge++
+			binary.Write(&loff, binary.BigEndian, o.offset)
+		}
+		binary.Write(&ooff, binary.BigEndian, [2]uint32{o.pack, off})
+	}
+
+	chunks := []midxChunk{
+		{"PNAM", &pnam},
+		{"OIDF", &oidf},
+		{"OIDL", &oidl},
+		{"OOFF", &ooff},
+	}
+	if nlarge > 0 {
+		chunks = append(chunks, midxChunk{"LOFF", &loff})
+	}
+
+	h := sha1.New()
+	out := io.MultiWriter(w, h)
+	out.Write([]byte("MIDX"))
+	out.Write([]byte{1, 1, byte(len(chunks)), 0})
+	binary.Write(out, binary.BigEndian, uint32(len(names)))
+	offset := uint64(12 + 12*(len(chunks)+1))
+	for _, c := range chunks {
+		out.Write([]byte(c.id))
+		binary.Write(out, binary.BigEndian, offset)
+		offset += uint64(c.data.Len())
+	}
+	out.Write([]byte{0, 0, 0, 0})
+	binary.Write(out, binary.BigEndian, offset)
+	for _, c := range chunks {
+		out.Write(c.data.Bytes())
+	}
+	w.Write(h.Sum(nil))
+}
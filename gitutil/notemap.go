@@ -0,0 +1,273 @@
+// Copyright 2023 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitutil
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+)
+
+// MaxLeafNotes is the largest number of notes kept in a single tree,
+// as in JGit's LeafBucket. Larger buckets are split into fanout
+// directories named after the next 2 hex digits of the note name.
+const MaxLeafNotes = 256
+
+// NoteLayout is the way notes are spread over directories.
+type NoteLayout string
+
+const (
+	// AutoLayout splits buckets that grow beyond MaxLeafNotes, as
+	// JGit does.
+	AutoLayout NoteLayout = ""
+
+	// FlatLayout keeps all notes in the root tree.
+	FlatLayout NoteLayout = "flat"
+
+	// FanoutLayout puts every note in a directory named after its
+	// first 2 hex digits.
+	FanoutLayout NoteLayout = "fanout"
+)
+
+// ParseNoteLayout parses a layout name: auto, flat or fanout.
+func ParseNoteLayout(s string) (NoteLayout, error) {
+	switch l := NoteLayout(s); l {
+	case FlatLayout, FanoutLayout:
+		return l, nil
+	case "auto":
+		return AutoLayout, nil
+	}
+	return "", fmt.Errorf("layout must be auto, flat or fanout, got %q", s)
+}
+
+// NoteName returns the note name for a key, its hex SHA-1, as Gerrit
+// uses for external IDs and group names.
+func NoteName(key string) string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(key)))
+}
+
+// IsNoteName returns true for 40 hex digit names.
+func IsNoteName(name string) bool {
+	if len(name) != 2*len(plumbing.ZeroHash) {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil
+}
+
+// NoteMap is a notes tree, such as refs/meta/external-ids, keyed by
+// the hex note name.
+type NoteMap struct {
+	base *object.Tree
+
+	// notes holds the blob per note name.
+	notes map[string]plumbing.Hash
+
+	// orig holds the entry in base per note name; the entry name is
+	// the full path.
+	orig map[string]object.TreeEntry
+
+	// Layout selects the tree layout that Write produces.
+	// LoadNoteMap sets it to the layout of the tree.
+	Layout NoteLayout
+}
+
+// LoadNoteMap reads a notes tree in either flat or fanout layout. A
+// nil tree yields an empty map. Files that are not notes are left
+// alone. The Layout is the one the tree has, so Write keeps a layout
+// chosen earlier; see detectLayout.
+func LoadNoteMap(tree *object.Tree) (*NoteMap, error) {
+	m := &NoteMap{
+		base:  tree,
+		notes: map[string]plumbing.Hash{},
+		orig:  map[string]object.TreeEntry{},
+	}
+	if tree == nil {
+		m.base = &object.Tree{}
+		return m, nil
+	}
+
+	walker := object.NewTreeWalker(tree, true, nil)
+	defer walker.Close()
+	for {
+		p, e, err := walker.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if e.Mode == filemode.Dir {
+			continue
+		}
+		name := strings.ReplaceAll(p, "/", "")
+		if !IsNoteName(name) {
+			continue
+		}
+		m.notes[name] = e.Hash
+		m.orig[name] = object.TreeEntry{Name: p, Mode: e.Mode, Hash: e.Hash}
+	}
+	m.Layout = m.detectLayout()
+	return m, nil
+}
+
+// detectLayout returns AutoLayout if the notes are where AutoLayout
+// puts them, and otherwise FlatLayout or FanoutLayout if all notes
+// are in the root or in 2 digit directories. Up to MaxLeafNotes, a
+// flat tree is also the auto layout, and is split once it grows.
+func (m *NoteMap) detectLayout() NoteLayout {
+	flat, fanout := true, true
+	for n, e := range m.orig {
+		flat = flat && e.Name == n
+		fanout = fanout && e.Name == n[:2]+"/"+n[2:]
+	}
+	if !flat && !fanout {
+		return AutoLayout
+	}
+	paths := map[string]string{}
+	layout(m.Names(), 0, "", paths)
+	auto := true
+	for n, p := range paths {
+		auto = auto && m.orig[n].Name == p
+	}
+	switch {
+	case auto:
+		return AutoLayout
+	case flat:
+		return FlatLayout
+	default:
+		return FanoutLayout
+	}
+}
+
+// Get returns the blob ID of a note, and whether the note exists.
+func (m *NoteMap) Get(name string) (plumbing.Hash, bool) {
+	id, ok := m.notes[name]
+	return id, ok
+}
+
+// Set adds or replaces a note.
+func (m *NoteMap) Set(name string, id plumbing.Hash) {
+	m.notes[name] = id
+}
+
+// Remove deletes a note, if it exists.
+func (m *NoteMap) Remove(name string) {
+	delete(m.notes, name)
+}
+
+// Len returns the number of notes.
+func (m *NoteMap) Len() int {
+	return len(m.notes)
+}
+
+// Names returns the note names, sorted.
+func (m *NoteMap) Names() []string {
+	var names []string
+	for n := range m.notes {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Path returns the path of a note in the tree the map was loaded
+// from, eg. "ab/cdef...". It returns false for notes that were added
+// since.
+func (m *NoteMap) Path(name string) (string, bool) {
+	e, ok := m.orig[name]
+	return e.Name, ok
+}
+
+// layout computes the path of each note in names, which share the
+// first 2*depth hex digits.
+func layout(names []string, depth int, prefix string, out map[string]string) {
+	if len(names) <= MaxLeafNotes {
+		for _, n := range names {
+			out[n] = prefix + n[2*depth:]
+		}
+		return
+	}
+
+	for len(names) > 0 {
+		fan := names[0][2*depth : 2*depth+2]
+		end := sort.Search(len(names), func(i int) bool {
+			return names[i][2*depth:2*depth+2] > fan
+		})
+		layout(names[:end], depth+1, prefix+fan+"/", out)
+		names = names[end:]
+	}
+}
+
+// Write stores the notes as a tree, and returns its ID. With
+// AutoLayout, buckets that grew beyond MaxLeafNotes are split, and
+// fanout directories that shrank are collapsed again. The layout is
+// computed over all notes, so even a single change costs time in
+// proportion to Len; write once after many changes rather than after
+// each.
+func (m *NoteMap) Write(st storer.EncodedObjectStorer) (plumbing.Hash, error) {
+	names := m.Names()
+	paths := map[string]string{}
+	switch m.Layout {
+	case FlatLayout:
+		for _, n := range names {
+			paths[n] = n
+		}
+	case FanoutLayout:
+		for _, n := range names {
+			paths[n] = n[:2] + "/" + n[2:]
+		}
+	default:
+		layout(names, 0, "", paths)
+	}
+
+	var changes []object.TreeEntry
+	for n, old := range m.orig {
+		if _, ok := m.notes[n]; !ok || paths[n] != old.Name {
+			changes = append(changes, object.TreeEntry{
+				Name: old.Name,
+				Hash: plumbing.ZeroHash,
+			})
+		}
+	}
+	for _, n := range names {
+		p := paths[n]
+		if old, ok := m.orig[n]; ok && old.Name == p && old.Hash == m.notes[n] {
+			continue
+		}
+		changes = append(changes, object.TreeEntry{
+			Name: p,
+			Mode: filemode.Regular,
+			Hash: m.notes[n],
+		})
+	}
+
+	id, err := PatchTree(st, m.base, changes)
+	if err != nil {
+		return id, err
+	}
+	if id == plumbing.ZeroHash {
+		// PatchTree drops empty trees, but a commit needs one.
+		return SaveTree(st, nil)
+	}
+	return id, nil
+}
@@ -0,0 +1,90 @@
+// Copyright 2023 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitutil_test
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/hanwen/allusersync/gitutil"
+)
+
+func TestLoadNoteMapKeepsLayout(t *testing.T) {
+	for _, tc := range []struct {
+		layout gitutil.NoteLayout
+		n      int
+		// want is the layout LoadNoteMap finds.
+		want gitutil.NoteLayout
+	}{
+		{gitutil.FlatLayout, 300, gitutil.FlatLayout},
+		{gitutil.FanoutLayout, 10, gitutil.FanoutLayout},
+		{gitutil.FanoutLayout, 300, gitutil.AutoLayout},
+		{gitutil.FanoutLayout, 70000, gitutil.FanoutLayout},
+		{gitutil.AutoLayout, 10, gitutil.AutoLayout},
+		{gitutil.AutoLayout, 70000, gitutil.AutoLayout},
+		// Indistinguishable from the auto layout.
+		{gitutil.FlatLayout, 10, gitutil.AutoLayout},
+	} {
+		st := memory.NewStorage()
+		m, err := gitutil.LoadNoteMap(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.Layout = tc.layout
+		blob := gitutil.HashBlob([]byte("note"))
+		for i := 0; i < tc.n; i++ {
+			m.Set(gitutil.NoteName(strconv.Itoa(i)), blob)
+		}
+		id, err := m.Write(st)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tree, err := object.GetTree(st, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := gitutil.LoadNoteMap(tree)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if loaded.Layout != tc.want {
+			t.Errorf("%q layout of %d notes: loaded as %q, want %q", tc.layout, tc.n, loaded.Layout, tc.want)
+			continue
+		}
+
+		// Writing a change must keep the paths of the other notes.
+		loaded.Set(gitutil.NoteName("new"), blob)
+		id, err = loaded.Write(st)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tree, err = object.GetTree(st, id); err != nil {
+			t.Fatal(err)
+		}
+		reloaded, err := gitutil.LoadNoteMap(tree)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, n := range loaded.Names() {
+			want, ok := loaded.Path(n)
+			if got, _ := reloaded.Path(n); ok && got != want {
+				t.Errorf("%q layout of %d notes: %s moved from %s to %s", tc.layout, tc.n, n, want, got)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,268 @@
+// Copyright 2023 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitutil
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/storage"
+)
+
+const packedRefsFile = "packed-refs"
+
+// RefChange moves a ref from Old to New. The ZeroHash as Old means the
+// ref must not exist, unless Force is set; as New, it deletes the ref.
+type RefChange struct {
+	Name     plumbing.ReferenceName
+	Old, New plumbing.Hash
+
+	// Force skips the check of Old.
+	Force bool
+}
+
+// ErrIncompleteUpdate is returned if packed-refs was replaced, but
+// loose refs that shadow it could not be removed.
+var ErrIncompleteUpdate = errors.New("ref update incomplete")
+
+// PackedRefsStorer writes ref updates in batches to packed-refs. It
+// uses git's lock files, so it is safe against concurrent git and
+// JGit processes. Single updates of hash refs also go to packed-refs;
+// go-git gets them wrong for refs that are only in packed-refs.
+type PackedRefsStorer struct {
+	storage.Storer
+	fs billy.Filesystem
+}
+
+// NewPackedRefsStorer writes packed-refs in the git directory fs of
+// base.
+func NewPackedRefsStorer(base storage.Storer, fs billy.Filesystem) *PackedRefsStorer {
+	return &PackedRefsStorer{Storer: base, fs: fs}
+}
+
+// Unwrap returns the underlying storage.
+func (s *PackedRefsStorer) Unwrap() storage.Storer {
+	return s.Storer
+}
+
+func (s *PackedRefsStorer) SetReference(ref *plumbing.Reference) error {
+	if ref.Type() != plumbing.HashReference {
+		return s.Storer.SetReference(ref)
+	}
+	return s.UpdateRefs([]RefChange{{Name: ref.Name(), New: ref.Hash(), Force: true}})
+}
+
+func (s *PackedRefsStorer) CheckAndSetReference(ref, old *plumbing.Reference) error {
+	if old == nil {
+		return s.SetReference(ref)
+	}
+	if ref.Type() != plumbing.HashReference || old.Type() != plumbing.HashReference {
+		return s.Storer.CheckAndSetReference(ref, old)
+	}
+	return s.UpdateRefs([]RefChange{{Name: ref.Name(), Old: old.Hash(), New: ref.Hash()}})
+}
+
+func (s *PackedRefsStorer) RemoveReference(name plumbing.ReferenceName) error {
+	return s.UpdateRefs([]RefChange{{Name: name, Force: true}})
+}
+
+// flushObjects flushes a BatchStorer below st, so refs don't point to
+// objects that are not written yet.
+func flushObjects(st storage.Storer) error {
+	for {
+		if f, ok := st.(interface{ Flush() error }); ok {
+			return f.Flush()
+		}
+		u, ok := st.(interface{ Unwrap() storage.Storer })
+		if !ok {
+			return nil
+		}
+		st = u.Unwrap()
+	}
+}
+
+// packedRef is a line of packed-refs, with its peeled line, if any.
+type packedRef struct {
+	id     plumbing.Hash
+	peeled string
+}
+
+func (s *PackedRefsStorer) readPackedRefs() (map[plumbing.ReferenceName]*packedRef, error) {
+	refs := map[plumbing.ReferenceName]*packedRef{}
+	f, err := s.fs.Open(packedRefsFile)
+	if os.IsNotExist(err) {
+		return refs, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var last *packedRef
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		l := sc.Text()
+		switch {
+		case l == "" || l[0] == '#':
+		case l[0] == '^':
+			if last == nil {
+				return nil, fmt.Errorf("%s: peeled line %q without ref", packedRefsFile, l)
+			}
+			last.peeled = l
+		default:
+			fields := strings.Fields(l)
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("%s: malformed line %q", packedRefsFile, l)
+			}
+			last = &packedRef{id: plumbing.NewHash(fields[0])}
+			refs[plumbing.ReferenceName(fields[1])] = last
+		}
+	}
+	return refs, sc.Err()
+}
+
+// readLooseRef returns the ID in a loose ref, whether it exists, and
+// an error for symbolic refs.
+func (s *PackedRefsStorer) readLooseRef(name plumbing.ReferenceName) (plumbing.Hash, bool, error) {
+	f, err := s.fs.Open(name.String())
+	if os.IsNotExist(err) {
+		return plumbing.ZeroHash, false, nil
+	} else if err != nil {
+		return plumbing.ZeroHash, false, err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return plumbing.ZeroHash, false, err
+	}
+	line := strings.TrimSpace(string(data))
+	if strings.HasPrefix(line, "ref: ") {
+		return plumbing.ZeroHash, false, fmt.Errorf("%s: is a symbolic ref", name)
+	}
+	return plumbing.NewHash(line), true, nil
+}
+
+// lock creates path.lock, failing if it exists, as git does.
+func (s *PackedRefsStorer) lock(path string) (billy.File, error) {
+	f, err := s.fs.OpenFile(path+".lock", os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if os.IsExist(err) {
+		return nil, fmt.Errorf("%s: locked by another process; remove %s.lock if it is stale", path, path)
+	}
+	return f, err
+}
+
+// UpdateRefs applies the changes atomically: either packed-refs is
+// replaced with all changes, or no ref changes. If a ref is not at its
+// Old value, it returns storage.ErrReferenceHasChanged. Loose refs of
+// the changed names are removed after packed-refs is replaced; if that
+// fails, the error wraps ErrIncompleteUpdate.
+func (s *PackedRefsStorer) UpdateRefs(changes []RefChange) (err error) {
+	if err := flushObjects(s.Storer); err != nil {
+		return err
+	}
+
+	var locks []string
+	defer func() {
+		for _, l := range locks {
+			s.fs.Remove(l + ".lock")
+		}
+	}()
+	for _, c := range changes {
+		f, err := s.lock(c.Name.String())
+		if err != nil {
+			return err
+		}
+		locks = append(locks, c.Name.String())
+		f.Close()
+	}
+	packed, err := s.lock(packedRefsFile)
+	if err != nil {
+		return err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			packed.Close()
+			s.fs.Remove(packedRefsFile + ".lock")
+		}
+	}()
+
+	refs, err := s.readPackedRefs()
+	if err != nil {
+		return err
+	}
+	var loose []plumbing.ReferenceName
+	for _, c := range changes {
+		cur, ok, err := s.readLooseRef(c.Name)
+		if err != nil {
+			return err
+		}
+		if ok {
+			loose = append(loose, c.Name)
+		} else if p := refs[c.Name]; p != nil {
+			cur = p.id
+		}
+		if !c.Force && cur != c.Old {
+			return fmt.Errorf("%s: %w: want %s, have %s", c.Name, storage.ErrReferenceHasChanged, c.Old, cur)
+		}
+		if c.New.IsZero() {
+			delete(refs, c.Name)
+		} else {
+			refs[c.Name] = &packedRef{id: c.New}
+		}
+	}
+
+	var names []string
+	for n := range refs {
+		names = append(names, n.String())
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	// We don't peel the refs we write, so we can't claim the
+	// peeled traits; the peeled lines that we keep are still used.
+	buf.WriteString("# pack-refs with: sorted \n")
+	for _, n := range names {
+		r := refs[plumbing.ReferenceName(n)]
+		fmt.Fprintf(&buf, "%s %s\n", r.id, n)
+		if r.peeled != "" {
+			fmt.Fprintf(&buf, "%s\n", r.peeled)
+		}
+	}
+	if _, err := packed.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	if err := packed.Close(); err != nil {
+		return err
+	}
+	committed = true
+	if err := s.fs.Rename(packedRefsFile+".lock", packedRefsFile); err != nil {
+		s.fs.Remove(packedRefsFile + ".lock")
+		return err
+	}
+
+	for _, n := range loose {
+		if err := s.fs.Remove(n.String()); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("%w: %s: %v", ErrIncompleteUpdate, n, err)
+		}
+	}
+	return nil
+}
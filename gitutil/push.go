@@ -0,0 +1,149 @@
+// Copyright 2023 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/capability"
+	"github.com/go-git/go-git/v5/plumbing/revlist"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
+	"github.com/go-git/go-git/v5/storage"
+)
+
+// ErrNotAtomic is returned by PushRefs for several refs if the remote
+// cannot update them atomically, so a failure could leave it with only
+// some of them updated.
+var ErrNotAtomic = errors.New("remote does not support atomic pushes")
+
+// PushRefs sets refs of the repository at url to the New IDs of
+// changes, sending the objects of st that the remote lacks. Like `git
+// push --force-with-lease=REF:OLD`, a ref only moves if the remote has
+// it at Old, so a ref that someone else updated is never overwritten;
+// an Old of ZeroHash means the ref must not exist, and a New of
+// ZeroHash deletes it. The remote checks Old under its ref lock. Refs
+// that the remote has at New already are skipped. The push is atomic;
+// pushing several refs to a remote that does not support that fails
+// with ErrNotAtomic. Force is ignored.
+func PushRefs(st storage.Storer, url string, auth transport.AuthMethod, changes []RefChange) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	ep, err := transport.NewEndpoint(url)
+	if err != nil {
+		return err
+	}
+	c, err := client.NewClient(ep)
+	if err != nil {
+		return err
+	}
+	sess, err := c.NewReceivePackSession(ep, auth)
+	if err != nil {
+		return err
+	}
+	defer sess.Close()
+	ar, err := sess.AdvertisedReferences()
+	if err != nil {
+		return err
+	}
+	remoteRefs, err := ar.AllReferences()
+	if err != nil {
+		return err
+	}
+
+	req := packp.NewReferenceUpdateRequestFromCapabilities(ar.Capabilities)
+	if ar.Capabilities.Supports(capability.Atomic) {
+		req.Capabilities.Set(capability.Atomic)
+	}
+	var moved []string
+	var tips []plumbing.Hash
+	for _, ch := range changes {
+		cur := plumbing.ZeroHash
+		if r, ok := remoteRefs[ch.Name]; ok {
+			cur = r.Hash()
+		}
+		if cur == ch.New {
+			// Eg. from an earlier push that failed halfway.
+			continue
+		}
+		// Failing here saves sending the objects.
+		if cur != ch.Old {
+			moved = append(moved, fmt.Sprintf("%s is at %s, want %s", ch.Name, cur, ch.Old))
+			continue
+		}
+		if ch.New.IsZero() && !ar.Capabilities.Supports(capability.DeleteRefs) {
+			return fmt.Errorf("%s: remote does not support deleting refs", ch.Name)
+		}
+		req.Commands = append(req.Commands, &packp.Command{Name: ch.Name, Old: ch.Old, New: ch.New})
+		if !ch.New.IsZero() {
+			tips = append(tips, ch.New)
+		}
+	}
+	if len(moved) > 0 {
+		return fmt.Errorf("%w on the remote:\n  %s", storage.ErrReferenceHasChanged, strings.Join(moved, "\n  "))
+	}
+	if len(req.Commands) == 0 {
+		return nil
+	}
+	if len(req.Commands) > 1 && !ar.Capabilities.Supports(capability.Atomic) {
+		return fmt.Errorf("%w, so %d refs could be left half updated", ErrNotAtomic, len(req.Commands))
+	}
+
+	var haves []plumbing.Hash
+	for _, r := range remoteRefs {
+		if r.Type() == plumbing.HashReference && st.HasEncodedObject(r.Hash()) == nil {
+			haves = append(haves, r.Hash())
+		}
+	}
+	var objs []plumbing.Hash
+	if len(tips) > 0 {
+		if objs, err = revlist.Objects(st, tips, haves); err != nil {
+			return err
+		}
+	}
+
+	// As in go-git, a pack goes along unless all commands delete.
+	done := make(chan error, 1)
+	if len(tips) > 0 {
+		rd, wr := io.Pipe()
+		req.Packfile = rd
+		go func() {
+			_, err := packfile.NewEncoder(wr, st, !ar.Capabilities.Supports(capability.OFSDelta)).Encode(objs, packWindow)
+			done <- wr.CloseWithError(err)
+		}()
+		defer rd.Close()
+	} else {
+		close(done)
+	}
+	rs, err := sess.ReceivePack(context.Background(), req)
+	if err != nil {
+		return err
+	}
+	if err := <-done; err != nil {
+		return err
+	}
+	if rs != nil {
+		return rs.Error()
+	}
+	return nil
+}
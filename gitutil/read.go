@@ -0,0 +1,87 @@
+// Copyright 2023 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitutil
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/config"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+)
+
+// LoadBlob returns the contents of the blob id.
+func LoadBlob(st storer.EncodedObjectStorer, id plumbing.Hash) ([]byte, error) {
+	blob, err := object.GetBlob(st, id)
+	if err != nil {
+		return nil, err
+	}
+	r, err := blob.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// LoadConfig reads the blob id, and parses it with ParseConfig.
+func LoadConfig(st storer.EncodedObjectStorer, id plumbing.Hash) (*config.Config, error) {
+	data, err := LoadBlob(st, id)
+	if err != nil {
+		return nil, err
+	}
+	return ParseConfig(data)
+}
+
+// ParseConfig parses a blob in git config format, as read by
+// LoadConfig or ObjectReader.
+func ParseConfig(data []byte) (*config.Config, error) {
+	cfg := config.New()
+	if err := config.NewDecoder(bytes.NewReader(data)).Decode(cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// FindFile returns the blob ID of a file in the tree of a commit, or
+// the ZeroHash if the commit is nil or lacks the file.
+func FindFile(st storer.EncodedObjectStorer, c *object.Commit, name string) (plumbing.Hash, error) {
+	if c == nil {
+		return plumbing.ZeroHash, nil
+	}
+	tree, err := object.GetTree(st, c.TreeHash)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	e, err := tree.FindEntry(name)
+	if err == object.ErrEntryNotFound || err == object.ErrDirectoryNotFound {
+		return plumbing.ZeroHash, nil
+	} else if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return e.Hash, nil
+}
+
+// LoadCommitConfig reads a config file from a commit. It returns nil if
+// the commit is nil or lacks the file.
+func LoadCommitConfig(st storer.EncodedObjectStorer, c *object.Commit, name string) (*config.Config, error) {
+	id, err := FindFile(st, c, name)
+	if err != nil || id == plumbing.ZeroHash {
+		return nil, err
+	}
+	return LoadConfig(st, id)
+}
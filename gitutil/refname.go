@@ -0,0 +1,92 @@
+// Copyright 2023 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitutil
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// CheckRefName returns an error if git would refuse name, following
+// the rules of git check-ref-format. The name must have at least two
+// components, eg. "refs/x".
+func CheckRefName(name plumbing.ReferenceName) error {
+	s := string(name)
+	bad := func(why string) error {
+		return fmt.Errorf("invalid ref name %q: %s", s, why)
+	}
+	if s == "" {
+		return bad("empty")
+	}
+	if s == "@" {
+		return bad(`"@" is reserved`)
+	}
+	if strings.HasPrefix(s, "/") || strings.HasSuffix(s, "/") {
+		return bad("starts or ends with /")
+	}
+	if strings.HasSuffix(s, ".") {
+		return bad("ends with .")
+	}
+	for _, seq := range []string{"..", "//", "@{"} {
+		if strings.Contains(s, seq) {
+			return bad(fmt.Sprintf("contains %q", seq))
+		}
+	}
+	for _, c := range s {
+		if c < 0x20 || c == 0x7f {
+			return bad("contains a control character")
+		}
+		if strings.ContainsRune(" ~^:?*[\\", c) {
+			return bad(fmt.Sprintf("contains %q", c))
+		}
+	}
+	comps := strings.Split(s, "/")
+	if len(comps) < 2 {
+		return bad("needs at least two components")
+	}
+	for _, c := range comps {
+		if strings.HasPrefix(c, ".") {
+			return bad("component starts with .")
+		}
+		if strings.HasSuffix(c, ".lock") {
+			return bad("component ends with .lock")
+		}
+	}
+	return nil
+}
+
+// UserRefName returns the ref of a Gerrit account,
+// refs/users/CD/ABCD, sharded by the last two digits of the ID.
+func UserRefName(id int) (plumbing.ReferenceName, error) {
+	if id <= 0 {
+		return "", fmt.Errorf("invalid account ID %d", id)
+	}
+	return plumbing.ReferenceName(fmt.Sprintf("refs/users/%02d/%d", id%100, id)), nil
+}
+
+// GroupRefName returns the ref of a Gerrit group, refs/groups/UU/UUID,
+// sharded by the first two characters of the UUID.
+func GroupRefName(uuid string) (plumbing.ReferenceName, error) {
+	if len(uuid) < 2 || strings.Contains(uuid, "/") {
+		return "", fmt.Errorf("invalid group UUID %q", uuid)
+	}
+	name := plumbing.ReferenceName(fmt.Sprintf("refs/groups/%s/%s", uuid[:2], uuid))
+	if err := CheckRefName(name); err != nil {
+		return "", fmt.Errorf("group UUID %q: %w", uuid, err)
+	}
+	return name, nil
+}
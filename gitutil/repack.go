@@ -0,0 +1,203 @@
+// Copyright 2023 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitutil
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+)
+
+// reflogIDs returns the IDs in the reflogs of the git directory fs.
+func reflogIDs(fs billy.Filesystem) ([]plumbing.Hash, error) {
+	var ids []plumbing.Hash
+	err := util.Walk(fs, "logs", func(p string, fi os.FileInfo, err error) error {
+		if os.IsNotExist(err) && p == "logs" {
+			return filepath.SkipDir
+		} else if err != nil || fi.IsDir() {
+			return err
+		}
+		f, err := fs.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			fields := strings.Fields(sc.Text())
+			if len(fields) < 2 {
+				continue
+			}
+			for _, h := range fields[:2] {
+				if id := plumbing.NewHash(h); plumbing.IsHash(h) && !id.IsZero() {
+					ids = append(ids, id)
+				}
+			}
+		}
+		return sc.Err()
+	})
+	return ids, err
+}
+
+// ReachableObjects returns the IDs of all objects reachable from the
+// refs of st, and from their reflogs in the git directory fs, if
+// given. Unlike go-git's object walker, it takes refs that point to
+// blobs or trees, as Gerrit's starred-changes refs do.
+func ReachableObjects(st storage.Storer, fs billy.Filesystem) ([]plumbing.Hash, error) {
+	refs, err := st.IterReferences()
+	if err != nil {
+		return nil, err
+	}
+	var todo []plumbing.Hash
+	if err := refs.ForEach(func(r *plumbing.Reference) error {
+		if r.Type() == plumbing.HashReference {
+			todo = append(todo, r.Hash())
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if fs != nil {
+		ids, err := reflogIDs(fs)
+		if err != nil {
+			return nil, err
+		}
+		// As in git, reflog entries may point to objects that were
+		// pruned already.
+		for _, id := range ids {
+			if st.HasEncodedObject(id) == nil {
+				todo = append(todo, id)
+			}
+		}
+	}
+
+	seen := map[plumbing.Hash]bool{}
+	var ids []plumbing.Hash
+	for len(todo) > 0 {
+		id := todo[len(todo)-1]
+		todo = todo[:len(todo)-1]
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		ids = append(ids, id)
+
+		obj, err := st.EncodedObject(plumbing.AnyObject, id)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", id, err)
+		}
+		switch obj.Type() {
+		case plumbing.CommitObject:
+			c, err := object.DecodeCommit(st, obj)
+			if err != nil {
+				return nil, err
+			}
+			todo = append(todo, c.TreeHash)
+			todo = append(todo, c.ParentHashes...)
+		case plumbing.TreeObject:
+			t, err := object.DecodeTree(st, obj)
+			if err != nil {
+				return nil, err
+			}
+			for _, e := range t.Entries {
+				// Submodule commits live elsewhere.
+				if e.Mode != filemode.Submodule {
+					todo = append(todo, e.Hash)
+				}
+			}
+		case plumbing.TagObject:
+			t, err := object.DecodeTag(st, obj)
+			if err != nil {
+				return nil, err
+			}
+			todo = append(todo, t.Target)
+		}
+	}
+	return ids, nil
+}
+
+// Repack writes the objects reachable from the refs of st and their
+// reflogs as one packfile into fs, the filesystem storage below st,
+// and removes the loose objects that it packed. Of the other packs,
+// those older than the start of the repack are removed; newer ones may
+// have been written by another process, with objects that we didn't
+// see.
+func Repack(st storage.Storer, fs *filesystem.Storage) (plumbing.Hash, error) {
+	start := time.Now()
+	ids, err := ReachableObjects(st, fs.Filesystem())
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	old, err := fs.ObjectPacks()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	w, err := fs.PackfileWriter()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	id, err := packfile.NewEncoder(w, st, false).Encode(ids, packWindow)
+	if err != nil {
+		w.Close()
+		return id, err
+	}
+	if err := w.Close(); err != nil {
+		return id, err
+	}
+
+	for _, p := range old {
+		if p == id {
+			continue
+		}
+		if err := fs.DeleteOldObjectPackAndIndex(p, start); err != nil {
+			return id, err
+		}
+	}
+	packed := map[plumbing.Hash]bool{}
+	for _, o := range ids {
+		packed[o] = true
+	}
+	var loose []plumbing.Hash
+	if err := fs.ForEachObjectHash(func(o plumbing.Hash) error {
+		if packed[o] {
+			loose = append(loose, o)
+		}
+		return nil
+	}); err != nil {
+		return id, err
+	}
+	for _, o := range loose {
+		if err := fs.DeleteLooseObject(o); err != nil {
+			return id, err
+		}
+	}
+	// fs loads the pack indexes once, and would look for objects in
+	// the removed packs.
+	fs.Reindex()
+	return id, nil
+}
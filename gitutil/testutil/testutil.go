@@ -0,0 +1,118 @@
+// Copyright 2023 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package testutil builds git trees from compact descriptions, for
+// tests of gitutil and its users.
+package testutil
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/hanwen/allusersync/gitutil"
+)
+
+// MapToEntries provides input to gitutil.PatchTree. Keys are paths,
+// which may have directories, eg. "a/b/c". The value is the file
+// content, unless the key has a suffix:
+// * '!' = delete; "dir/!" deletes the directory
+// * '*' = executable
+// * '@' = symlink, to the value
+// * '#' = submodule, at the commit ID in the value
+// * '<' = the content is read from the file named by the value.
+// A key ending in '/' is an empty directory. Entries are sorted by
+// path, so an empty directory can be filled by other keys.
+func MapToEntries(st storer.EncodedObjectStorer, in map[string]string) ([]object.TreeEntry, error) {
+	var es []object.TreeEntry
+	for k, v := range in {
+		e, err := mapEntry(st, k, v)
+		if err != nil {
+			return nil, err
+		}
+		es = append(es, e)
+	}
+	sort.Slice(es, func(i, j int) bool { return es[i].Name < es[j].Name })
+	return es, nil
+}
+
+func mapEntry(st storer.EncodedObjectStorer, k, v string) (object.TreeEntry, error) {
+	e := object.TreeEntry{Mode: filemode.Regular}
+	name := k
+	content := []byte(v)
+	blob := true
+	if k == "" {
+		return e, fmt.Errorf("empty path")
+	}
+	name = k[:len(k)-1]
+	var err error
+	switch k[len(k)-1:] {
+	case "*":
+		e.Mode = filemode.Executable
+	case "@":
+		e.Mode = filemode.Symlink
+	case "!":
+		// The ZeroHash deletes.
+		name = strings.TrimSuffix(name, "/")
+		blob = false
+	case "#":
+		if !plumbing.IsHash(v) {
+			return e, fmt.Errorf("%s: submodule needs a commit ID, got %q", k, v)
+		}
+		e.Mode = filemode.Submodule
+		e.Hash = plumbing.NewHash(v)
+		blob = false
+	case "<":
+		if content, err = os.ReadFile(v); err != nil {
+			return e, fmt.Errorf("%s: %v", k, err)
+		}
+	case "/":
+		e.Mode = filemode.Dir
+		e.Hash, err = gitutil.SaveTree(st, nil)
+		if err != nil {
+			return e, err
+		}
+		blob = false
+	default:
+		name = k
+	}
+	if name == "" {
+		return e, fmt.Errorf("%q: empty path", k)
+	}
+	e.Name = name
+	if blob {
+		e.Hash, err = gitutil.SaveBlob(st, content)
+	}
+	return e, err
+}
+
+// MapToTree writes the tree described by in, in the format of
+// MapToEntries, and returns its ID. An empty map yields the empty
+// tree.
+func MapToTree(st storer.EncodedObjectStorer, in map[string]string) (plumbing.Hash, error) {
+	es, err := MapToEntries(st, in)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	id, err := gitutil.PatchTree(st, &object.Tree{}, es)
+	if err != nil || id != plumbing.ZeroHash {
+		return id, err
+	}
+	return gitutil.SaveTree(st, nil)
+}
@@ -38,6 +38,8 @@ func (se sortableEntries) Len() int               { return len(se) }
 func (se sortableEntries) Less(i int, j int) bool { return se.sortName(se[i]) < se.sortName(se[j]) }
 func (se sortableEntries) Swap(i int, j int)      { se[i], se[j] = se[j], se[i] }
 
+// SortTreeEntries sorts entries in git's tree order, where a directory
+// sorts as if its name ended in '/'.
 func SortTreeEntries(es []object.TreeEntry) {
 	se := sortableEntries(es)
 	sort.Sort(se)
@@ -86,6 +88,11 @@ func (n *lazyTreeNode) encode(s storer.EncodedObjectStorer) (plumbing.Hash, erro
 			})
 		}
 	}
+	if len(es) == 0 {
+		// All children were deleted; like git, drop the
+		// directory rather than writing an empty tree.
+		return plumbing.ZeroHash, nil
+	}
 
 	return SaveTree(s, es)
 }
@@ -144,7 +151,10 @@ func (lt *lazyTreeNode) patch(eos storer.EncodedObjectStorer, entry object.TreeE
 }
 
 // PatchTree constructs a new tree by applying changes to it. In changes,
-// the ZeroHash signifies deletion of the path.
+// the ZeroHash signifies deletion of the path. Directories that become
+// empty are removed; if nothing is left, the ZeroHash is returned.
+// Only the trees on the paths of changes are read and written, so a
+// change costs in proportion to the size of those trees, not of t.
 func PatchTree(eos storer.EncodedObjectStorer, t *object.Tree, changes []object.TreeEntry) (id plumbing.Hash, err error) {
 	root := lazyTreeNode{
 		mode: filemode.Dir,
@@ -0,0 +1,145 @@
+// Copyright 2023 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitutil_test
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/hanwen/allusersync/gitutil"
+	"github.com/hanwen/allusersync/gitutil/testutil"
+)
+
+// treeContents lists the tree recursively as "path=content" for files
+// and "path/" for empty directories, sorted.
+func treeContents(t *testing.T, st *memory.Storage, id plumbing.Hash) string {
+	t.Helper()
+	tree, err := object.GetTree(st, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []string
+	w := object.NewTreeWalker(tree, true, nil)
+	defer w.Close()
+	for {
+		p, e, err := w.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if e.Mode == filemode.Dir {
+			sub, err := object.GetTree(st, e.Hash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(sub.Entries) == 0 {
+				out = append(out, p+"/")
+			}
+			continue
+		}
+		data, err := gitutil.LoadBlob(st, e.Hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, p+"="+string(data))
+	}
+	sort.Strings(out)
+	return strings.Join(out, " ")
+}
+
+// patch applies changes, in the format of testutil.MapToEntries, to
+// the tree described by base.
+func patch(t *testing.T, st *memory.Storage, base, changes map[string]string) plumbing.Hash {
+	t.Helper()
+	id, err := testutil.MapToTree(st, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := object.GetTree(st, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	es, err := testutil.MapToEntries(st, changes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err = gitutil.PatchTree(st, tree, es)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestPatchTreeEmptyDir(t *testing.T) {
+	st := memory.NewStorage()
+	id := patch(t, st, map[string]string{"f": "1"}, map[string]string{"a/b/": ""})
+	if got, want := treeContents(t, st, id), "a/b/ f=1"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// The empty directory sorts before the file that fills it.
+	id = patch(t, st, map[string]string{"f": "1"}, map[string]string{"a/": "", "a/g": "2"})
+	if got, want := treeContents(t, st, id), "a/g=2 f=1"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestPatchTreeDeleteDir(t *testing.T) {
+	st := memory.NewStorage()
+	base := map[string]string{"d/x": "1", "d/e/y": "2", "dd": "3", "f": "4"}
+	id := patch(t, st, base, map[string]string{"d/!": ""})
+	if got, want := treeContents(t, st, id), "dd=3 f=4"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	id = patch(t, st, base, map[string]string{"d/e/!": ""})
+	if got, want := treeContents(t, st, id), "d/x=1 dd=3 f=4"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestPatchTreeContentFromFile(t *testing.T) {
+	st := memory.NewStorage()
+	src := filepath.Join(t.TempDir(), "account.config")
+	if err := os.WriteFile(src, []byte("[account]\n\tfullName = Bob\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	id := patch(t, st, map[string]string{"f": "1"}, map[string]string{"a/account.config<": src})
+	if got, want := treeContents(t, st, id), "a/account.config=[account]\n\tfullName = Bob\n f=1"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if _, err := testutil.MapToEntries(st, map[string]string{"g<": filepath.Join(t.TempDir(), "missing")}); err == nil {
+		t.Error("missing file: got no error")
+	}
+}
+
+func TestMapToEntriesInvalid(t *testing.T) {
+	st := memory.NewStorage()
+	for _, k := range []string{"", "!", "x#"} {
+		if es, err := testutil.MapToEntries(st, map[string]string{k: "not a hash"}); err == nil {
+			t.Errorf("%q: got %v, want error", k, es)
+		}
+	}
+}
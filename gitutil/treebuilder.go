@@ -0,0 +1,99 @@
+// Copyright 2023 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitutil
+
+import (
+	"path"
+	"sort"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/format/config"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+)
+
+// TreeBuilder collects changes to a tree, and writes them with
+// PatchTree. Files that are not touched are kept from the base tree.
+type TreeBuilder struct {
+	st      storer.EncodedObjectStorer
+	base    *object.Tree
+	changes map[string]object.TreeEntry
+}
+
+// NewTreeBuilder returns a builder on top of base. A nil base is the
+// empty tree.
+func NewTreeBuilder(st storer.EncodedObjectStorer, base *object.Tree) *TreeBuilder {
+	if base == nil {
+		base = &object.Tree{}
+	}
+	return &TreeBuilder{
+		st:      st,
+		base:    base,
+		changes: map[string]object.TreeEntry{},
+	}
+}
+
+// Insert sets the file at p, which may contain slashes, to id.
+func (b *TreeBuilder) Insert(p string, mode filemode.FileMode, id plumbing.Hash) {
+	p = path.Clean(p)
+	b.changes[p] = object.TreeEntry{Name: p, Mode: mode, Hash: id}
+}
+
+// InsertBlob stores data and inserts it as a regular file.
+func (b *TreeBuilder) InsertBlob(p string, data []byte) error {
+	id, err := SaveBlob(b.st, data)
+	if err != nil {
+		return err
+	}
+	b.Insert(p, filemode.Regular, id)
+	return nil
+}
+
+// InsertConfig stores cfg and inserts it as a regular file.
+func (b *TreeBuilder) InsertConfig(p string, cfg *config.Config) error {
+	id, err := SaveConfig(b.st, cfg)
+	if err != nil {
+		return err
+	}
+	b.Insert(p, filemode.Regular, id)
+	return nil
+}
+
+// Remove deletes the file or directory at p.
+func (b *TreeBuilder) Remove(p string) {
+	b.Insert(p, filemode.Regular, plumbing.ZeroHash)
+}
+
+// Changes returns the changes in the format of PatchTree, sorted by
+// path.
+func (b *TreeBuilder) Changes() []object.TreeEntry {
+	var es []object.TreeEntry
+	for _, e := range b.changes {
+		es = append(es, e)
+	}
+	sort.Slice(es, func(i, j int) bool { return es[i].Name < es[j].Name })
+	return es
+}
+
+// Write stores the new tree, and returns its ID. If nothing is left,
+// it writes the empty tree.
+func (b *TreeBuilder) Write() (plumbing.Hash, error) {
+	id, err := PatchTree(b.st, b.base, b.Changes())
+	if err != nil || id != plumbing.ZeroHash {
+		return id, err
+	}
+	return SaveTree(b.st, nil)
+}
@@ -0,0 +1,139 @@
+// Copyright 2023 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitutil
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage"
+)
+
+// ValidateObject decodes an encoded object, and checks the invariants
+// that git fsck checks: trees have sorted, unique entries with valid
+// names and modes, and commits and tags have a target and signatures.
+func ValidateObject(obj plumbing.EncodedObject) error {
+	var err error
+	switch obj.Type() {
+	case plumbing.BlobObject:
+	case plumbing.TreeObject:
+		err = validateTree(obj)
+	case plumbing.CommitObject:
+		err = validateCommit(obj)
+	case plumbing.TagObject:
+		err = validateTag(obj)
+	default:
+		err = fmt.Errorf("unexpected type %s", obj.Type())
+	}
+	if err != nil {
+		return fmt.Errorf("%s %s: %w", obj.Type(), obj.Hash(), err)
+	}
+	return nil
+}
+
+func validateTree(obj plumbing.EncodedObject) error {
+	t, err := object.DecodeTree(nil, obj)
+	if err != nil {
+		return err
+	}
+	se := sortableEntries(t.Entries)
+	for i, e := range t.Entries {
+		if e.Name == "" || e.Name == "." || e.Name == ".." || strings.ContainsAny(e.Name, "/\x00") {
+			return fmt.Errorf("invalid entry name %q", e.Name)
+		}
+		switch e.Mode {
+		case filemode.Dir, filemode.Regular, filemode.Executable, filemode.Symlink, filemode.Submodule:
+		default:
+			return fmt.Errorf("entry %q: invalid mode %o", e.Name, uint32(e.Mode))
+		}
+		if e.Hash.IsZero() {
+			return fmt.Errorf("entry %q: zero ID", e.Name)
+		}
+		if i > 0 && !se.Less(i-1, i) {
+			if e.Name == t.Entries[i-1].Name {
+				return fmt.Errorf("duplicate entry %q", e.Name)
+			}
+			return fmt.Errorf("entry %q sorts before %q", e.Name, t.Entries[i-1].Name)
+		}
+	}
+	return nil
+}
+
+func validateSignature(what string, sig object.Signature) error {
+	if sig.Name == "" && sig.Email == "" {
+		return fmt.Errorf("missing %s", what)
+	}
+	if sig.When.IsZero() {
+		return fmt.Errorf("%s has no time", what)
+	}
+	return nil
+}
+
+func validateCommit(obj plumbing.EncodedObject) error {
+	c, err := object.DecodeCommit(nil, obj)
+	if err != nil {
+		return err
+	}
+	if c.TreeHash.IsZero() {
+		return fmt.Errorf("missing tree")
+	}
+	for _, p := range c.ParentHashes {
+		if p.IsZero() {
+			return fmt.Errorf("zero parent")
+		}
+	}
+	if err := validateSignature("author", c.Author); err != nil {
+		return err
+	}
+	return validateSignature("committer", c.Committer)
+}
+
+func validateTag(obj plumbing.EncodedObject) error {
+	t, err := object.DecodeTag(nil, obj)
+	if err != nil {
+		return err
+	}
+	if t.Target.IsZero() {
+		return fmt.Errorf("missing target")
+	}
+	if t.Name == "" {
+		return fmt.Errorf("missing name")
+	}
+	return validateSignature("tagger", t.Tagger)
+}
+
+// ValidatingStorer runs ValidateObject on objects before writing them.
+type ValidatingStorer struct {
+	storage.Storer
+}
+
+func NewValidatingStorer(base storage.Storer) *ValidatingStorer {
+	return &ValidatingStorer{Storer: base}
+}
+
+// Unwrap returns the underlying storage.
+func (s *ValidatingStorer) Unwrap() storage.Storer {
+	return s.Storer
+}
+
+func (s *ValidatingStorer) SetEncodedObject(obj plumbing.EncodedObject) (plumbing.Hash, error) {
+	if err := ValidateObject(obj); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return s.Storer.SetEncodedObject(obj)
+}
@@ -16,118 +16,238 @@ package gitutil
 
 import (
 	"bytes"
+	"fmt"
+	"io"
+	"strings"
 
 	"github.com/go-git/go-git/v5/plumbing"
-	"github.com/go-git/go-git/v5/plumbing/filemode"
 	"github.com/go-git/go-git/v5/plumbing/format/config"
 	"github.com/go-git/go-git/v5/plumbing/object"
 	"github.com/go-git/go-git/v5/plumbing/storer"
 )
 
-func SaveBlob(st storer.EncodedObjectStorer, data []byte) (id plumbing.Hash, err error) {
-	enc := st.NewEncodedObject()
-	enc.SetType(plumbing.BlobObject)
-	w, err := enc.Writer()
-	if err != nil {
-		return
+// store writes enc unless st already has an object with its ID.
+func store(st storer.EncodedObjectStorer, enc plumbing.EncodedObject) (plumbing.Hash, error) {
+	if st.HasEncodedObject(enc.Hash()) == nil {
+		return enc.Hash(), nil
 	}
-	if _, err := w.Write(data); err != nil {
-		return id, err
+	return st.SetEncodedObject(enc)
+}
+
+func encodeBlob(data []byte) (plumbing.EncodedObject, error) {
+	enc := &plumbing.MemoryObject{}
+	enc.SetType(plumbing.BlobObject)
+	if _, err := enc.Write(data); err != nil {
+		return nil, err
 	}
-	if err := w.Close(); err != nil {
-		return id, err
+	return enc, nil
+}
+
+func encodeTree(entries []object.TreeEntry) (plumbing.EncodedObject, error) {
+	SortTreeEntries(entries)
+	enc := &plumbing.MemoryObject{}
+	enc.SetType(plumbing.TreeObject)
+	t := object.Tree{Entries: entries}
+	if err := t.Encode(enc); err != nil {
+		return nil, err
 	}
-	return st.SetEncodedObject(enc)
+	return enc, nil
 }
 
-func SaveConfig(st storer.EncodedObjectStorer, cfg *config.Config) (id plumbing.Hash, err error) {
+// CommitHeaders are commit headers that object.Commit lacks. The
+// gpgsig header is object.Commit.PGPSignature.
+type CommitHeaders struct {
+	// Encoding is the character set of the message, eg. "ISO-8859-1".
+	// If empty, the message is UTF-8.
+	Encoding string
+}
+
+func encodeCommit(c *object.Commit, h CommitHeaders) (plumbing.EncodedObject, error) {
+	enc := &plumbing.MemoryObject{}
+	enc.SetType(plumbing.CommitObject)
+	if err := c.Encode(enc); err != nil {
+		return nil, err
+	}
+	if h.Encoding == "" {
+		return enc, nil
+	}
+	if strings.ContainsAny(h.Encoding, " \n") {
+		return nil, fmt.Errorf("invalid encoding %q", h.Encoding)
+	}
+
+	// Like git, put encoding after committer, and before gpgsig.
+	r, err := enc.Reader()
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	i := bytes.Index(data, []byte("\ncommitter "))
+	if i < 0 {
+		return nil, fmt.Errorf("commit lacks committer")
+	}
+	i += 1 + bytes.IndexByte(data[i+1:], '\n')
 	var buf bytes.Buffer
-	if err = config.NewEncoder(&buf).Encode(cfg); err != nil {
-		return
+	buf.Write(data[:i])
+	fmt.Fprintf(&buf, "\nencoding %s", h.Encoding)
+	buf.Write(data[i:])
+
+	enc = &plumbing.MemoryObject{}
+	enc.SetType(plumbing.CommitObject)
+	if _, err := enc.Write(buf.Bytes()); err != nil {
+		return nil, err
 	}
+	return enc, nil
+}
 
-	return SaveBlob(st, buf.Bytes())
+// HashBlob returns the ID SaveBlob would return, without storing
+// anything.
+func HashBlob(data []byte) plumbing.Hash {
+	return plumbing.ComputeHash(plumbing.BlobObject, data)
 }
 
-func SaveTree(st storer.EncodedObjectStorer, entries []object.TreeEntry) (id plumbing.Hash, err error) {
-	SortTreeEntries(entries)
+// HashTree returns the ID SaveTree would return, without storing
+// anything. Like SaveTree, it sorts entries.
+func HashTree(entries []object.TreeEntry) (plumbing.Hash, error) {
+	enc, err := encodeTree(entries)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return enc.Hash(), nil
+}
 
-	enc := st.NewEncodedObject()
-	enc.SetType(plumbing.TreeObject)
+// HashCommit returns the ID SaveCommit would return, without storing
+// anything.
+func HashCommit(c *object.Commit) (plumbing.Hash, error) {
+	enc, err := encodeCommit(c, CommitHeaders{})
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return enc.Hash(), nil
+}
 
-	t := object.Tree{Entries: entries}
-	if err := t.Encode(enc); err != nil {
+func SaveBlob(st storer.EncodedObjectStorer, data []byte) (id plumbing.Hash, err error) {
+	enc, err := encodeBlob(data)
+	if err != nil {
 		return id, err
 	}
+	return store(st, enc)
+}
 
-	return st.SetEncodedObject(enc)
+// SaveConfig stores the config, encoded with EncodeConfig.
+func SaveConfig(st storer.EncodedObjectStorer, cfg *config.Config) (id plumbing.Hash, err error) {
+	data, err := EncodeConfig(cfg)
+	if err != nil {
+		return id, err
+	}
+	return SaveBlob(st, data)
+}
+
+func SaveTree(st storer.EncodedObjectStorer, entries []object.TreeEntry) (id plumbing.Hash, err error) {
+	enc, err := encodeTree(entries)
+	if err != nil {
+		return id, err
+	}
+	return store(st, enc)
 }
 
+// SaveCommit stores c. A PGPSignature is written as gpgsig header.
 func SaveCommit(st storer.EncodedObjectStorer, c *object.Commit) (id plumbing.Hash, err error) {
-	enc := st.NewEncodedObject()
-	enc.SetType(plumbing.CommitObject)
-	if err := c.Encode(enc); err != nil {
+	return SaveCommitHeaders(st, c, CommitHeaders{})
+}
+
+// SaveCommitHeaders stores c with extra headers.
+func SaveCommitHeaders(st storer.EncodedObjectStorer, c *object.Commit, h CommitHeaders) (id plumbing.Hash, err error) {
+	enc, err := encodeCommit(c, h)
+	if err != nil {
 		return id, err
 	}
-	return st.SetEncodedObject(enc)
+	return store(st, enc)
 }
 
-// TestMapToEntries provides input to PatchTree. keys are filenames, with
-// suffixes:
-// * '!' = delete
-// * '*' = executable
-// * '@' = symlink
-// * '#' = submodule.
-func TestMapToEntries(st storer.EncodedObjectStorer, in map[string]string) ([]object.TreeEntry, error) {
-	var es []object.TreeEntry
-	for k, v := range in {
-		id, err := SaveBlob(st, []byte(v))
-		if err != nil {
-			return nil, err
-		}
-		mode := filemode.Regular
-
-		last := k[len(k)-1]
-		trim := true
-		switch last {
-		case '*':
-			mode = filemode.Executable
-		case '@':
-			mode = filemode.Symlink
-		case '!':
-			id = plumbing.ZeroHash
-		case '#':
-			mode = filemode.Submodule
-			id = plumbing.NewHash(v)
-		default:
-			trim = false
+// SaveMergeCommit stores a commit of tree with the given parents, in
+// order, by sig. The tree is the caller's merge result. The parents
+// must be distinct commits in st, and there must be at least two.
+func SaveMergeCommit(st storer.EncodedObjectStorer, tree plumbing.Hash, parents []plumbing.Hash, sig object.Signature, message string) (id plumbing.Hash, err error) {
+	if len(parents) < 2 {
+		return id, fmt.Errorf("merge needs at least 2 parents, got %d", len(parents))
+	}
+	seen := map[plumbing.Hash]bool{}
+	for _, p := range parents {
+		if seen[p] {
+			return id, fmt.Errorf("duplicate parent %s", p)
 		}
-		if trim {
-			k = k[:len(k)-1]
+		seen[p] = true
+		if _, err := object.GetCommit(st, p); err != nil {
+			return id, fmt.Errorf("parent %s: %w", p, err)
 		}
+	}
+	return SaveCommit(st, &object.Commit{
+		Author:       sig,
+		Committer:    sig,
+		Message:      message,
+		TreeHash:     tree,
+		ParentHashes: parents,
+	})
+}
 
-		es = append(es, object.TreeEntry{Name: k, Hash: id, Mode: mode})
+// SaveTag stores an annotated tag object. It does not create the ref
+// under refs/tags/.
+func SaveTag(st storer.EncodedObjectStorer, t *object.Tag) (id plumbing.Hash, err error) {
+	enc := &plumbing.MemoryObject{}
+	enc.SetType(plumbing.TagObject)
+	if err := t.Encode(enc); err != nil {
+		return id, err
 	}
-	return es, nil
+	return store(st, enc)
 }
 
-func ModifyCommit(st storer.EncodedObjectStorer, c *object.Commit, newContent map[string]string, message string) (id plumbing.Hash, err error) {
-	tree, err := object.GetTree(st, c.TreeHash)
+// ModifyOptions are the metadata of the commit that ModifyCommit
+// writes.
+type ModifyOptions struct {
+	// Author is required. If Committer is zero, Author is used.
+	Author    object.Signature
+	Committer object.Signature
+
+	// ExtraParents are added after the modified commit, making the
+	// result a merge.
+	ExtraParents []plumbing.Hash
+}
+
+// ModifyCommit writes a child of c with changes (as for PatchTree)
+// applied to its tree. testutil.MapToEntries makes changes for tests.
+func ModifyCommit(st storer.EncodedObjectStorer, c *object.Commit, changes []object.TreeEntry, message string, opts ModifyOptions) (id plumbing.Hash, err error) {
+	if opts.Author.Name == "" || opts.Author.When.IsZero() {
+		return id, fmt.Errorf("ModifyCommit: author must have a name and time")
+	}
+	if opts.Committer.Name == "" {
+		opts.Committer = opts.Author
+	}
 
-	es, err := TestMapToEntries(st, newContent)
+	tree, err := object.GetTree(st, c.TreeHash)
 	if err != nil {
 		return id, err
 	}
 
-	treeID, err := PatchTree(st, tree, es)
+	treeID, err := PatchTree(st, tree, changes)
 	if err != nil {
 		return id, err
 	}
+	if treeID == plumbing.ZeroHash {
+		// Everything was deleted.
+		if treeID, err = SaveTree(st, nil); err != nil {
+			return id, err
+		}
+	}
 
 	newCommit := object.Commit{
+		Author:       opts.Author,
+		Committer:    opts.Committer,
 		Message:      message,
 		TreeHash:     treeID,
-		ParentHashes: []plumbing.Hash{c.Hash},
+		ParentHashes: append([]plumbing.Hash{c.Hash}, opts.ExtraParents...),
 	}
 
 	return SaveCommit(st, &newCommit)
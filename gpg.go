@@ -0,0 +1,94 @@
+//    Copyright 2023, Google LLC
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/hanwen/allusersync/gitutil"
+	gerrit "github.com/hanwen/go-gerrit"
+	"golang.org/x/time/rate"
+)
+
+// gpgKeysRef holds Gerrit's PublicKeyStore: a notemap of
+// ASCII-armored public keys.
+const gpgKeysRef = plumbing.ReferenceName("refs/meta/gpg-keys")
+
+const gpgKeyScheme = "gpgkey:"
+
+// gpgKeyNoteName returns the note name for a key in the PublicKeyStore:
+// the 64-bit key ID, ie. the last 8 bytes of the V4 fingerprint,
+// padded with zeros to the size of an object ID.
+func gpgKeyNoteName(fingerprint string) (string, error) {
+	fp := strings.ToLower(strings.ReplaceAll(fingerprint, " ", ""))
+	if !gitutil.IsNoteName(fp) {
+		return "", fmt.Errorf("unsupported GPG fingerprint %q", fingerprint)
+	}
+	return fp[24:] + strings.Repeat("0", 24), nil
+}
+
+func getGPGKeys(lim *rate.Limiter, cl *gerrit.Client, id string) ([]gerrit.GpgKeyInfo, error) {
+	lim.Wait(context.Background())
+	keys, _, err := cl.Accounts.ListGPGKeys(id)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []gerrit.GpgKeyInfo{}
+	if keys != nil {
+		for _, k := range *keys {
+			result = append(result, k)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Fingerprint < result[j].Fingerprint })
+	return result, nil
+}
+
+// updateGPGKeys replaces the keys that the account had according to
+// its old gpgkey external IDs with the fetched keys.
+func updateGPGKeys(st storer.EncodedObjectStorer, notes *gitutil.NoteMap, old []*localExternalID, keys []gerrit.GpgKeyInfo) error {
+	for _, e := range old {
+		if !strings.HasPrefix(e.Key, gpgKeyScheme) {
+			continue
+		}
+		name, err := gpgKeyNoteName(strings.TrimPrefix(e.Key, gpgKeyScheme))
+		if err != nil {
+			return err
+		}
+		notes.Remove(name)
+	}
+
+	for _, k := range keys {
+		name, err := gpgKeyNoteName(k.Fingerprint)
+		if err != nil {
+			return err
+		}
+		armored := k.Key
+		if !strings.HasSuffix(armored, "\n") {
+			armored += "\n"
+		}
+		id, err := gitutil.SaveBlob(st, []byte(armored))
+		if err != nil {
+			return err
+		}
+		notes.Set(name, id)
+	}
+	return nil
+}
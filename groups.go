@@ -0,0 +1,242 @@
+//    Copyright 2023, Google LLC
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/format/config"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/hanwen/allusersync/gitutil"
+	gerrit "github.com/hanwen/go-gerrit"
+	"golang.org/x/time/rate"
+)
+
+// groupNamesRef is a notemap from group name to UUID, keyed by the
+// SHA-1 of the name.
+const groupNamesRef = plumbing.ReferenceName("refs/meta/group-names")
+
+// isInternalGroup returns true for the UUIDs of groups stored in
+// NoteDb. Other groups (eg. "ldap:...") live in external systems.
+func isInternalGroup(uuid string) bool {
+	return gitutil.IsNoteName(uuid)
+}
+
+// listGroups fetches all internal groups with their members and
+// subgroups.
+func listGroups(lim *rate.Limiter, cl *gerrit.Client) ([]gerrit.GroupInfo, error) {
+	var result []gerrit.GroupInfo
+	for skip := 0; ; {
+		lim.Wait(context.Background())
+		page, _, err := cl.Groups.ListGroups(&gerrit.ListGroupsOptions{
+			Options: []string{"MEMBERS", "INCLUDES"},
+			Limit:   accountQueryLimit,
+			Skip:    skip,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if page == nil || len(*page) == 0 {
+			break
+		}
+
+		more := false
+		for name, g := range *page {
+			skip++
+			more = more || g.MoreGroups
+			if !isInternalGroup(g.ID) {
+				continue
+			}
+			if g.Name == "" {
+				g.Name = name
+			}
+			result = append(result, g)
+		}
+		if !more {
+			break
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+	return result, nil
+}
+
+// fileLines returns the values one per line, as in Gerrit's members
+// and subgroups files.
+func fileLines(vals []string) []byte {
+	return []byte(strings.Join(vals, "\n") + "\n")
+}
+
+// groupConfigKeys are the keys of group.config that we write; others
+// are kept.
+var groupConfigKeys = gitutil.SectionKeys("group", "name", "id", "description", "ownerGroupUuid", "visibleToAll")
+
+// groupTreeEntries returns the group.config, members and subgroups
+// files for a group, on top of the old commit, which may be nil. Empty
+// files are returned with the ZeroHash, so PatchTree removes them.
+func groupTreeEntries(repo *git.Repository, g *gerrit.GroupInfo, old *object.Commit) ([]object.TreeEntry, error) {
+	cfg := config.New()
+	cfg.SetOption("group", "", "name", g.Name)
+	cfg.SetOption("group", "", "id", strconv.Itoa(g.GroupID))
+	if g.Description != "" {
+		cfg.SetOption("group", "", "description", g.Description)
+	}
+	if g.OwnerID != "" {
+		cfg.SetOption("group", "", "ownerGroupUuid", g.OwnerID)
+	}
+	cfg.SetOption("group", "", "visibleToAll", strconv.FormatBool(g.Options.VisibleToAll))
+
+	oldCfg, err := gitutil.LoadCommitConfig(repo.Storer, old, "group.config")
+	if err != nil {
+		return nil, err
+	}
+	cfg = gitutil.MergeConfig(oldCfg, cfg, groupConfigKeys)
+	id, err := gitutil.SaveConfig(repo.Storer, cfg)
+	if err != nil {
+		return nil, err
+	}
+	entries := []object.TreeEntry{{
+		Name: "group.config",
+		Mode: filemode.Regular,
+		Hash: id,
+	}}
+
+	// Like Gerrit's GroupConfig, sort account IDs as numbers, and
+	// group UUIDs as strings.
+	var ids []int
+	for _, m := range g.Members {
+		ids = append(ids, m.AccountID)
+	}
+	sort.Ints(ids)
+	var members, subgroups []string
+	for _, id := range ids {
+		members = append(members, strconv.Itoa(id))
+	}
+	for _, sub := range g.Includes {
+		subgroups = append(subgroups, sub.ID)
+	}
+	sort.Strings(subgroups)
+	for _, f := range []struct {
+		name string
+		vals []string
+	}{
+		{"members", members},
+		{"subgroups", subgroups},
+	} {
+		e := object.TreeEntry{
+			Name: f.name,
+			Mode: filemode.Regular,
+		}
+		if len(f.vals) > 0 {
+			e.Hash, err = gitutil.SaveBlob(repo.Storer, fileLines(f.vals))
+			if err != nil {
+				return nil, err
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// saveGroups writes the groups into the repository, and adds the
+// necessary ref updates to trans.
+func saveGroups(groups []gerrit.GroupInfo, repo *git.Repository, trans *RefTransaction) error {
+	s := newSig()
+	for i := range groups {
+		g := &groups[i]
+		refName, err := gitutil.GroupRefName(g.ID)
+		if err != nil {
+			return err
+		}
+		old, err := readRefCommit(repo, refName)
+		if err != nil {
+			return err
+		}
+		entries, err := groupTreeEntries(repo, g, old)
+		if err != nil {
+			return err
+		}
+		oldTree := &object.Tree{}
+		if old != nil {
+			oldTree, err = old.Tree()
+			if err != nil {
+				return err
+			}
+		}
+
+		id, err := gitutil.PatchTree(repo.Storer, oldTree, entries)
+		if err != nil {
+			return err
+		}
+		if old != nil && old.TreeHash == id {
+			continue
+		}
+
+		sig := s
+		if old == nil && g.CreatedOn != nil && !g.CreatedOn.IsZero() {
+			sig.When = g.CreatedOn.Time
+		}
+		c := &object.Commit{
+			Author:    sig,
+			Committer: sig,
+			Message:   "update group",
+			TreeHash:  id,
+		}
+		if old != nil {
+			c.ParentHashes = []plumbing.Hash{old.Hash}
+		}
+		id, err = gitutil.SaveCommit(repo.Storer, c)
+		if err != nil {
+			return err
+		}
+		update := &RefUpdate{NewID: id}
+		if old != nil {
+			update.OldID = old.Hash
+		}
+		trans.updates[refName] = update
+	}
+
+	return saveGroupNames(groups, repo, trans)
+}
+
+// saveGroupNames rewrites refs/meta/group-names for the given groups,
+// which should be all internal groups. Notes for renamed or deleted
+// groups are dropped.
+func saveGroupNames(groups []gerrit.GroupInfo, repo *git.Repository, trans *RefTransaction) error {
+	names, err := loadNotesRef(repo, groupNamesRef)
+	if err != nil {
+		return err
+	}
+	for _, n := range names.notes.Names() {
+		names.notes.Remove(n)
+	}
+
+	for _, g := range groups {
+		cfg := config.New()
+		cfg.SetOption("group", "", "uuid", g.ID)
+		cfg.SetOption("group", "", "name", g.Name)
+		id, err := gitutil.SaveConfig(repo.Storer, cfg)
+		if err != nil {
+			return err
+		}
+		names.notes.Set(noteName(g.Name), id)
+	}
+	return names.commit(repo.Storer, trans, newSig(), "update group names")
+}
@@ -0,0 +1,168 @@
+//    Copyright 2023, Google LLC
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// parseRanges expands "1-250,300,400-410" into account IDs.
+func parseRanges(s string) ([]string, error) {
+	var result []string
+	for _, r := range strings.Split(s, ",") {
+		r = strings.TrimSpace(r)
+		lo, hi, found := strings.Cut(r, "-")
+		if !found {
+			hi = lo
+		}
+		start, err := strconv.Atoi(lo)
+		if err != nil {
+			return nil, fmt.Errorf("range %q: %v", r, err)
+		}
+		end, err := strconv.Atoi(hi)
+		if err != nil {
+			return nil, fmt.Errorf("range %q: %v", r, err)
+		}
+		if start <= 0 || end < start {
+			return nil, fmt.Errorf("invalid range %q", r)
+		}
+		for id := start; id <= end; id++ {
+			result = append(result, strconv.Itoa(id))
+		}
+	}
+	return result, nil
+}
+
+// rangeFlag collects the IDs of repeated --range flags.
+type rangeFlag []string
+
+func (f *rangeFlag) String() string {
+	return fmt.Sprintf("%d IDs", len(*f))
+}
+
+func (f *rangeFlag) Set(s string) error {
+	ids, err := parseRanges(s)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, ids...)
+	return nil
+}
+
+// readIDsFile reads account IDs, one per line, from the named file, or
+// from stdin if name is "-". Blank lines and text after '#' are
+// ignored.
+func readIDsFile(name string) ([]string, error) {
+	var r io.Reader = os.Stdin
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	var result []string
+	scanner := bufio.NewScanner(r)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if _, err := strconv.Atoi(line); err != nil {
+			return nil, fmt.Errorf("%s:%d: %q is not an account ID", name, lineno, line)
+		}
+		result = append(result, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// idSet is a set of account IDs.
+type idSet map[int]bool
+
+func newIDSet(ids []string) idSet {
+	s := idSet{}
+	for _, id := range ids {
+		if n, err := strconv.Atoi(id); err == nil {
+			s[n] = true
+		}
+	}
+	return s
+}
+
+// filter returns the IDs that are not in the set.
+func (s idSet) filter(ids []string) []string {
+	var result []string
+	for _, id := range ids {
+		if n, err := strconv.Atoi(id); err == nil && s[n] {
+			continue
+		}
+		result = append(result, id)
+	}
+	return result
+}
+
+// filterInts is like filter, for numeric IDs.
+func (s idSet) filterInts(ids []int) []int {
+	var result []int
+	for _, id := range ids {
+		if !s[id] {
+			result = append(result, id)
+		}
+	}
+	return result
+}
+
+// sortIDs sorts numeric account IDs in ascending order, with other
+// identifiers after them in their original order.
+func sortIDs(ids []string) {
+	sort.SliceStable(ids, func(i, j int) bool {
+		a, aerr := strconv.Atoi(ids[i])
+		b, berr := strconv.Atoi(ids[j])
+		if aerr != nil || berr != nil {
+			return aerr == nil && berr != nil
+		}
+		return a < b
+	})
+}
+
+// accountError is a failure to fetch one account.
+type accountError struct {
+	ID  string
+	Err error
+}
+
+// writeErrorReport writes the failed account IDs in the --ids-file
+// format, with the error as a comment, so they can be retried.
+func writeErrorReport(name string, errs []accountError) error {
+	var buf bytes.Buffer
+	for _, e := range errs {
+		msg := strings.ReplaceAll(e.Err.Error(), "\n", " ")
+		fmt.Fprintf(&buf, "%s # %s\n", e.ID, msg)
+	}
+	return writeFileAtomic(name, buf.Bytes())
+}
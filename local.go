@@ -0,0 +1,353 @@
+//    Copyright 2023, Google LLC
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/config"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/hanwen/allusersync/gitutil"
+)
+
+const externalIDsRef = plumbing.ReferenceName("refs/meta/external-ids")
+
+var userRefRE = regexp.MustCompile(`^refs/users/([0-9]{2})/([0-9]+)$`)
+
+// noteName returns the notemap key for an external ID key, such as
+// "mailto:jdoe@example.com".
+func noteName(key string) string {
+	return gitutil.NoteName(key)
+}
+
+// externalIDKeys describes how the Gerrit server derives note names
+// from external ID keys. Since external IDs moved to NoteDb in Gerrit
+// 2.14, the note name is the SHA-1 of the key; Gerrit 3.5 added the one
+// variation below.
+type externalIDKeys struct {
+	// CaseInsensitiveUserNames mirrors auth.userNameCaseInsensitive
+	// (Gerrit 3.5 and later): the note names of "username:" and
+	// "gerrit:" keys are computed from the lowercased key.
+	CaseInsensitiveUserNames bool
+}
+
+// caseInsensitiveUserNamesUsage is the help of the
+// --username-case-insensitive flags.
+const caseInsensitiveUserNamesUsage = "compute note names like a Gerrit 3.5 or later server with auth.userNameCaseInsensitive set. Without it, note names are the SHA-1 of the key, as in all Gerrit versions since 2.14"
+
+// noteName returns the note name for an external ID key.
+func (k externalIDKeys) noteName(key string) string {
+	if k.CaseInsensitiveUserNames && (strings.HasPrefix(key, "username:") || strings.HasPrefix(key, "gerrit:")) {
+		key = strings.ToLower(key)
+	}
+	return noteName(key)
+}
+
+// localAccount is an account as stored in the All-Users repository.
+type localAccount struct {
+	ID     int
+	Ref    *plumbing.Reference
+	Commit *object.Commit
+
+	// Config is the parsed account.config, or nil if there is none.
+	Config *config.Config
+}
+
+func (a *localAccount) option(key string) string {
+	if a.Config == nil {
+		return ""
+	}
+	return a.Config.Section("account").Option(key)
+}
+
+func (a *localAccount) Active() bool {
+	return a.option("active") != "false"
+}
+
+// localExternalID is an external ID note from refs/meta/external-ids.
+type localExternalID struct {
+	// Note is the note name, ie. the SHA-1 of Key.
+	Note string
+
+	// Path is the path of the note in the notemap tree.
+	Path string
+
+	Key       string
+	AccountID int
+	Email     string
+
+	// HasPassword is set if the note has a hashed HTTP password.
+	HasPassword bool
+}
+
+func readLocalAccount(repo *git.Repository, ref *plumbing.Reference) (*localAccount, error) {
+	m := userRefRE.FindStringSubmatch(ref.Name().String())
+	if m == nil {
+		return nil, fmt.Errorf("%s is not a user ref", ref.Name())
+	}
+	id, err := strconv.Atoi(m[2])
+	if err != nil {
+		return nil, err
+	}
+	commit, err := repo.CommitObject(ref.Hash())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", ref.Name(), err)
+	}
+	acc := &localAccount{
+		ID:     id,
+		Ref:    ref,
+		Commit: commit,
+	}
+
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", ref.Name(), err)
+	}
+	e, err := tree.FindEntry("account.config")
+	if err == object.ErrEntryNotFound {
+		return acc, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	acc.Config, err = gitutil.LoadConfig(repo.Storer, e.Hash)
+	if err != nil {
+		return nil, fmt.Errorf("%s: account.config: %v", ref.Name(), err)
+	}
+	return acc, nil
+}
+
+// readLocalAccounts reads all refs/users/NN/ID refs, sorted by
+// account ID.
+func readLocalAccounts(repo *git.Repository) ([]*localAccount, error) {
+	iter, err := repo.References()
+	if err != nil {
+		return nil, err
+	}
+
+	var result []*localAccount
+	if err := iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() != plumbing.HashReference || !userRefRE.MatchString(ref.Name().String()) {
+			return nil
+		}
+		acc, err := readLocalAccount(repo, ref)
+		if err != nil {
+			return err
+		}
+		result = append(result, acc)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+	return result, nil
+}
+
+// localAccountIDs returns the IDs of the accounts that have a user
+// ref, without reading the accounts.
+func localAccountIDs(repo *git.Repository) (idSet, error) {
+	iter, err := repo.References()
+	if err != nil {
+		return nil, err
+	}
+
+	result := idSet{}
+	if err := iter.ForEach(func(ref *plumbing.Reference) error {
+		m := userRefRE.FindStringSubmatch(ref.Name().String())
+		if m == nil {
+			return nil
+		}
+		id, err := strconv.Atoi(m[2])
+		if err != nil {
+			return err
+		}
+		result[id] = true
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// readRefCommit returns the commit a ref points to, or nil if the ref
+// does not exist.
+func readRefCommit(repo *git.Repository, name plumbing.ReferenceName) (*object.Commit, error) {
+	ref, err := repo.Reference(name, true)
+	if err == plumbing.ErrReferenceNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return repo.CommitObject(ref.Hash())
+}
+
+// readExternalIDsTree returns the tree of refs/meta/external-ids, or
+// nil if the ref does not exist.
+func readExternalIDsTree(repo *git.Repository) (*object.Tree, error) {
+	commit, err := readRefCommit(repo, externalIDsRef)
+	if err != nil || commit == nil {
+		return nil, err
+	}
+	return commit.Tree()
+}
+
+func parseExternalIDNote(st storer.EncodedObjectStorer, name string, id plumbing.Hash) (*localExternalID, error) {
+	data, err := gitutil.LoadBlob(st, id)
+	if err != nil {
+		return nil, fmt.Errorf("note %s: %v", name, err)
+	}
+	return decodeExternalIDNote(name, data)
+}
+
+func decodeExternalIDNote(name string, data []byte) (*localExternalID, error) {
+	cfg, err := gitutil.ParseConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("note %s: %v", name, err)
+	}
+	sec := cfg.Section("externalId")
+	if len(sec.Subsections) != 1 {
+		return nil, fmt.Errorf("note %s: want 1 externalId section, got %d", name, len(sec.Subsections))
+	}
+	sub := sec.Subsections[0]
+	accID, err := strconv.Atoi(sub.Option("accountId"))
+	if err != nil {
+		return nil, fmt.Errorf("note %s: accountId: %v", name, err)
+	}
+	return &localExternalID{
+		Note:        name,
+		Key:         sub.Name,
+		AccountID:   accID,
+		Email:       sub.Option("email"),
+		HasPassword: sub.Option("password") != "",
+	}, nil
+}
+
+// newObjectReader returns a batched reader for st. It looks through
+// the dry-run overlay, which keeps only new objects in memory, for the
+// packs on disk.
+func newObjectReader(st storer.EncodedObjectStorer) *gitutil.ObjectReader {
+	fs := dotGitFS(st)
+	if o, ok := st.(*overlayStorage); ok {
+		fs = dotGitFS(o.Storer)
+	}
+	return gitutil.NewObjectReader(st, fs)
+}
+
+// parseExternalIDNotes parses all notes, reading the blobs in one
+// batch, and calls fn with each in name order, with the parse error if
+// there is one.
+func parseExternalIDNotes(st storer.EncodedObjectStorer, notes *gitutil.NoteMap, fn func(name string, e *localExternalID, err error) error) error {
+	names := notes.Names()
+	ids := make([]plumbing.Hash, 0, len(names))
+	for _, n := range names {
+		id, _ := notes.Get(n)
+		ids = append(ids, id)
+	}
+	return parseExternalIDBlobs(st, names, ids, fn)
+}
+
+// parseExternalIDBlobs is parseExternalIDNotes for the notes names,
+// with blobs ids.
+func parseExternalIDBlobs(st storer.EncodedObjectStorer, names []string, ids []plumbing.Hash, fn func(name string, e *localExternalID, err error) error) error {
+	byBlob := map[plumbing.Hash][]string{}
+	for i, n := range names {
+		byBlob[ids[i]] = append(byBlob[ids[i]], n)
+	}
+	parsed := make(map[string]*localExternalID, len(names))
+	errs := map[string]error{}
+	if err := newObjectReader(st).ReadBlobs(ids, func(id plumbing.Hash, data []byte, err error) error {
+		for _, n := range byBlob[id] {
+			if err != nil {
+				errs[n] = fmt.Errorf("note %s: %v", n, err)
+				continue
+			}
+			e, perr := decodeExternalIDNote(n, data)
+			if perr != nil {
+				errs[n] = perr
+				continue
+			}
+			parsed[n] = e
+		}
+		return nil
+	}); err != nil {
+		// Eg. a pack removed by a concurrent git gc. Skipping the
+		// unread notes would drop their external IDs.
+		log.Printf("batch read of external IDs: %v; reading the rest one by one", err)
+		for i, n := range names {
+			if parsed[n] == nil && errs[n] == nil {
+				parsed[n], errs[n] = parseExternalIDNote(st, n, ids[i])
+			}
+		}
+	}
+	for _, n := range names {
+		if err := fn(n, parsed[n], errs[n]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readLocalExternalIDs reads all notes of refs/meta/external-ids.
+func readLocalExternalIDs(repo *git.Repository) ([]*localExternalID, error) {
+	tree, err := readExternalIDsTree(repo)
+	if err != nil || tree == nil {
+		return nil, err
+	}
+	notes, err := gitutil.LoadNoteMap(tree)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []*localExternalID
+	if err := parseExternalIDNotes(repo.Storer, notes, func(name string, extID *localExternalID, err error) error {
+		if err != nil {
+			return err
+		}
+		extID.Path, _ = notes.Path(name)
+		result = append(result, extID)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Note < result[j].Note })
+	return result, nil
+}
+
+// externalIDsByAccount parses all notes, and returns the external IDs
+// per account ID. Notes that cannot be parsed are skipped.
+func externalIDsByAccount(st storer.EncodedObjectStorer, notes *gitutil.NoteMap) (map[int][]*localExternalID, error) {
+	result := map[int][]*localExternalID{}
+	if err := parseExternalIDNotes(st, notes, func(name string, e *localExternalID, err error) error {
+		if err != nil {
+			log.Printf("skipping external ID: %v", err)
+			return nil
+		}
+		result[e.AccountID] = append(result[e.AccountID], e)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
@@ -0,0 +1,182 @@
+//    Copyright 2023, Google LLC
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/hanwen/allusersync/gitutil"
+)
+
+// identityIndex indexes the accounts and external IDs of the local
+// repository.
+type identityIndex struct {
+	accounts map[int]*localAccount
+	byKey    map[string]*localExternalID
+	byEmail  map[string][]int
+
+	// extIDs holds the external IDs per account ID.
+	extIDs map[int][]*localExternalID
+}
+
+func loadIdentityIndex(repo *git.Repository) (*identityIndex, error) {
+	accounts, err := readLocalAccounts(repo)
+	if err != nil {
+		return nil, err
+	}
+	extIDs, err := readLocalExternalIDs(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	ix := &identityIndex{
+		accounts: map[int]*localAccount{},
+		byKey:    map[string]*localExternalID{},
+		byEmail:  map[string][]int{},
+		extIDs:   map[int][]*localExternalID{},
+	}
+	for _, a := range accounts {
+		ix.accounts[a.ID] = a
+		if email := a.option("preferredEmail"); email != "" {
+			ix.addEmail(email, a.ID)
+		}
+	}
+	for _, e := range extIDs {
+		ix.byKey[e.Key] = e
+		ix.extIDs[e.AccountID] = append(ix.extIDs[e.AccountID], e)
+		if e.Email != "" {
+			ix.addEmail(e.Email, e.AccountID)
+		}
+	}
+	return ix, nil
+}
+
+func (ix *identityIndex) addEmail(email string, id int) {
+	for _, existing := range ix.byEmail[email] {
+		if existing == id {
+			return
+		}
+	}
+	ix.byEmail[email] = append(ix.byEmail[email], id)
+	sort.Ints(ix.byEmail[email])
+}
+
+// byID returns the account, or nil if it does not exist.
+func (ix *identityIndex) byID(id int) *localAccount {
+	return ix.accounts[id]
+}
+
+// byExternalID returns the account for an external ID key, such as
+// "username:jdoe".
+func (ix *identityIndex) byExternalID(key string) *localAccount {
+	e := ix.byKey[key]
+	if e == nil {
+		return nil
+	}
+	return ix.accounts[e.AccountID]
+}
+
+func (ix *identityIndex) byUsername(name string) *localAccount {
+	return ix.byExternalID("username:" + name)
+}
+
+// byEmailAddress returns all accounts that use the given email.
+func (ix *identityIndex) byEmailAddress(email string) []*localAccount {
+	var r []*localAccount
+	for _, id := range ix.byEmail[email] {
+		if a := ix.accounts[id]; a != nil {
+			r = append(r, a)
+		}
+	}
+	return r
+}
+
+func (ix *identityIndex) printAccount(st storer.EncodedObjectStorer, a *localAccount) error {
+	fmt.Printf("account %d (%s)\n", a.ID, a.Ref.Name())
+	fmt.Printf("  fullName: %s\n", a.option("fullName"))
+	fmt.Printf("  preferredEmail: %s\n", a.option("preferredEmail"))
+	fmt.Printf("  active: %v\n", a.Active())
+	fmt.Printf("  external IDs:\n")
+	for _, e := range ix.extIDs[a.ID] {
+		if e.Email != "" {
+			fmt.Printf("    %s <%s>\n", e.Key, e.Email)
+		} else {
+			fmt.Printf("    %s\n", e.Key)
+		}
+	}
+	c, err := gitutil.LastChange(st, a.Ref.Hash(), "account.config")
+	if err != nil {
+		return err
+	}
+	if c != nil {
+		fmt.Printf("  account.config last changed: %s (%s)\n", c.Committer.When.UTC().Format(time.RFC3339), c.Hash)
+	}
+	return nil
+}
+
+func lookupMain(args []string) error {
+	fs := flag.NewFlagSet("lookup", flag.ExitOnError)
+	repoDir := fs.String("repo", "", "all-users repo")
+	var sf storageFlags
+	sf.register(fs)
+	email := fs.String("email", "", "look up accounts by email address")
+	username := fs.String("username", "", "look up account by username")
+	id := fs.Int("id", 0, "look up account by account ID")
+	fs.Parse(args)
+	if *repoDir == "" {
+		return fmt.Errorf("must specify --repo")
+	}
+
+	repo, err := sf.open(*repoDir)
+	if err != nil {
+		return err
+	}
+
+	ix, err := loadIdentityIndex(repo)
+	if err != nil {
+		return err
+	}
+
+	var found []*localAccount
+	switch {
+	case *email != "":
+		found = ix.byEmailAddress(*email)
+	case *username != "":
+		if a := ix.byUsername(*username); a != nil {
+			found = append(found, a)
+		}
+	case *id != 0:
+		if a := ix.byID(*id); a != nil {
+			found = append(found, a)
+		}
+	default:
+		return fmt.Errorf("must specify --email, --username or --id")
+	}
+
+	if len(found) == 0 {
+		return fmt.Errorf("no account found")
+	}
+	for _, a := range found {
+		if err := ix.printAccount(repo.Storer, a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
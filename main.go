@@ -16,21 +16,23 @@ package main
 
 import (
 	"context"
-	"crypto/sha1"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	git "github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/plumbing"
-	"github.com/go-git/go-git/v5/plumbing/filemode"
 	"github.com/go-git/go-git/v5/plumbing/format/config"
 	"github.com/go-git/go-git/v5/plumbing/object"
 	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/storage"
 	"github.com/hanwen/allusersync/gitutil"
 	gerrit "github.com/hanwen/go-gerrit"
 	"golang.org/x/time/rate"
@@ -39,9 +41,37 @@ import (
 type AccountInfo struct {
 	account gerrit.AccountDetailInfo
 	extIDs  []gerrit.AccountExternalIdInfo
+
+	// prefs is the preferences.config content, or nil if
+	// preferences were not fetched.
+	prefs *config.Config
+
+	// gpgKeys is nil if GPG keys were not fetched.
+	gpgKeys []gerrit.GpgKeyInfo
+
+	// starred holds the starred change numbers, or nil if they
+	// were not fetched.
+	starred []int
+
+	// drafts holds the draft comments per change number, or nil
+	// if they were not fetched.
+	drafts map[int][]gerrit.CommentInfo
 }
 
-func getAccountDetails(lim *rate.Limiter, cl *gerrit.Client, id string) (*AccountInfo, error) {
+// fetchOptions selects the optional per-account data to fetch.
+type fetchOptions struct {
+	Preferences bool
+	GPGKeys     bool
+	Starred     bool
+	Emails      bool
+	Drafts      bool
+
+	// Self is the account we authenticate as. Drafts are only
+	// visible to their author, so they are only fetched for Self.
+	Self int
+}
+
+func getAccountDetails(lim *rate.Limiter, cl *gerrit.Client, id string, opts *fetchOptions) (*AccountInfo, error) {
 	lim.Wait(context.Background())
 	details, reply, err := cl.Accounts.GetAccountDetails(id)
 
@@ -52,19 +82,76 @@ func getAccountDetails(lim *rate.Limiter, cl *gerrit.Client, id string) (*Accoun
 	if err != nil {
 		return nil, err
 	}
+	return completeAccountInfo(lim, cl, details, opts)
+}
+
+// completeAccountInfo fetches the data that is not part of the
+// account details.
+func completeAccountInfo(lim *rate.Limiter, cl *gerrit.Client, details *gerrit.AccountDetailInfo, opts *fetchOptions) (*AccountInfo, error) {
+	for _, c := range sanitizeAccountDetails(details) {
+		log.Printf("account %d: sanitized %s", details.AccountID, c)
+	}
+	if err := validateAccountConfig(accountConfig(details)); err != nil {
+		return nil, fmt.Errorf("account %d: %v", details.AccountID, err)
+	}
+	id := strconv.Itoa(details.AccountID)
 	lim.Wait(context.Background())
 	extIDs, _, err := cl.Accounts.GetAccountExternalIDs(id)
 	if err != nil {
 		return nil, err
 	}
 
-	return &AccountInfo{
+	if opts.Emails {
+		extra, err := getEmailExternalIDs(lim, cl, id, extIDs)
+		if err != nil {
+			return nil, err
+		}
+		extIDs = append(extIDs, extra...)
+	}
+	for _, e := range extIDs {
+		if err := validateExternalIDKey(e.Identity); err != nil {
+			return nil, fmt.Errorf("account %d: %v", details.AccountID, err)
+		}
+	}
+
+	info := &AccountInfo{
 		account: *details,
 		extIDs:  extIDs,
-	}, nil
+	}
+	if opts.Preferences {
+		info.prefs, err = getPreferences(lim, cl, id)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if opts.GPGKeys {
+		info.gpgKeys, err = getGPGKeys(lim, cl, id)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if opts.Starred {
+		info.starred, err = getStarredChanges(lim, cl, id)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if opts.Drafts && details.AccountID == opts.Self {
+		info.drafts, err = getDraftComments(lim, cl)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return info, nil
 }
 
 type RefUpdate struct {
+	// OldID is the value of the ref when we read it, or the
+	// ZeroHash if it did not exist. The update fails if the ref
+	// has a different value.
+	OldID plumbing.Hash
+
+	// NewID is the new value; the ZeroHash deletes the ref.
 	NewID plumbing.Hash
 }
 
@@ -72,203 +159,953 @@ type RefTransaction struct {
 	updates map[plumbing.ReferenceName]*RefUpdate
 }
 
-func UpdateRepo(ref storer.ReferenceStorer, tr *RefTransaction) error {
-	// go-git doesn't do transactions.
-	for name, update := range tr.updates {
-		if update == nil {
-			ref.RemoveReference(plumbing.ReferenceName(name))
-			continue
+// errRefChanged is returned if a ref does not have the expected old
+// value.
+var errRefChanged = errors.New("ref changed")
+
+// checkRef returns errRefChanged if the ref is not at want.
+func checkRef(ref storer.ReferenceStorer, name plumbing.ReferenceName, want plumbing.Hash) error {
+	cur, err := currentRef(ref, name)
+	if err != nil {
+		return err
+	}
+	if cur != want {
+		return fmt.Errorf("%s: %w: want %s, have %s", name, errRefChanged, want, cur)
+	}
+	return nil
+}
+
+// setRef applies a single update, if the ref is still at its old
+// value, and records msg in the reflog.
+func setRef(ref storer.ReferenceStorer, name plumbing.ReferenceName, update *RefUpdate, msg string) error {
+	if update.NewID.IsZero() {
+		if err := checkRef(ref, name, update.OldID); err != nil {
+			return err
 		}
-		n := plumbing.NewHashReference(plumbing.ReferenceName(name), update.NewID)
-		if err := ref.SetReference(n); err != nil {
+		if err := ref.RemoveReference(name); err != nil {
 			return err
 		}
+		logRefUpdate(ref, name, update, msg)
+		return nil
+	}
+	n := plumbing.NewHashReference(name, update.NewID)
+	var old *plumbing.Reference
+	if update.OldID.IsZero() {
+		if err := checkRef(ref, name, plumbing.ZeroHash); err != nil {
+			return err
+		}
+	} else {
+		old = plumbing.NewHashReference(name, update.OldID)
+		ref = packedRefWriter(ref, name)
+	}
+	if err := ref.CheckAndSetReference(n, old); err != nil {
+		if errors.Is(err, storage.ErrReferenceHasChanged) {
+			return fmt.Errorf("%s: %w", name, errRefChanged)
+		}
+		return err
 	}
+	logRefUpdate(ref, name, update, msg)
 	return nil
 }
 
+// packedRefWriter returns a writer for updating name. go-git's
+// CheckAndSetReference fails for refs that only exist in packed-refs,
+// and leaves an empty loose ref behind, so those are updated in
+// packed-refs instead.
+func packedRefWriter(ref storer.ReferenceStorer, name plumbing.ReferenceName) storer.ReferenceStorer {
+	if _, ok := ref.(refBatcher); ok {
+		return ref
+	}
+	st, ok := ref.(storage.Storer)
+	if !ok {
+		return ref
+	}
+	fs := dotGitFS(st)
+	if fs == nil {
+		return ref
+	}
+	if _, err := fs.Stat(name.String()); os.IsNotExist(err) {
+		return gitutil.NewPackedRefsStorer(st, fs)
+	}
+	return ref
+}
+
+// logRefUpdate writes the reflog entry of an update. The ref has
+// moved already, so failing to log is only a warning.
+func logRefUpdate(ref storer.ReferenceStorer, name plumbing.ReferenceName, update *RefUpdate, msg string) {
+	if err := writeReflog(ref, name, update.OldID, update.NewID, msg); err != nil {
+		log.Printf("warning: %s: writing reflog: %v", name, err)
+	}
+}
+
+// UpdateRepo applies the transaction. go-git doesn't do transactions,
+// so all refs are checked first, and the updates are recorded in
+// pendingTransactionRef while the refs are flipped one by one. If an
+// update fails, the refs already written are restored. If we die
+// halfway, the next run finishes the transaction. A storer that
+// batches updates, see --packed-refs, writes them all at once instead.
+func UpdateRepo(st storage.Storer, tr *RefTransaction) error {
+	if len(tr.updates) == 0 {
+		return nil
+	}
+	names := tr.sortedNames()
+	for _, name := range names {
+		if err := gitutil.CheckRefName(name); err != nil {
+			return err
+		}
+		if err := checkRef(st, name, tr.updates[name].OldID); err != nil {
+			return err
+		}
+	}
+	if err := writePendingTransaction(st, tr); err != nil {
+		return err
+	}
+	if rb, ok := st.(refBatcher); ok {
+		return updatePackedRefs(st, rb, tr, names)
+	}
+	for i, name := range names {
+		if err := setRef(st, name, tr.updates[name], "update"); err != nil {
+			return rollback(st, tr, names[:i], err)
+		}
+	}
+	return st.RemoveReference(pendingTransactionRef)
+}
+
+// commitTime, if set, is the time for all commits that we write, so
+// repeated runs over the same data produce the same commits.
+var commitTime time.Time
+
 func newSig() object.Signature {
+	when := time.Now()
+	if !commitTime.IsZero() {
+		when = commitTime
+	}
 	return object.Signature{
 		Name:  "allusersync",
 		Email: "allusersync@invalid",
-		When:  time.Now(),
+		When:  when,
 	}
 }
 
-func saveAccountDetails(infos []*AccountInfo, repo *git.Repository) error {
-	s := newSig()
-	extRefName := plumbing.ReferenceName("refs/meta/external-ids")
-	extRef, err := repo.Reference(extRefName, true)
-	var extCommit *object.Commit
-	if err == plumbing.ErrReferenceNotFound {
-		err = nil
+// parseTimestamp parses --timestamp: a date, an RFC 3339 time, or
+// @SECONDS since the epoch, as in $SOURCE_DATE_EPOCH.
+func parseTimestamp(s string) (time.Time, error) {
+	if strings.HasPrefix(s, "@") {
+		secs, err := strconv.ParseInt(s[1:], 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("--timestamp: %v", err)
+		}
+		return time.Unix(secs, 0).UTC(), nil
 	}
+	t, err := parseSince(s)
 	if err != nil {
+		return time.Time{}, fmt.Errorf("--timestamp: want 2006-01-02, RFC 3339 or @SECONDS, got %q", s)
+	}
+	return t, nil
+}
+
+// refBatcher can apply many ref updates at once, such as
+// gitutil.PackedRefsStorer.
+type refBatcher interface {
+	UpdateRefs(changes []gitutil.RefChange) error
+}
+
+// updatePackedRefs applies tr in one batch. The batch is atomic, so if
+// it fails, nothing is rolled back. Only if it got stuck after
+// replacing packed-refs, the pending transaction is kept for the next
+// run to finish.
+func updatePackedRefs(st storage.Storer, rb refBatcher, tr *RefTransaction, names []plumbing.ReferenceName) error {
+	var changes []gitutil.RefChange
+	for _, name := range names {
+		u := tr.updates[name]
+		changes = append(changes, gitutil.RefChange{Name: name, Old: u.OldID, New: u.NewID})
+	}
+	if err := rb.UpdateRefs(changes); errors.Is(err, gitutil.ErrIncompleteUpdate) {
+		return fmt.Errorf("%v; the next run will finish the update", err)
+	} else if err != nil {
+		if rerr := st.RemoveReference(pendingTransactionRef); rerr != nil {
+			return fmt.Errorf("%v; also: %v", err, rerr)
+		}
+		if errors.Is(err, storage.ErrReferenceHasChanged) {
+			return fmt.Errorf("%w: %v", errRefChanged, err)
+		}
 		return err
 	}
+	for _, name := range names {
+		logRefUpdate(st, name, tr.updates[name], "update")
+	}
+	return st.RemoveReference(pendingTransactionRef)
+}
 
-	if extRef != nil {
-		extCommit, err = repo.CommitObject(extRef.Hash())
-		if err != nil {
-			return err
+func newRefTransaction() *RefTransaction {
+	return &RefTransaction{
+		updates: map[plumbing.ReferenceName]*RefUpdate{},
+	}
+}
+
+// merge adds the updates of a transaction that was applied after tr.
+func (tr *RefTransaction) merge(next *RefTransaction) {
+	for name, u := range next.updates {
+		if prev := tr.updates[name]; prev != nil {
+			u = &RefUpdate{OldID: prev.OldID, NewID: u.NewID}
 		}
+		tr.updates[name] = u
 	}
+}
 
-	var newEntries []object.TreeEntry
+// validateAccountConfig checks that Gerrit's AccountConfig parser
+// accepts an account.config that we generated.
+func validateAccountConfig(cfg *config.Config) error {
+	for _, sec := range cfg.Sections {
+		if sec.Name != "account" || len(sec.Subsections) > 0 {
+			return fmt.Errorf("account.config: unexpected section %q", sec.Name)
+		}
+		for _, o := range sec.Options {
+			switch {
+			case o.Value == "":
+				return fmt.Errorf("account.config: empty %s", o.Key)
+			case strings.ContainsAny(o.Value, "\x00\n"):
+				return fmt.Errorf("account.config: %s %q has a newline or NUL", o.Key, o.Value)
+			}
+		}
+		if v := sec.Option("active"); v != "" && v != "true" && v != "false" {
+			return fmt.Errorf("account.config: active = %q is not a boolean", v)
+		}
+	}
+	return nil
+}
 
-	trans := &RefTransaction{
-		updates: map[plumbing.ReferenceName]*RefUpdate{},
+// accountConfigKeys are the keys of the account section in
+// account.config that we write. Other keys, eg. written by plugins,
+// are kept when updating an account. "deleted" marks tombstones.
+var accountConfigKeys = []string{"fullName", "displayName", "preferredEmail", "status", "active", "deleted"}
+
+// mergeAccountConfig returns old with the keys in accountConfigKeys
+// replaced by the ones in fresh. If old is nil, fresh is returned.
+func mergeAccountConfig(old, fresh *config.Config) *config.Config {
+	return gitutil.MergeConfig(old, fresh, gitutil.SectionKeys("account", accountConfigKeys...))
+}
+
+// accountConfig returns the account.config for the account details.
+func accountConfig(d *gerrit.AccountDetailInfo) *config.Config {
+	cfg := &config.Config{}
+
+	// Gerrit doesn't write empty keys.
+	for _, kv := range [][2]string{
+		{"fullName", d.Name},
+		{"displayName", d.DisplayName},
+		{"preferredEmail", d.Email},
+		{"status", d.Status},
+	} {
+		if kv[1] != "" {
+			cfg.SetOption("account", "", kv[0], kv[1])
+		}
+	}
+	// Gerrit only writes the flag for deactivated accounts.
+	if d.Inactive {
+		cfg.SetOption("account", "", "active", "false")
 	}
+	return cfg
+}
 
-	for _, inf := range infos {
-		cfg := &config.Config{}
+// saveOptions controls how fetched accounts are written.
+type saveOptions struct {
+	// Tombstone marks the user refs of deleted accounts instead of
+	// removing them.
+	Tombstone bool
+
+	// Merge selects how user refs with local commits are merged.
+	Merge mergePolicy
+
+	// Keys selects the note names of external IDs.
+	Keys externalIDKeys
+
+	// ExtIDCommits selects how external ID changes are committed.
+	ExtIDCommits extIDCommits
 
-		cfg.SetOption("account", "", "fullName", inf.account.Name)
-		cfg.SetOption("account", "", "preferredEmail", inf.account.Email)
+	// PruneOrphans removes external IDs of accounts that have no
+	// user ref. Otherwise they are only reported.
+	PruneOrphans bool
+
+	// Collisions decides external IDs claimed by several of the
+	// saved accounts.
+	Collisions collisionPolicy
+
+	// KeepPasswords keeps the hashed HTTP passwords of external
+	// IDs we update. The REST API does not return them, so they
+	// can only come from the repository.
+	KeepPasswords bool
+
+	// WriteWorkers is the number of goroutines that write user
+	// refs. At most 1 writes them on the calling goroutine.
+	WriteWorkers int
+}
+
+// extIDCommits is the commit granularity of refs/meta/external-ids.
+// By default, each save writes one commit.
+type extIDCommits struct {
+	// PerAccount writes a commit for each account.
+	PerAccount bool
+
+	// Squash folds a commit into the previous sync commit if that
+	// is younger than this.
+	Squash time.Duration
+}
 
-		id, err := gitutil.SaveConfig(repo.Storer, cfg)
+func parseExtIDCommits(s string) (extIDCommits, error) {
+	switch s {
+	case "run":
+		return extIDCommits{}, nil
+	case "account":
+		return extIDCommits{PerAccount: true}, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return extIDCommits{}, fmt.Errorf("--extid-commits must be run, account or a duration, got %q", s)
+	}
+	return extIDCommits{Squash: d}, nil
+}
+
+// validateExternalIDKey checks that an external ID key can be stored
+// as the subsection name of its note. The config encoder escapes
+// quotes and backslashes, but git config has no escape for newlines
+// and NUL in subsection names.
+func validateExternalIDKey(key string) error {
+	if strings.ContainsAny(key, "\x00\n") {
+		return fmt.Errorf("external ID %q: newline or NUL cannot be stored", key)
+	}
+	return nil
+}
+
+// updateExternalIDNote writes the note for an external ID of the
+// given account. An existing note is read and modified, so keys that
+// we don't write are kept, except for the hashed HTTP password, which
+// is only kept if keepPassword is set. The note is only rewritten if
+// something changed.
+func updateExternalIDNote(st storer.EncodedObjectStorer, notes *gitutil.NoteMap, name string, account int, e gerrit.AccountExternalIdInfo, keepPassword bool) error {
+	cfg := &config.Config{}
+	oldID, ok := notes.Get(name)
+	if ok {
+		old, err := gitutil.LoadConfig(st, oldID)
 		if err != nil {
 			return err
 		}
+		if sub := old.Section("externalId"); len(sub.Subsections) == 1 && sub.Subsections[0].Name == e.Identity {
+			cfg = old
+			if prev := sub.Subsections[0].Option("accountId"); prev != strconv.Itoa(account) {
+				log.Printf("external ID %s moves from account %s to %d", e.Identity, prev, account)
+			}
+		} else {
+			log.Printf("note %s: unexpected content; rewriting it for external ID %s", name, e.Identity)
+		}
+	}
 
-		// TODO - read previous state, and drop associated external ids.
+	sub := cfg.Section("externalId").Subsection(e.Identity)
+	sub.SetOption("accountId", strconv.Itoa(account))
+	if e.EmailAddress != "" {
+		sub.SetOption("email", e.EmailAddress)
+	} else {
+		sub.RemoveOption("email")
+	}
+	if !keepPassword && sub.HasOption("password") {
+		log.Printf("removing password of external ID %s", e.Identity)
+		sub.RemoveOption("password")
+	}
+
+	id, err := gitutil.SaveConfig(st, cfg)
+	if err != nil {
+		return err
+	}
+	if id != oldID {
+		notes.Set(name, id)
+	}
+	return nil
+}
 
-		id, err = gitutil.SaveTree(repo.Storer, []object.TreeEntry{
-			{
-				Name: "account.config",
-				Mode: filemode.Regular,
-				Hash: id,
-			}})
+// saveUserRef writes the account.config and preferences of inf to its
+// user ref, and returns the ref and its update, or a nil update if the
+// ref is unchanged.
+func saveUserRef(st storage.Storer, inf *AccountInfo, opts *saveOptions, s object.Signature) (plumbing.ReferenceName, *RefUpdate, error) {
+	uidRefName, err := gitutil.UserRefName(inf.account.AccountID)
+	if err != nil {
+		return "", nil, err
+	}
+	uidRef, err := storer.ResolveReference(st, uidRefName)
+	var oldUserCommit *object.Commit
+	if err == plumbing.ErrReferenceNotFound {
+		err = nil
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	oldUserTree := &object.Tree{}
+	var oldConfig *config.Config
+	if uidRef != nil {
+		oldUserCommit, err = object.GetCommit(st, uidRef.Hash())
 		if err != nil {
-			return err
+			return "", nil, err
+		}
+		oldUserTree, err = oldUserCommit.Tree()
+		if err != nil {
+			return "", nil, err
 		}
+		oldConfig, err = gitutil.LoadCommitConfig(st, oldUserCommit, "account.config")
+		if err != nil {
+			return "", nil, err
+		}
+	}
 
-		uidRefName := plumbing.ReferenceName(fmt.Sprintf("refs/users/%02d/%d", inf.account.AccountID%100, inf.account.AccountID))
-		uidRef, err := repo.Reference(uidRefName, true)
-		var oldUserCommit *object.Commit
-		if err == plumbing.ErrReferenceNotFound {
-			err = nil
+	// Files we did not fetch, such as watch.config, are kept.
+	tb := gitutil.NewTreeBuilder(st, oldUserTree)
+	if err := tb.InsertConfig("account.config", mergeAccountConfig(oldConfig, accountConfig(&inf.account))); err != nil {
+		return "", nil, err
+	}
+	if inf.prefs != nil {
+		// Without any preferences, the file is removed.
+		if len(inf.prefs.Sections) > 0 {
+			if err := tb.InsertConfig("preferences.config", inf.prefs); err != nil {
+				return "", nil, err
+			}
+		} else {
+			tb.Remove("preferences.config")
 		}
+	}
+	entries := tb.Changes()
+	id, err := tb.Write()
+	if err != nil {
+		return "", nil, err
+	}
+
+	// The first commit on the user ref records when the account
+	// was created, so Gerrit can show the registration date.
+	userSig := s
+	if oldUserCommit == nil && !inf.account.RegisteredOn.IsZero() {
+		userSig.When = inf.account.RegisteredOn.Time
+	}
+	uidCommit := &object.Commit{
+		Author:    userSig,
+		Committer: userSig,
+		Message:   "update account",
+		TreeHash:  id,
+	}
+
+	if oldUserCommit != nil {
+		uidCommit.ParentHashes = []plumbing.Hash{oldUserCommit.Hash}
+	}
+
+	if opts.Merge != noMerge && oldUserCommit != nil {
+		id, err := mergeServerState(st, oldUserCommit, entries, opts.Merge, userSig, uidCommit.Message)
 		if err != nil {
-			return err
+			return "", nil, err
+		}
+		if !id.IsZero() {
+			return uidRefName, &RefUpdate{OldID: oldUserCommit.Hash, NewID: id}, nil
+		}
+	} else if oldUserCommit == nil || oldUserCommit.TreeHash != uidCommit.TreeHash {
+		id, err = gitutil.SaveCommit(st, uidCommit)
+		if err != nil {
+			return "", nil, err
+		}
+
+		update := &RefUpdate{NewID: id}
+		if oldUserCommit != nil {
+			update.OldID = oldUserCommit.Hash
 		}
-		if uidRef != nil {
-			oldUserCommit, err = repo.CommitObject(uidRef.Hash())
+		return uidRefName, update, nil
+	}
+	return uidRefName, nil, nil
+}
+
+// saveUserRefs saves the user refs of infos into trans. The user refs
+// are independent of each other, so with opts.WriteWorkers > 1, they
+// are written on that many goroutines.
+func saveUserRefs(st storage.Storer, infos []*AccountInfo, opts *saveOptions, s object.Signature, trans *RefTransaction) error {
+	if opts.WriteWorkers <= 1 {
+		for _, inf := range infos {
+			name, u, err := saveUserRef(st, inf, opts, s)
 			if err != nil {
 				return err
 			}
+			if u != nil {
+				trans.updates[name] = u
+			}
 		}
+		return nil
+	}
 
-		// TODO - could work registration date into Author/committer timestamp
-		uidCommit := &object.Commit{
-			Author:    s,
-			Committer: s,
-			Message:   "update account",
-			TreeHash:  id,
-		}
+	locked := gitutil.NewLockedStorer(st)
+	pool := gitutil.NewWritePool(locked, opts.WriteWorkers)
+	var mu sync.Mutex
+	for _, inf := range infos {
+		inf := inf
+		// saveUserRef also reads refs, so it uses locked rather
+		// than the object storer of the pool.
+		pool.Go(func(storer.EncodedObjectStorer) error {
+			name, u, err := saveUserRef(locked, inf, opts, s)
+			if err != nil || u == nil {
+				return err
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			trans.updates[name] = u
+			return nil
+		})
+	}
+	return pool.Wait()
+}
 
-		if oldUserCommit != nil {
-			if oldUserCommit.TreeHash == uidCommit.TreeHash {
-				continue
+// saveAccountDetails writes the objects for the accounts into the
+// repository, and adds the necessary ref updates to trans. The
+// external IDs and GPG keys of the accounts in gone are deleted. Their
+// user refs are deleted too, or get a tombstone commit, according to
+// opts.
+func saveAccountDetails(infos []*AccountInfo, gone []int, opts *saveOptions, repo *git.Repository, trans *RefTransaction) error {
+	// Process accounts in ID order, so the same input always
+	// produces the same commits.
+	infos = append([]*AccountInfo{}, infos...)
+	sort.Slice(infos, func(i, j int) bool { return infos[i].account.AccountID < infos[j].account.AccountID })
+	gone = append([]int{}, gone...)
+	sort.Ints(gone)
+
+	s := newSig()
+	extIDs, err := loadNotesRef(repo, externalIDsRef)
+	if err != nil {
+		return err
+	}
+	extIDs.squash = opts.ExtIDCommits.Squash
+	notes := extIDs.notes
+	gpgKeys, err := loadNotesRef(repo, gpgKeysRef)
+	if err != nil {
+		return err
+	}
+	oldExtIDs, err := externalIDsByAccount(repo.Storer, notes)
+	if err != nil {
+		return err
+	}
+
+	// claimed holds the account of the external IDs written so far.
+	claimed := map[string]int{}
+	owners, err := resolveCollisions(infos, opts.Keys, opts.Collisions)
+	if err != nil {
+		return err
+	}
+
+	var starredRefs map[int][]plumbing.ReferenceName
+	for _, inf := range infos {
+		if inf.starred != nil {
+			starredRefs, err = readStarredRefs(repo)
+			if err != nil {
+				return err
 			}
-			uidCommit.ParentHashes = []plumbing.Hash{oldUserCommit.Hash}
+			break
+		}
+	}
+	var draftRefs map[int][]plumbing.ReferenceName
+	for _, inf := range infos {
+		if inf.drafts != nil {
+			draftRefs, err = readDraftCommentsRefs(repo)
+			if err != nil {
+				return err
+			}
+			break
+		}
+	}
+
+	if err := saveUserRefs(repo.Storer, infos, opts, s, trans); err != nil {
+		return err
+	}
 
-			// TODO - work out differences, and schedule old external IDs for deletion.
+	for _, inf := range infos {
+		if inf.starred != nil {
+			if err := updateStarredRefs(repo.Storer, repo, trans, inf.account.AccountID, starredRefs[inf.account.AccountID], inf.starred); err != nil {
+				return err
+			}
 		}
 
-		id, err = gitutil.SaveCommit(repo.Storer, uidCommit)
-		if err != nil {
-			return err
+		if inf.drafts != nil {
+			if err := updateDraftCommentsRefs(repo, trans, s, inf.account.AccountID, draftRefs[inf.account.AccountID], inf.drafts); err != nil {
+				return err
+			}
 		}
 
-		trans.updates[uidRefName] = &RefUpdate{NewID: id}
+		if inf.gpgKeys != nil {
+			if err := updateGPGKeys(repo.Storer, gpgKeys.notes, oldExtIDs[inf.account.AccountID], inf.gpgKeys); err != nil {
+				return err
+			}
+		}
 
+		fresh := map[string]bool{}
 		for _, e := range inf.extIDs {
-			cfg := &config.Config{}
-			cfg.SetOption("externalId", e.Identity, "accountId", strconv.Itoa(inf.account.AccountID))
-			if e.EmailAddress != "" {
-				cfg.SetOption("externalId", e.Identity, "email", e.EmailAddress)
+			fresh[opts.Keys.noteName(e.Identity)] = true
+		}
+		for _, old := range oldExtIDs[inf.account.AccountID] {
+			// The ID may have moved to an account we already
+			// processed.
+			if !fresh[old.Note] && claimed[old.Note] == 0 {
+				notes.Remove(old.Note)
 			}
+		}
 
-			id, err := gitutil.SaveConfig(repo.Storer, cfg)
-			if err != nil {
+		for _, e := range inf.extIDs {
+			name := opts.Keys.noteName(e.Identity)
+			if owner, ok := owners[name]; ok && owner != inf.account.AccountID {
+				continue
+			}
+			if err := updateExternalIDNote(repo.Storer, notes, name, inf.account.AccountID, e, opts.KeepPasswords); err != nil {
+				return err
+			}
+			claimed[name] = inf.account.AccountID
+		}
+		if opts.ExtIDCommits.PerAccount {
+			if err := extIDs.commit(repo.Storer, trans, s, fmt.Sprintf("update external IDs of account %d", inf.account.AccountID)); err != nil {
 				return err
 			}
-
-			// TODO - support sharded notemap?
-			newEntries = append(newEntries, object.TreeEntry{
-				Name: fmt.Sprintf("%x", sha1.Sum([]byte(e.Identity))),
-				Mode: filemode.Regular,
-				Hash: id,
-			})
 		}
 	}
 
-	var prevExtIDTree object.Tree
-	if extCommit != nil {
-		tree, err := repo.TreeObject(extCommit.TreeHash)
+	for _, id := range gone {
+		name, err := gitutil.UserRefName(id)
 		if err != nil {
 			return err
 		}
-		prevExtIDTree = *tree
+		if opts.Tombstone {
+			if err := writeTombstone(repo, trans, s, id); err != nil {
+				return err
+			}
+		} else if ref, err := repo.Reference(name, false); err == nil {
+			log.Printf("pruning account %d", id)
+			trans.updates[name] = &RefUpdate{OldID: ref.Hash()}
+		}
+		if err := updateGPGKeys(repo.Storer, gpgKeys.notes, oldExtIDs[id], nil); err != nil {
+			return err
+		}
+		for _, old := range oldExtIDs[id] {
+			notes.Remove(old.Note)
+		}
 	}
 
-	id, err := gitutil.PatchTree(repo.Storer, &prevExtIDTree, newEntries)
+	accounts, err := localAccountIDs(repo)
 	if err != nil {
 		return err
 	}
-
-	newExtCommit := &object.Commit{
-		Author:    s,
-		Committer: s,
-		TreeHash:  id,
-		Message:   "update external IDs",
+	for _, inf := range infos {
+		accounts[inf.account.AccountID] = true
 	}
-	if extCommit != nil {
-		newExtCommit.ParentHashes = []plumbing.Hash{extCommit.Hash}
+	if !opts.Tombstone {
+		for _, id := range gone {
+			delete(accounts, id)
+		}
 	}
-	id, err = gitutil.SaveCommit(repo.Storer, newExtCommit)
-	if err != nil {
-		return err
+	// The notes written above belong to accounts that are synced, so
+	// only the old notes that are still there can be orphans.
+	var orphans []*localExternalID
+	for _, e := range orphansIn(oldExtIDs, accounts) {
+		if _, ok := notes.Get(e.Note); ok && claimed[e.Note] == 0 {
+			orphans = append(orphans, e)
+		}
 	}
+	reportOrphans(orphans, notes, opts.PruneOrphans)
 
-	if extCommit == nil || extCommit.TreeHash != newExtCommit.TreeHash {
-		trans.updates[extRefName] = &RefUpdate{NewID: id}
+	if err := extIDs.commit(repo.Storer, trans, s, "update external IDs"); err != nil {
+		return err
 	}
+	return gpgKeys.commit(repo.Storer, trans, s, "update GPG keys")
+}
 
-	return UpdateRepo(repo.Storer, trans)
+// commands are the subcommands; without a subcommand, accounts are
+// synced from the server.
+var commands = map[string]func(args []string) error{
+	"stats":                statsMain,
+	"lookup":               lookupMain,
+	"serve":                serveMain,
+	"apply":                applyMain,
+	"compact":              compactMain,
+	"repair":               repairMain,
+	"convert-notes":        convertNotesMain,
+	"orphans":              orphansMain,
+	"rebuild-external-ids": rebuildExternalIDsMain,
+	"check":                checkMain,
+	"verify":               verifyMain,
+	"fsck":                 fsckMain,
 }
 
 func main() {
-	url := flag.String("url", "http://localhost:8080/", "")
+	if len(os.Args) > 1 {
+		if cmd := commands[os.Args[1]]; cmd != nil {
+			reflogCommand = os.Args[1]
+			if err := cmd(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	}
+
+	syncMain()
+}
+
+func syncMain() {
+	var server serverFlags
+	server.register(flag.CommandLine, "http://localhost:8080/")
 	repoDir := flag.String("repo", "", "all-users repo")
+	initFlag := flag.Bool("init", false, "create --repo as a bare repository if it doesn't exist or is empty")
+	refFormat := flag.String("ref-format", "files", "with --init, the ref storage of the new repository: files, or reftable, which needs git 2.45 or later")
+	var sf storageFlags
+	sf.register(flag.CommandLine)
+	var remote remoteFlags
+	remote.register(flag.CommandLine)
 
-	basicAuth := flag.String("basic", "", "USER:PASSWORD for basic auth.")
-	cookieAuth := flag.String("cookie", "", "value for the 'o' auth cookie. Use for googlesource.com")
+	all := flag.Bool("all", false, "sync all accounts of the server")
+	var ranges rangeFlag
+	flag.Var(&ranges, "range", "sync account IDs in ranges such as 1-250000,300000; may be repeated")
+	idsFile := flag.String("ids-file", "", "read account IDs to sync from this file, one per line, or from stdin if '-'")
+	excludeIDs := flag.String("exclude-ids", "", "never sync these account IDs, given as ranges such as 1000,1005-1010")
+	excludeFile := flag.String("exclude-file", "", "never sync the account IDs in this file, one per line")
+	incremental := flag.Bool("incremental", false, "with --all, only fetch accounts that are new since the last --all sync according to refs/meta/sync-state, or whose account.config, username or emails changed; changes to preferences, GPG keys and other external IDs need a full sync")
+	sinceFlag := flag.String("since", "", "only sync accounts registered after this date (2006-01-02 or RFC 3339)")
+	skipExisting := flag.Bool("skip-existing", false, "only fetch accounts that have no user ref yet, eg. to complete an interrupted import")
+	dryRun := flag.Bool("dry-run", false, "fetch and write objects, but instead of updating refs, print what would change")
+	planFile := flag.String("plan", "", "write the ref updates and new objects to this file instead of updating refs; see the apply command")
+	streamFile := flag.String("fast-import-stream", "", "write the new objects and ref updates to this file as a stream for git fast-import, instead of updating refs. Load it with git fast-import --force; unlike --plan, it doesn't check that refs are unchanged, and cannot delete refs")
+	checkpointEvery := flag.Int("checkpoint", 0, "write refs after every this many accounts, so an interrupted run keeps its progress; 0 writes once at the end")
+	progressFile := flag.String("progress-file", "", "with --checkpoint, record progress in this file; it is removed when the sync completes")
+	resume := flag.Bool("resume", false, "continue an interrupted sync from the --progress-file")
+	keepGoing := flag.Bool("keep-going", false, "skip accounts that fail to fetch instead of aborting")
+	errorReport := flag.String("error-report", "", "with --keep-going, write the failed account IDs to this file, in the --ids-file format")
+	force := flag.Bool("force", false, "overwrite refs that another writer changed while syncing")
+	mergeFlag := flag.String("merge", "", "merge user refs that have local commits instead of committing over them; server-wins or local-wins decides files changed on both sides")
+	defaultTimestamp := ""
+	if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" {
+		defaultTimestamp = "@" + epoch
+	}
+	timestamp := flag.String("timestamp", defaultTimestamp, "use this time for all commits (2006-01-02, RFC 3339 or @SECONDS), so runs over the same data give the same commits")
+	extIDCommitsFlag := flag.String("extid-commits", "run", "commits on refs/meta/external-ids: run (one per run or checkpoint), account (one per account), or a duration such as 24h, which folds changes into the previous sync commit younger than that (rewriting the ref's history)")
+	writeWorkers := flag.Int("write-workers", 1, "number of goroutines that write the objects of user refs; more keep up with a fast server on machines with spare CPUs")
+	keepPasswords := flag.Bool("keep-passwords", false, "keep the hashed HTTP passwords of external IDs that are updated; by default they are removed")
+	pruneOrphans := flag.Bool("prune-orphans", false, "remove external IDs of accounts that have no user ref, rather than only reporting them")
+	collisionsFlag := flag.String("collisions", string(preferLowerID), "what to do if several synced accounts claim the same external ID: prefer-lower-id, skip (keep the note as it is) or fail")
+	caseInsensitiveUserNames := flag.Bool("username-case-insensitive", false, caseInsensitiveUserNamesUsage)
+	query := flag.String("query", "", "sync the accounts matching this Gerrit account query. Without is:inactive, only active accounts match")
+	var fetchOpts fetchOptions
+	flag.BoolVar(&fetchOpts.Preferences, "preferences", false, "also sync general, diff and edit preferences into preferences.config")
+	flag.BoolVar(&fetchOpts.GPGKeys, "gpg-keys", false, "also sync GPG keys into refs/meta/gpg-keys")
+	flag.BoolVar(&fetchOpts.Starred, "starred-changes", false, "also sync starred changes into refs/starred-changes/")
+	flag.BoolVar(&fetchOpts.Emails, "emails", false, "also create mailto: external IDs for confirmed emails that have none")
+	flag.BoolVar(&fetchOpts.Drafts, "draft-comments", false, "also sync draft comments into refs/draft-comments/; Gerrit only serves drafts of the authenticated account")
+	syncGroups := flag.Bool("groups", false, "also sync internal groups into refs/groups/")
+	prune := flag.Bool("prune", false, "delete the user refs and external IDs of accounts that no longer exist on the server")
+	tombstone := flag.Bool("tombstone", false, "like --prune, but mark deleted accounts with a commit on their user ref instead of deleting it")
+	serviceUsersFlag := flag.String("service-users", "include", "include, exclude or only sync service users (accounts tagged SERVICE_USER)")
+	batch := flag.Int("batch", 100, "number of account IDs to fetch per account query; 0 fetches accounts one by one")
+	emailReport := flag.String("invalid-email-report", "", "write the fetched emails that Gerrit would reject to this file, one per line with the account ID and the field using it")
+	duplicateEmails := flag.String("duplicate-email-report", "", "after syncing, write the preferred emails shared by several accounts to this file, one per line with the account IDs")
+	commitGraph := flag.Int("commit-graph", 1000, "rewrite the commit-graph file after a sync that updated at least this many refs, so later history walks stay fast; 0 never does. Only new commits are read, but the whole file is rewritten, which takes time linear in the number of commits")
+	repackFlag := flag.Bool("repack", false, "repack the repository after syncing, eg. to compress the objects of an import with --compression=0")
+	midxPacks := flag.Int("midx-packs", 10, "after syncing, write a multi-pack-index once the repository has this many packfiles, and keep it up to date; 0 never does")
+	metricsFile := flag.String("metrics-file", "", "write a Prometheus textfile-collector snapshot here after syncing")
 	flag.Parse()
-	if *repoDir == "" {
-		log.Fatal("must specify --repo")
+	if (*repoDir == "") == (remote.url == "") {
+		log.Fatal("must specify one of --repo and --remote")
+	}
+	if remote.url != "" && (*planFile != "" || *streamFile != "" || *checkpointEvery > 0 || *repackFlag) {
+		log.Fatal("--remote keeps the repository in memory, so it cannot be used with --plan, --fast-import-stream, --checkpoint or --repack")
+	}
+	if *initFlag && remote.url != "" {
+		log.Fatal("--init creates a local repository; it cannot be combined with --remote")
+	}
+	if (remote.fetch != "" || remote.push != "") && remote.url != "" {
+		log.Fatal("--remote fetches and pushes the refs already; drop --fetch and --push")
+	}
+	if remote.nonAtomic && remote.url == "" && remote.push == "" {
+		log.Fatal("--push-non-atomic requires --remote or --push")
+	}
+	if remote.push != "" && (*dryRun || *planFile != "" || *streamFile != "") {
+		log.Fatal("--push pushes the refs that a sync updates, so it cannot be used with --dry-run, --plan or --fast-import-stream")
 	}
 
-	if flag.NArg() == 0 {
-		log.Fatal("must specify 1 or more account IDs.")
+	serviceUsers, err := parseServiceUserFilter(*serviceUsersFlag)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	repo, err := git.PlainOpen(*repoDir)
+	saveOpts := &saveOptions{
+		Tombstone:     *tombstone,
+		Keys:          externalIDKeys{CaseInsensitiveUserNames: *caseInsensitiveUserNames},
+		PruneOrphans:  *pruneOrphans,
+		KeepPasswords: *keepPasswords,
+		WriteWorkers:  *writeWorkers,
+	}
+	saveOpts.Collisions, err = parseCollisionPolicy(*collisionsFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	saveOpts.Merge, err = parseMergePolicy(*mergeFlag)
 	if err != nil {
 		log.Fatal(err)
 	}
+	saveOpts.ExtIDCommits, err = parseExtIDCommits(*extIDCommitsFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *timestamp != "" {
+		commitTime, err = parseTimestamp(*timestamp)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *prune && *tombstone {
+		log.Fatal("--prune and --tombstone are mutually exclusive")
+	}
+	// Both need to find the accounts that are gone.
+	*prune = *prune || *tombstone
+	if *prune && *skipExisting {
+		log.Fatal("--prune and --tombstone cannot be used with --skip-existing")
+	}
+	if *prune && *query != "" {
+		log.Fatal("--prune and --tombstone cannot be used with --query")
+	}
+	if *prune && serviceUsers != includeServiceUsers {
+		log.Fatal("--prune and --tombstone cannot tell filtered service users from removed accounts; use --service-users=include")
+	}
+
+	var since time.Time
+	if *sinceFlag != "" {
+		since, err = parseSince(*sinceFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 
-	client, err := gerrit.NewClient(*url, nil)
+	if *checkpointEvery > 0 && (*dryRun || *planFile != "" || *streamFile != "") {
+		log.Fatal("--checkpoint updates refs, so it cannot be used with --dry-run, --plan or --fast-import-stream")
+	}
+	if *planFile != "" && *streamFile != "" {
+		log.Fatal("--plan and --fast-import-stream are exclusive")
+	}
+	if *progressFile != "" && *checkpointEvery <= 0 {
+		log.Fatal("--progress-file requires --checkpoint")
+	}
+	if *resume && *progressFile == "" {
+		log.Fatal("--resume requires --progress-file")
+	}
+	if *incremental && !*all {
+		log.Fatal("--incremental requires --all")
+	}
+	if *all && *query != "" {
+		log.Fatal("--all and --query are mutually exclusive")
+	}
+	if (*all || *query != "") && *batch <= 0 {
+		log.Fatal("--all and --query require account queries; need --batch > 0")
+	}
+	ids := append(flag.Args(), ranges...)
+	if *idsFile != "" {
+		fromFile, err := readIDsFile(*idsFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ids = append(ids, fromFile...)
+	}
+
+	var excluded []string
+	if *excludeIDs != "" {
+		excluded, err = parseRanges(*excludeIDs)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *excludeFile != "" {
+		fromFile, err := readIDsFile(*excludeFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		excluded = append(excluded, fromFile...)
+	}
+	if len(ids) == 0 && !*all && *query == "" && !*syncGroups {
+		log.Fatal("must specify 1 or more account IDs, --all, --query or --groups.")
+	}
+	exclude := newIDSet(excluded)
+
+	var repo *git.Repository
+	if remote.url != "" {
+		repo, err = remote.open(&sf)
+	} else {
+		if *initFlag {
+			if created, err := initRepository(*repoDir, *refFormat); err != nil {
+				log.Fatal(err)
+			} else if created {
+				log.Printf("created %s", *repoDir)
+			}
+		}
+		repo, err = sf.open(*repoDir)
+		if err == git.ErrRepositoryNotExists && !*initFlag {
+			err = fmt.Errorf("%s: %v; pass --init to create it", *repoDir, err)
+		}
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
+	if *dryRun || *planFile != "" || *streamFile != "" {
+		if tr, err := readPendingTransaction(repo.Storer); err != nil {
+			log.Fatal(err)
+		} else if tr != nil {
+			log.Fatalf("%s exists: a previous run was interrupted; run a sync to finish it", pendingTransactionRef)
+		}
+	} else if err := finishPendingTransaction(repo.Storer); err != nil {
+		log.Fatal(err)
+	}
+	if remote.fetch != "" {
+		url, err := remoteURL(repo, remote.fetch)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := fetchRefs(repo, url, remote.auth()); err != nil {
+			log.Fatalf("fetch %s: %v", url, err)
+		}
+		log.Printf("fetched refs from %s", url)
+		if n, err := dropUnpushed(repo.Storer); err != nil {
+			log.Fatal(err)
+		} else if n > 0 {
+			log.Printf("dropped %d unpushed ref updates of an earlier run; the fetched refs replace them", n)
+		}
+	}
+	var overlay *overlayStorage
+	if *planFile != "" || *streamFile != "" {
+		overlay = newOverlayStorage(repo.Storer)
+		repo, err = git.Open(overlay, nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 
-	if *basicAuth != "" {
-		fields := strings.Split(*basicAuth, ":")
-		client.Authentication.SetBasicAuth(fields[0], fields[1])
-	} else if *cookieAuth != "" {
-		client.Authentication.SetCookieAuth("o", *cookieAuth)
+	if *skipExisting {
+		existing, err := localAccountIDs(repo)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for id := range existing {
+			exclude[id] = true
+		}
+	}
+	ids = exclude.filter(ids)
+
+	// Accounts are handled in ID order, so progress is a single ID.
+	sortIDs(ids)
+	progress := &syncProgress{}
+	if *resume {
+		progress, err = readSyncProgress(*progressFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		progress.check(repo)
+		log.Printf("resuming after account %d", progress.LastAccountID)
+	}
+	done := func(id int) bool {
+		return id <= progress.LastAccountID
+	}
+
+	client, err := server.client()
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	caps, _, err := client.Accounts.ListAccountCapabilities("self", nil)
@@ -280,33 +1117,327 @@ func main() {
 		log.Fatal("need accessDatabase capability.")
 	}
 
+	if fetchOpts.Drafts {
+		self, _, err := client.Accounts.GetAccount("self")
+		if err != nil {
+			log.Fatal(err)
+		}
+		fetchOpts.Self = self.AccountID
+		log.Printf("syncing draft comments of account %d only", self.AccountID)
+	}
+
+	res := &syncResult{Trans: newRefTransaction()}
 	var infos []*AccountInfo
+	var gone []int
+	var failed []accountError
+	// fail aborts, or with --keep-going, records the error.
+	fail := func(id string, err error) {
+		if !*keepGoing {
+			log.Fatal(err)
+		}
+		log.Printf("account %s: %v", id, err)
+		failed = append(failed, accountError{ID: id, Err: err})
+	}
+
+	// checkEmails records the emails that Gerrit would reject.
+	var badEmails []invalidEmail
+	checkEmails := func(info *AccountInfo) {
+		for _, e := range invalidEmails(info) {
+			log.Printf("warning: account %d: %s has invalid email %q", e.AccountID, e.Field, e.Email)
+			badEmails = append(badEmails, e)
+		}
+	}
+
+	// checkpoint writes the accounts fetched so far, once there are
+	// enough of them.
+	checkpoint := func() {
+		if *checkpointEvery <= 0 || len(infos) < *checkpointEvery {
+			return
+		}
+		trans := newRefTransaction()
+		if err := saveAccountDetails(infos, nil, saveOpts, repo, trans); err != nil {
+			log.Fatal(err)
+		}
+		if remote.push != "" {
+			if err := recordUnpushed(repo.Storer, trans); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if err := applyTransaction(repo, trans, *force); err != nil {
+			log.Fatal(err)
+		}
+		res.Trans.merge(trans)
+		res.Fetched += len(infos)
+		if *progressFile != "" {
+			progress.LastAccountID = infos[len(infos)-1].account.AccountID
+			progress.record(trans)
+			if err := progress.write(*progressFile); err != nil {
+				log.Fatal(err)
+			}
+		}
+		infos = nil
+		log.Printf("checkpoint: wrote %d accounts", res.Fetched)
+	}
 
 	// googlesource.com caps at 8 QPS for logged-in users.
 	lim := rate.NewLimiter(8, 4)
 
-	// TODO - use account query to fetch AccountInfo data in bulk,
-	// so we can get account details for many IDs in one call.
-	// Right now, we have to probe all integer account IDs.
-	for _, id := range flag.Args() {
-		val, err := getAccountDetails(lim, client, id)
-		if val == nil {
-			continue
+	if *batch <= 0 {
+		for _, id := range ids {
+			if n, err := strconv.Atoi(id); err == nil && done(n) {
+				continue
+			}
+			val, err := getAccountDetails(lim, client, id, &fetchOpts)
+			if err != nil {
+				fail(id, err)
+				continue
+			}
+			if val != nil && (!serviceUsers.match(&val.account) || val.account.RegisteredOn.Before(since)) {
+				continue
+			}
+			if val == nil {
+				if *prune {
+					gone = append(gone, missingAccounts([]string{id}, nil)...)
+				}
+				continue
+			}
+			checkEmails(val)
+			infos = append(infos, val)
+			if len(infos)%100 == 0 {
+				fmt.Printf("%s ... ", id)
+			}
+			checkpoint()
+		}
+	}
+
+	var details []gerrit.AccountDetailInfo
+	var state *syncState
+	if *all {
+		start := time.Now()
+		if !commitTime.IsZero() && commitTime.Before(start) {
+			// An earlier cursor makes the next incremental
+			// sync fetch more, which is safe.
+			start = commitTime
 		}
+		details, err = queryAccounts(lim, client, serviceUsers.query(allAccountsQuery))
 		if err != nil {
 			log.Fatal(err)
 		}
+		if *prune {
+			gone, err = unlistedAccounts(repo, details)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		state, err = readSyncState(repo)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *incremental {
+			details, err = changedAccounts(repo, state, details)
+			if err != nil {
+				log.Fatal(err)
+			}
+			log.Printf("%d accounts changed since %v", len(details), state.LastSync)
+		}
+		for _, d := range details {
+			if d.AccountID > state.MaxAccountID {
+				state.MaxAccountID = d.AccountID
+			}
+		}
+		state.LastSync = start
+	} else if *query != "" {
+		details, err = queryAccounts(lim, client, serviceUsers.query(*query))
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// IDs unknown to the server are simply absent from the query
+	// result, so we don't pay for probing them.
+	for start := 0; *batch > 0 && start < len(ids); start += *batch {
+		end := start + *batch
+		if end > len(ids) {
+			end = len(ids)
+		}
+		found, err := queryAccounts(lim, client, serviceUsers.query(idsQuery(ids[start:end])))
+		if err != nil {
+			log.Fatal(err)
+		}
+		details = append(details, found...)
+		if *prune && !*all {
+			gone = append(gone, missingAccounts(ids[start:end], found)...)
+		}
+	}
+
+	sort.Slice(details, func(i, j int) bool { return details[i].AccountID < details[j].AccountID })
+	for i := range details {
+		if exclude[details[i].AccountID] || details[i].RegisteredOn.Before(since) || done(details[i].AccountID) {
+			continue
+		}
+		val, err := completeAccountInfo(lim, client, &details[i], &fetchOpts)
+		if err != nil {
+			fail(strconv.Itoa(details[i].AccountID), err)
+			continue
+		}
+		checkEmails(val)
 		infos = append(infos, val)
 		if len(infos)%100 == 0 {
-			fmt.Printf("%s ... ", id)
+			fmt.Printf("%d ... ", val.account.AccountID)
+		}
+		checkpoint()
+	}
+
+	var groups []gerrit.GroupInfo
+	if *syncGroups {
+		groups, err = listGroups(lim, client)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *errorReport != "" {
+		if err := writeErrorReport(*errorReport, failed); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *emailReport != "" {
+		if err := writeInvalidEmailReport(*emailReport, badEmails); err != nil {
+			log.Fatal(err)
 		}
 	}
 
-	if len(infos) == 0 {
+	gone = exclude.filterInts(gone)
+	res.Fetched += len(infos)
+	if res.Fetched == 0 && len(gone) == 0 && len(groups) == 0 {
 		log.Println("nothing to do.")
-		os.Exit(0)
 	}
-	if err := saveAccountDetails(infos, repo); err != nil {
+	// Checkpoints have been applied already, so the rest goes into
+	// a separate transaction.
+	trans := newRefTransaction()
+	if len(infos) > 0 || len(gone) > 0 {
+		if err := saveAccountDetails(infos, gone, saveOpts, repo, trans); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if len(groups) > 0 {
+		if err := saveGroups(groups, repo, trans); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if state != nil {
+		if err := state.save(repo, trans, newSig()); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *streamFile != "" {
+		if err := writeFastImportStream(*streamFile, overlay, trans); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("wrote %d ref updates to %s", len(trans.updates), *streamFile)
+		return
+	}
+	if overlay != nil {
+		plan, err := newSyncPlan(overlay, trans)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := plan.write(*planFile); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("wrote %d ref updates and %d objects to %s", len(plan.Updates), len(plan.Objects), *planFile)
+		return
+	}
+	if *dryRun {
+		if err := printPlan(os.Stdout, repo, trans); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if remote.push != "" {
+		if err := recordUnpushed(repo.Storer, trans); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := applyTransaction(repo, trans, *force); err != nil {
 		log.Fatal(err)
 	}
+	res.Trans.merge(trans)
+	res.End = time.Now()
+
+	// The old IDs of the run, from before any checkpoint, are the
+	// lease.
+	if remote.url != "" {
+		n, err := pushTransaction(repo.Storer, remote.url, remote.auth(), res.Trans, remote.nonAtomic)
+		if err != nil {
+			log.Fatalf("push %s: %v", remote.url, err)
+		}
+		log.Printf("pushed %d ref updates to %s", n, remote.url)
+	} else if remote.push != "" {
+		// This includes the updates of earlier runs whose push
+		// failed.
+		url, err := remoteURL(repo, remote.push)
+		if err != nil {
+			log.Fatal(err)
+		}
+		n, err := pushUnpushed(repo.Storer, url, remote.auth(), remote.nonAtomic)
+		if errors.Is(err, storage.ErrReferenceHasChanged) {
+			log.Fatalf("push %s: %v\nthe local refs are updated; sync again with --fetch to build on the refs of the remote", url, err)
+		} else if err != nil {
+			log.Fatalf("push %s: %v\nthe local refs are updated; the next sync with --push pushes them", url, err)
+		}
+		log.Printf("pushed %d ref updates to %s", n, url)
+	}
+
+	if *progressFile != "" {
+		if err := os.Remove(*progressFile); err != nil && !os.IsNotExist(err) {
+			log.Fatal(err)
+		}
+	}
+
+	if *repackFlag {
+		if err := repackRepo(repo); err != nil {
+			log.Fatalf("repack: %v", err)
+		}
+	}
+	// The in-memory repository of --remote has no files to maintain.
+	local := remote.url == ""
+	if local && *commitGraph > 0 && len(res.Trans.updates) >= *commitGraph {
+		// The refs are written; a missing commit-graph only costs
+		// time.
+		if err := writeCommitGraph(repo); err != nil {
+			log.Printf("warning: %v", err)
+		}
+	}
+	if local && *midxPacks > 0 {
+		if err := writeMultiPackIndex(repo, *midxPacks); err != nil {
+			log.Printf("warning: %v", err)
+		}
+	}
+
+	if *duplicateEmails != "" {
+		accounts, err := readLocalAccounts(repo)
+		if err != nil {
+			log.Fatal(err)
+		}
+		dups := duplicatePreferredEmails(accounts)
+		for _, d := range dups {
+			log.Printf("warning: preferred email %s is used by accounts %s", d.Email, strings.Trim(fmt.Sprint(d.Accounts), "[]"))
+		}
+		if err := writeDuplicateEmailReport(*duplicateEmails, dups); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *metricsFile != "" {
+		if err := writeMetricsFile(*metricsFile, repo, res); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if len(failed) > 0 {
+		log.Fatalf("%d accounts failed", len(failed))
+	}
 }
@@ -0,0 +1,393 @@
+//    Copyright 2023, Google LLC
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/hanwen/allusersync/gitutil"
+	gerrit "github.com/hanwen/go-gerrit"
+)
+
+func newTestRepo(t *testing.T) *git.Repository {
+	repo, err := git.Init(memory.NewStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return repo
+}
+
+// testAccount returns an account with the given external IDs; mailto:
+// IDs get their email address.
+func testAccount(id int, keys ...string) *AccountInfo {
+	inf := &AccountInfo{account: gerrit.AccountDetailInfo{
+		AccountInfo: gerrit.AccountInfo{AccountID: id, Name: "user"},
+	}}
+	for _, k := range keys {
+		e := gerrit.AccountExternalIdInfo{Identity: k}
+		if strings.HasPrefix(k, mailtoScheme) {
+			e.EmailAddress = strings.TrimPrefix(k, mailtoScheme)
+		}
+		inf.extIDs = append(inf.extIDs, e)
+	}
+	return inf
+}
+
+// syncAccounts saves infos into repo, and updates the refs.
+func syncAccounts(repo *git.Repository, opts *saveOptions, infos ...*AccountInfo) error {
+	trans := newRefTransaction()
+	if err := saveAccountDetails(infos, nil, opts, repo, trans); err != nil {
+		return err
+	}
+	return UpdateRepo(repo.Storer, trans)
+}
+
+// noteOwners returns the account of each external ID key in repo.
+func noteOwners(t *testing.T, repo *git.Repository) map[string]int {
+	nr, err := loadNotesRef(repo, externalIDsRef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	byAccount, err := externalIDsByAccount(repo.Storer, nr.notes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := map[string]int{}
+	for id, es := range byAccount {
+		for _, e := range es {
+			result[e.Key] = id
+		}
+	}
+	return result
+}
+
+func TestResolveCollisions(t *testing.T) {
+	var keys externalIDKeys
+	shared := keys.noteName("mailto:bob@example.com")
+	infos := []*AccountInfo{
+		testAccount(1001, "username:bob", "mailto:bob@example.com"),
+		testAccount(1000, "username:alice", "mailto:bob@example.com"),
+	}
+	for _, tc := range []struct {
+		policy  collisionPolicy
+		want    map[string]int
+		wantErr bool
+	}{
+		{failCollisions, nil, true},
+		{skipCollisions, map[string]int{shared: 0}, false},
+		{preferLowerID, map[string]int{shared: 1000}, false},
+	} {
+		got, err := resolveCollisions(infos, keys, tc.policy)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: got error %v, want error %v", tc.policy, err, tc.wantErr)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.policy, got, tc.want)
+		}
+	}
+
+	if got, err := resolveCollisions(infos[:1], keys, failCollisions); err != nil || got != nil {
+		t.Errorf("without collisions: got %v, %v", got, err)
+	}
+}
+
+func TestSaveAccountDetailsCollisions(t *testing.T) {
+	for _, tc := range []struct {
+		policy  collisionPolicy
+		owner   int
+		wantErr bool
+	}{
+		{failCollisions, 1002, true},
+		// The note keeps the account it had in the repository.
+		{skipCollisions, 1002, false},
+		{preferLowerID, 1000, false},
+	} {
+		repo := newTestRepo(t)
+		opts := &saveOptions{Collisions: tc.policy}
+		if err := syncAccounts(repo, opts, testAccount(1002, "mailto:bob@example.com")); err != nil {
+			t.Fatal(err)
+		}
+		err := syncAccounts(repo, opts,
+			testAccount(1001, "username:bob", "mailto:bob@example.com"),
+			testAccount(1000, "username:alice", "mailto:bob@example.com"))
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: got error %v, want error %v", tc.policy, err, tc.wantErr)
+		}
+		owners := noteOwners(t, repo)
+		if got := owners["mailto:bob@example.com"]; got != tc.owner {
+			t.Errorf("%s: mailto:bob@example.com belongs to %d, want %d", tc.policy, got, tc.owner)
+		}
+		if !tc.wantErr && (owners["username:bob"] != 1001 || owners["username:alice"] != 1000) {
+			t.Errorf("%s: uncontested IDs are %v", tc.policy, owners)
+		}
+	}
+}
+
+func TestOrphansIn(t *testing.T) {
+	var keys externalIDKeys
+	extID := func(id int, key string) *localExternalID {
+		return &localExternalID{Note: keys.noteName(key), Key: key, AccountID: id}
+	}
+	byAccount := map[int][]*localExternalID{
+		1000: {extID(1000, "username:alice")},
+		1002: {extID(1002, "username:carol"), extID(1002, "mailto:carol@example.com")},
+		1003: {extID(1003, "username:dave")},
+	}
+	got := orphansIn(byAccount, idSet{1000: true, 1001: true})
+	want := append(append([]*localExternalID{}, byAccount[1002]...), byAccount[1003]...)
+	sort.Slice(want, func(i, j int) bool { return want[i].Note < want[j].Note })
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	for _, prune := range []bool{false, true} {
+		notes, err := gitutil.LoadNoteMap(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, es := range byAccount {
+			for _, e := range es {
+				notes.Set(e.Note, gitutil.HashBlob([]byte(e.Key)))
+			}
+		}
+		reportOrphans(got, notes, prune)
+		wantLen := 4
+		if prune {
+			wantLen = 1
+		}
+		if notes.Len() != wantLen {
+			t.Errorf("prune %v: %d notes left, want %d", prune, notes.Len(), wantLen)
+		}
+		if _, ok := notes.Get(keys.noteName("username:alice")); !ok {
+			t.Errorf("prune %v: removed the note of an existing account", prune)
+		}
+	}
+}
+
+func TestSaveAccountDetailsOrphans(t *testing.T) {
+	for _, prune := range []bool{false, true} {
+		repo := newTestRepo(t)
+		opts := &saveOptions{Collisions: preferLowerID, PruneOrphans: prune}
+		if err := syncAccounts(repo, opts,
+			testAccount(1000, "username:alice"),
+			testAccount(1001, "username:bob", "mailto:bob@example.com")); err != nil {
+			t.Fatal(err)
+		}
+		name, err := gitutil.UserRefName(1001)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.Storer.RemoveReference(name); err != nil {
+			t.Fatal(err)
+		}
+
+		// Account 1000 takes over an ID of the orphaned account,
+		// so that one is no orphan.
+		if err := syncAccounts(repo, opts, testAccount(1000, "username:alice", "mailto:bob@example.com")); err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]int{
+			"username:alice":         1000,
+			"mailto:bob@example.com": 1000,
+		}
+		if !prune {
+			want["username:bob"] = 1001
+		}
+		if got := noteOwners(t, repo); !reflect.DeepEqual(got, want) {
+			t.Errorf("prune %v: got %v, want %v", prune, got, want)
+		}
+	}
+}
+
+func TestCheckExternalIDs(t *testing.T) {
+	repo := newTestRepo(t)
+	var keys externalIDKeys
+	notes, err := gitutil.LoadNoteMap(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addNote := func(name, data string) string {
+		id, err := gitutil.SaveBlob(repo.Storer, []byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		notes.Set(name, id)
+		return name
+	}
+	extID := func(key string, account int, extra string) string {
+		return addNote(keys.noteName(key), fmt.Sprintf("[externalId %q]\n\taccountId = %d\n%s", key, account, extra))
+	}
+
+	extID("username:alice", 1000, "")
+	malformed := addNote(keys.noteName("username:broken"), "[account]\n\tfullName = x\n")
+	misnamed := addNote(keys.noteName("username:other"), "[externalId \"username:wrong\"]\n\taccountId = 1000\n")
+	orphan := extID("username:ghost", 1099, "")
+	password := extID("mailto:pw@example.com", 1000, "\temail = pw@example.com\n\tpassword = bcrypt:4:c2FsdA==:aGFzaA==\n")
+	invalid := extID("external:bad", 1000, "\temail = not an email\n")
+	dup1 := extID("mailto:dup@example.com", 1000, "\temail = dup@example.com\n")
+	dup2 := extID("external:dup", 1001, "\temail = dup@example.com\n")
+	noUsername := extID("gerrit:carol", 1001, "")
+
+	tree, err := notes.Write(repo.Storer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := newSig()
+	c, err := gitutil.SaveCommit(repo.Storer, &object.Commit{Author: sig, Committer: sig, Message: "notes", TreeHash: tree})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []int{1000, 1001} {
+		name, err := gitutil.UserRefName(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.Storer.SetReference(plumbing.NewHashReference(name, c)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := repo.Storer.SetReference(plumbing.NewHashReference(externalIDsRef, c)); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := checkExternalIDs(repo, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dupMsg := "email dup@example.com is not unique, it is used by external IDs external:dup, mailto:dup@example.com"
+	want := []checkProblem{
+		{Kind: "malformed-note", Note: malformed, Message: fmt.Sprintf("note %s: want 1 externalId section, got 0", malformed)},
+		{Kind: "wrong-note-name", Note: misnamed, AccountID: 1000,
+			Message: fmt.Sprintf("external ID username:wrong should be in note %s", keys.noteName("username:wrong"))},
+		{Kind: "orphan", Note: orphan, AccountID: 1099, Message: "external ID username:ghost belongs to nonexistent account 1099"},
+		{Kind: "password", Note: password, AccountID: 1000,
+			Message: "external ID mailto:pw@example.com has a password, but only username: IDs may"},
+		{Kind: "invalid-email", Note: invalid, AccountID: 1000, Message: `external ID external:bad has invalid email "not an email"`},
+		{Kind: "duplicate-email", Note: dup1, AccountID: 1000, Message: dupMsg},
+		{Kind: "duplicate-email", Note: dup2, AccountID: 1001, Message: dupMsg},
+		{Kind: "no-username", Note: noUsername, AccountID: 1001,
+			Message: "account 1001 has external ID gerrit:carol but no username: ID"},
+	}
+	sort.Slice(want, func(i, j int) bool {
+		if want[i].Note != want[j].Note {
+			return want[i].Note < want[j].Note
+		}
+		return want[i].Kind < want[j].Kind
+	})
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got\n%v\nwant\n%v", got, want)
+	}
+
+	// Other tools parse the --json output.
+	for _, tc := range []struct {
+		problem checkProblem
+		want    string
+	}{
+		{got[indexOfKind(got, "orphan")],
+			fmt.Sprintf(`{"kind":"orphan","note":"%s","accountId":1099,"message":"external ID username:ghost belongs to nonexistent account 1099"}`, orphan)},
+		{checkProblem{Kind: "misplaced-ref", Message: "m"}, `{"kind":"misplaced-ref","message":"m"}`},
+	} {
+		data, err := json.Marshal(tc.problem)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != tc.want {
+			t.Errorf("got JSON %s, want %s", data, tc.want)
+		}
+	}
+}
+
+func indexOfKind(problems []checkProblem, kind string) int {
+	for i, p := range problems {
+		if p.Kind == kind {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestFinishPendingTransaction(t *testing.T) {
+	repo := newTestRepo(t)
+	st := repo.Storer
+	blob := func(s string) plumbing.Hash {
+		id, err := gitutil.SaveBlob(st, []byte(s))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	old, nu, other := blob("old"), blob("new"), blob("other")
+	tr := newRefTransaction()
+	tr.updates["refs/meta/behind"] = &RefUpdate{OldID: old, NewID: nu}
+	tr.updates["refs/meta/done"] = &RefUpdate{OldID: old, NewID: nu}
+	tr.updates["refs/meta/moved"] = &RefUpdate{OldID: old, NewID: nu}
+	tr.updates["refs/meta/deleted"] = &RefUpdate{OldID: old}
+	tr.updates["refs/meta/created"] = &RefUpdate{NewID: nu}
+
+	decoded, err := decodeTransaction(pendingTransactionRef, encodeTransaction(tr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, tr) {
+		t.Errorf("decoded %v, want %v", decoded.updates, tr.updates)
+	}
+	if _, err := decodeTransaction(pendingTransactionRef, []byte("garbage\n")); err == nil {
+		t.Error("decoding garbage succeeded")
+	}
+
+	// The run died after writing refs/meta/done; someone else moved
+	// refs/meta/moved since.
+	for name, id := range map[plumbing.ReferenceName]plumbing.Hash{
+		"refs/meta/behind":  old,
+		"refs/meta/done":    nu,
+		"refs/meta/moved":   other,
+		"refs/meta/deleted": old,
+	} {
+		if err := st.SetReference(plumbing.NewHashReference(name, id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writePendingTransaction(st, tr); err != nil {
+		t.Fatal(err)
+	}
+	if err := writePendingTransaction(st, tr); err == nil {
+		t.Error("wrote a second pending transaction")
+	}
+	if err := finishPendingTransaction(st); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[plumbing.ReferenceName]plumbing.Hash{
+		"refs/meta/behind":    nu,
+		"refs/meta/done":      nu,
+		"refs/meta/moved":     other,
+		"refs/meta/deleted":   plumbing.ZeroHash,
+		"refs/meta/created":   nu,
+		pendingTransactionRef: plumbing.ZeroHash,
+	} {
+		if got, err := currentRef(st, name); err != nil || got != want {
+			t.Errorf("%s: got %s, %v; want %s", name, got, err, want)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+//    Copyright 2023, Google LLC
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/hanwen/allusersync/gitutil"
+)
+
+// writeCommitGraph rewrites the commit-graph for all refs, so git,
+// JGit and go-git can walk the ref histories without parsing every
+// commit. Only commits that the old commit-graph lacks are read, but
+// the file is written in full, in time and space linear in all
+// commits.
+func writeCommitGraph(repo *git.Repository) error {
+	fs := dotGitFS(repo.Storer)
+	if fs == nil {
+		return fmt.Errorf("commit-graph: repository has no git directory")
+	}
+	refs, err := repo.References()
+	if err != nil {
+		return err
+	}
+	var tips []plumbing.Hash
+	if err := refs.ForEach(func(r *plumbing.Reference) error {
+		if r.Type() == plumbing.HashReference {
+			tips = append(tips, r.Hash())
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	n, err := gitutil.WriteCommitGraph(repo.Storer, fs, tips)
+	if err != nil {
+		return err
+	}
+	log.Printf("wrote commit-graph with %d commits", n)
+	return nil
+}
+
+// hasCommitGraph returns whether the repository has a commit-graph,
+// which must be rewritten if commits are dropped.
+func hasCommitGraph(repo *git.Repository) bool {
+	fs := dotGitFS(repo.Storer)
+	if fs == nil {
+		return false
+	}
+	_, err := fs.Stat(gitutil.CommitGraphFile)
+	return err == nil
+}
+
+// writeMultiPackIndex rewrites the multi-pack-index if the repository
+// has one already, or if it has at least minPacks packs, for minPacks
+// > 0.
+func writeMultiPackIndex(repo *git.Repository, minPacks int) error {
+	fs := dotGitFS(repo.Storer)
+	if fs == nil {
+		return fmt.Errorf("multi-pack-index: repository has no git directory")
+	}
+	packs, err := gitutil.ListPacks(fs)
+	if err != nil {
+		return err
+	}
+	if _, err := fs.Stat(gitutil.MultiPackIndexFile); err != nil && (minPacks <= 0 || len(packs) < minPacks) {
+		return nil
+	}
+	p, n, err := gitutil.WriteMultiPackIndex(fs)
+	if err != nil {
+		return err
+	}
+	log.Printf("wrote multi-pack-index with %d objects in %d packs", n, p)
+	return nil
+}
@@ -0,0 +1,160 @@
+//    Copyright 2023, Google LLC
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/hanwen/allusersync/gitutil"
+)
+
+// mergePolicy decides how user refs with local commits are updated.
+type mergePolicy string
+
+const (
+	// noMerge commits the server state on top of local commits.
+	noMerge mergePolicy = ""
+
+	// serverWins and localWins merge local commits with the server
+	// state. Files changed on both sides are taken from the server,
+	// or kept from the local side, respectively.
+	serverWins mergePolicy = "server-wins"
+	localWins  mergePolicy = "local-wins"
+)
+
+func parseMergePolicy(s string) (mergePolicy, error) {
+	switch p := mergePolicy(s); p {
+	case noMerge, serverWins, localWins:
+		return p, nil
+	}
+	return "", fmt.Errorf("--merge must be server-wins or local-wins, got %q", s)
+}
+
+// isSyncCommit returns true for commits written by allusersync.
+func isSyncCommit(c *object.Commit) bool {
+	return c.Committer.Email == newSig().Email
+}
+
+// lastServerState returns the newest commit below c that holds the
+// server state as we last wrote it, or nil if there is none. Local
+// commits are skipped along the first parent, and our own merges along
+// the second parent, which is the server side.
+func lastServerState(c *object.Commit) (*object.Commit, error) {
+	for {
+		ours := isSyncCommit(c)
+		if ours && c.NumParents() <= 1 {
+			return c, nil
+		}
+		if c.NumParents() == 0 {
+			return nil, nil
+		}
+		i := 0
+		if ours {
+			i = 1
+		}
+		var err error
+		c, err = c.Parent(i)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func entryHash(t *object.Tree, name string) plumbing.Hash {
+	if e, err := t.FindEntry(name); err == nil {
+		return e.Hash
+	}
+	return plumbing.ZeroHash
+}
+
+// mergeServerState commits the server's files on top of the last
+// server state below head, and merges that with head. The server's
+// files are entries; a ZeroHash entry is a file the server doesn't
+// have. It returns the new commit, or the ZeroHash if head already has
+// the result.
+func mergeServerState(st storer.EncodedObjectStorer, head *object.Commit, entries []object.TreeEntry, policy mergePolicy, sig object.Signature, msg string) (plumbing.Hash, error) {
+	base, err := lastServerState(head)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	baseTree := &object.Tree{}
+	if base != nil {
+		if baseTree, err = base.Tree(); err != nil {
+			return plumbing.ZeroHash, err
+		}
+	}
+	headTree, err := head.Tree()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	serverTreeID, err := gitutil.PatchTree(st, baseTree, entries)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if base != nil && serverTreeID == base.TreeHash {
+		// Nothing changed on the server; keep the local edits.
+		return plumbing.ZeroHash, nil
+	}
+	if base != nil && base.Hash == head.Hash {
+		// No local commits, so there is nothing to merge.
+		return gitutil.SaveCommit(st, &object.Commit{
+			Author:       sig,
+			Committer:    sig,
+			Message:      msg,
+			TreeHash:     serverTreeID,
+			ParentHashes: []plumbing.Hash{head.Hash},
+		})
+	}
+
+	var changes []object.TreeEntry
+	for _, e := range entries {
+		b := entryHash(baseTree, e.Name)
+		l := entryHash(headTree, e.Name)
+		switch {
+		case l == e.Hash || e.Hash == b:
+			continue
+		case l != b && policy == localWins:
+			continue
+		}
+		changes = append(changes, e)
+	}
+	mergedTreeID, err := gitutil.PatchTree(st, headTree, changes)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if mergedTreeID == head.TreeHash {
+		return plumbing.ZeroHash, nil
+	}
+
+	server := &object.Commit{
+		Author:    sig,
+		Committer: sig,
+		Message:   msg,
+		TreeHash:  serverTreeID,
+	}
+	if base != nil {
+		server.ParentHashes = []plumbing.Hash{base.Hash}
+	}
+	serverID, err := gitutil.SaveCommit(st, server)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return gitutil.SaveMergeCommit(st, mergedTreeID, []plumbing.Hash{head.Hash, serverID}, sig,
+		fmt.Sprintf("merge server state (%s)", policy))
+}
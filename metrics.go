@@ -0,0 +1,106 @@
+//    Copyright 2023, Google LLC
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+)
+
+// syncResult summarizes a sync run for reporting.
+type syncResult struct {
+	Fetched int
+	Trans   *RefTransaction
+	End     time.Time
+}
+
+// drift returns the number of accounts whose user ref was updated,
+// ie. that differed between server and repository.
+func (r *syncResult) drift() int {
+	n := 0
+	if r.Trans == nil {
+		return n
+	}
+	for name := range r.Trans.updates {
+		if userRefRE.MatchString(name.String()) {
+			n++
+		}
+	}
+	return n
+}
+
+func writeMetric(buf *bytes.Buffer, name, help, typ string, samples ...string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(buf, "# TYPE %s %s\n", name, typ)
+	for _, s := range samples {
+		fmt.Fprintf(buf, "%s%s\n", name, s)
+	}
+}
+
+// writeMetricsFile writes a snapshot in the Prometheus text format,
+// suitable for node-exporter's textfile collector. The file is
+// replaced atomically, so the collector never sees partial output.
+func writeMetricsFile(name string, repo *git.Repository, res *syncResult) error {
+	st, err := computeStats(repo)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	writeMetric(&buf, "allusersync_accounts", "Accounts in the repository.", "gauge",
+		fmt.Sprintf(`{state="active"} %d`, st.Accounts-st.InactiveAccounts),
+		fmt.Sprintf(`{state="inactive"} %d`, st.InactiveAccounts))
+	var schemes []string
+	for _, e := range sortedCounts(st.Schemes) {
+		schemes = append(schemes, fmt.Sprintf(`{scheme=%q} %d`, e.Key, e.Count))
+	}
+	writeMetric(&buf, "allusersync_external_ids", "External IDs in the repository.", "gauge", schemes...)
+	writeMetric(&buf, "allusersync_last_sync_fetched_accounts", "Accounts fetched from the server in the last sync.", "gauge",
+		fmt.Sprintf(" %d", res.Fetched))
+	writeMetric(&buf, "allusersync_last_sync_drift_accounts", "Accounts that differed from the server in the last sync.", "gauge",
+		fmt.Sprintf(" %d", res.drift()))
+	writeMetric(&buf, "allusersync_last_sync_timestamp_seconds", "Completion time of the last successful sync.", "gauge",
+		fmt.Sprintf(" %d", res.End.Unix()))
+
+	return writeFileAtomic(name, buf.Bytes())
+}
+
+// writeFileAtomic writes data to a temporary file, and renames it to
+// name, so readers never see partial content.
+func writeFileAtomic(name string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(name), ".allusersync-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
@@ -0,0 +1,180 @@
+//    Copyright 2023, Google LLC
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"sort"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/hanwen/allusersync/gitutil"
+)
+
+// notesRef is a notemap stored on a ref.
+type notesRef struct {
+	name plumbing.ReferenceName
+
+	// parent is the commit the notes were read from, or nil if the
+	// ref does not exist yet.
+	parent *object.Commit
+	notes  *gitutil.NoteMap
+
+	// squash is the window in which a commit replaces the previous
+	// one with the same message, instead of stacking on it.
+	squash time.Duration
+}
+
+func loadNotesRef(repo *git.Repository, name plumbing.ReferenceName) (*notesRef, error) {
+	parent, err := readRefCommit(repo, name)
+	if err != nil {
+		return nil, err
+	}
+	var tree *object.Tree
+	if parent != nil {
+		tree, err = parent.Tree()
+		if err != nil {
+			return nil, err
+		}
+	}
+	notes, err := gitutil.LoadNoteMap(tree)
+	if err != nil {
+		return nil, err
+	}
+	return &notesRef{
+		name:   name,
+		parent: parent,
+		notes:  notes,
+	}, nil
+}
+
+// squashes returns true if a commit with the given signature and
+// message should replace c rather than be added on top of it.
+func (nr *notesRef) squashes(c *object.Commit, sig object.Signature, msg string) bool {
+	return nr.squash > 0 && isSyncCommit(c) && c.NumParents() <= 1 &&
+		c.Message == msg && sig.When.Sub(c.Author.When) < nr.squash
+}
+
+// commit writes the notes, and schedules a ref update in trans if they
+// changed. The commit can be called again for more changes; the ref
+// then gets a chain of commits.
+func (nr *notesRef) commit(st storer.EncodedObjectStorer, trans *RefTransaction, sig object.Signature, msg string) error {
+	if nr.parent == nil && nr.notes.Len() == 0 {
+		return nil
+	}
+	id, err := nr.notes.Write(st)
+	if err != nil {
+		return err
+	}
+	if nr.parent != nil && nr.parent.TreeHash == id {
+		return nil
+	}
+
+	c := &object.Commit{
+		Author:    sig,
+		Committer: sig,
+		TreeHash:  id,
+		Message:   msg,
+	}
+	if nr.parent != nil {
+		c.ParentHashes = []plumbing.Hash{nr.parent.Hash}
+		if nr.squashes(nr.parent, sig, msg) {
+			c.Author = nr.parent.Author
+			c.ParentHashes = nr.parent.ParentHashes
+		}
+	}
+	id, err = gitutil.SaveCommit(st, c)
+	if err != nil {
+		return err
+	}
+	update := trans.updates[nr.name]
+	if update == nil {
+		update = &RefUpdate{}
+		if nr.parent != nil {
+			update.OldID = nr.parent.Hash
+		}
+		trans.updates[nr.name] = update
+	}
+	update.NewID = id
+	nr.parent, err = object.GetCommit(st, id)
+	return err
+}
+
+// commitNoteMap loads the notes of a commit; a nil commit has no
+// notes.
+func commitNoteMap(c *object.Commit) (*gitutil.NoteMap, error) {
+	if c == nil {
+		return gitutil.LoadNoteMap(nil)
+	}
+	t, err := c.Tree()
+	if err != nil {
+		return nil, err
+	}
+	return gitutil.LoadNoteMap(t)
+}
+
+// mergeNotes merges per note: notes that we changed relative to base
+// are applied to theirs. If both sides changed a note differently,
+// ours wins, as if our update was retried on top of theirs. It
+// returns the conflicting note names, and the merged map, based on
+// theirs.
+func mergeNotes(base, ours, theirs *object.Commit) (*gitutil.NoteMap, []string, error) {
+	b, err := commitNoteMap(base)
+	if err != nil {
+		return nil, nil, err
+	}
+	o, err := commitNoteMap(ours)
+	if err != nil {
+		return nil, nil, err
+	}
+	merged, err := commitNoteMap(theirs)
+	if err != nil {
+		return nil, nil, err
+	}
+	t := map[string]plumbing.Hash{}
+	for _, n := range merged.Names() {
+		t[n], _ = merged.Get(n)
+	}
+
+	names := map[string]bool{}
+	for _, n := range b.Names() {
+		names[n] = true
+	}
+	for _, n := range o.Names() {
+		names[n] = true
+	}
+
+	var conflicts []string
+	for n := range names {
+		bid, inBase := b.Get(n)
+		oid, inOurs := o.Get(n)
+		if inBase == inOurs && bid == oid {
+			continue
+		}
+		tid, inTheirs := t[n]
+		if (inTheirs != inBase || tid != bid) && (inTheirs != inOurs || tid != oid) {
+			conflicts = append(conflicts, n)
+		}
+		if inOurs {
+			merged.Set(n, oid)
+		} else {
+			merged.Remove(n)
+		}
+	}
+	sort.Strings(conflicts)
+	return merged, conflicts, nil
+}
@@ -0,0 +1,110 @@
+//    Copyright 2023, Google LLC
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/hanwen/allusersync/gitutil"
+)
+
+// orphanExternalIDs returns the external IDs whose account is not in
+// accounts, sorted by note name. Gerrit refuses to create an account
+// for an external ID that is already taken, so these block the account
+// on the destination server.
+func orphanExternalIDs(st storer.EncodedObjectStorer, notes *gitutil.NoteMap, accounts idSet) ([]*localExternalID, error) {
+	byAccount, err := externalIDsByAccount(st, notes)
+	if err != nil {
+		return nil, err
+	}
+	return orphansIn(byAccount, accounts), nil
+}
+
+// orphansIn is orphanExternalIDs for external IDs that are already
+// grouped by account, as externalIDsByAccount returns them.
+func orphansIn(byAccount map[int][]*localExternalID, accounts idSet) []*localExternalID {
+	var result []*localExternalID
+	for id, extIDs := range byAccount {
+		if !accounts[id] {
+			result = append(result, extIDs...)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Note < result[j].Note })
+	return result
+}
+
+// reportOrphans logs the orphaned external IDs, and removes them from
+// notes if prune is set.
+func reportOrphans(orphans []*localExternalID, notes *gitutil.NoteMap, prune bool) {
+	for _, e := range orphans {
+		if prune {
+			log.Printf("removing external ID %s of nonexistent account %d", e.Key, e.AccountID)
+			notes.Remove(e.Note)
+		} else {
+			log.Printf("warning: external ID %s belongs to nonexistent account %d", e.Key, e.AccountID)
+		}
+	}
+}
+
+func orphansMain(args []string) error {
+	fs := flag.NewFlagSet("orphans", flag.ExitOnError)
+	repoDir := fs.String("repo", "", "all-users repo")
+	var sf storageFlags
+	sf.register(fs)
+	prune := fs.Bool("prune", false, "remove the orphaned external IDs")
+	fs.Parse(args)
+	if *repoDir == "" {
+		return fmt.Errorf("must specify --repo")
+	}
+
+	repo, err := sf.open(*repoDir)
+	if err != nil {
+		return err
+	}
+	if *prune {
+		if err := finishPendingTransaction(repo.Storer); err != nil {
+			return err
+		}
+	}
+	accounts, err := localAccountIDs(repo)
+	if err != nil {
+		return err
+	}
+	nr, err := loadNotesRef(repo, externalIDsRef)
+	if err != nil {
+		return err
+	}
+
+	orphans, err := orphanExternalIDs(repo.Storer, nr.notes, accounts)
+	if err != nil {
+		return err
+	}
+	if !*prune {
+		for _, e := range orphans {
+			fmt.Printf("%s\t%d\t%s\n", e.Note, e.AccountID, e.Key)
+		}
+		return nil
+	}
+	reportOrphans(orphans, nr.notes, true)
+	trans := newRefTransaction()
+	if err := nr.commit(repo.Storer, trans, newSig(), "remove orphaned external IDs"); err != nil {
+		return err
+	}
+	return UpdateRepo(repo.Storer, trans)
+}
@@ -0,0 +1,285 @@
+//    Copyright 2023, Google LLC
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/storage"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/hanwen/allusersync/gitutil"
+)
+
+// overlayStorage reads objects from the underlying storage, but keeps
+// new objects in memory, so they can be written to a plan.
+type overlayStorage struct {
+	storage.Storer
+	mem *memory.ObjectStorage
+}
+
+func newOverlayStorage(base storage.Storer) *overlayStorage {
+	return &overlayStorage{
+		Storer: base,
+		mem:    &memory.NewStorage().ObjectStorage,
+	}
+}
+
+func (s *overlayStorage) NewEncodedObject() plumbing.EncodedObject {
+	return s.mem.NewEncodedObject()
+}
+
+func (s *overlayStorage) SetEncodedObject(obj plumbing.EncodedObject) (plumbing.Hash, error) {
+	if s.Storer.HasEncodedObject(obj.Hash()) == nil {
+		return obj.Hash(), nil
+	}
+	return s.mem.SetEncodedObject(obj)
+}
+
+func (s *overlayStorage) EncodedObject(t plumbing.ObjectType, id plumbing.Hash) (plumbing.EncodedObject, error) {
+	if obj, err := s.mem.EncodedObject(t, id); err == nil {
+		return obj, nil
+	}
+	return s.Storer.EncodedObject(t, id)
+}
+
+func (s *overlayStorage) HasEncodedObject(id plumbing.Hash) error {
+	if s.mem.HasEncodedObject(id) == nil {
+		return nil
+	}
+	return s.Storer.HasEncodedObject(id)
+}
+
+func (s *overlayStorage) EncodedObjectSize(id plumbing.Hash) (int64, error) {
+	if sz, err := s.mem.EncodedObjectSize(id); err == nil {
+		return sz, nil
+	}
+	return s.Storer.EncodedObjectSize(id)
+}
+
+func (s *overlayStorage) IterEncodedObjects(t plumbing.ObjectType) (storer.EncodedObjectIter, error) {
+	mem, err := s.mem.IterEncodedObjects(t)
+	if err != nil {
+		return nil, err
+	}
+	base, err := s.Storer.IterEncodedObjects(t)
+	if err != nil {
+		return nil, err
+	}
+	return storer.NewMultiEncodedObjectIter([]storer.EncodedObjectIter{mem, base}), nil
+}
+
+// planUpdate is a ref update in a plan. Old is empty for refs that
+// don't exist yet, and New is empty for deleted refs.
+type planUpdate struct {
+	Ref string
+	Old string `json:",omitempty"`
+	New string `json:",omitempty"`
+}
+
+type planObject struct {
+	Type string
+	ID   string
+	Data []byte
+}
+
+// syncPlan holds the outcome of a sync, to be applied later.
+type syncPlan struct {
+	Updates []planUpdate
+	Objects []planObject
+}
+
+// newSyncPlan records the updates in trans, and the objects written to
+// ov.
+func newSyncPlan(ov *overlayStorage, trans *RefTransaction) (*syncPlan, error) {
+	plan := &syncPlan{}
+	for name, u := range trans.updates {
+		pu := planUpdate{Ref: name.String()}
+		if ref, err := ov.Reference(name); err == nil {
+			pu.Old = ref.Hash().String()
+		}
+		if !u.NewID.IsZero() {
+			pu.New = u.NewID.String()
+		}
+		plan.Updates = append(plan.Updates, pu)
+	}
+	sort.Slice(plan.Updates, func(i, j int) bool { return plan.Updates[i].Ref < plan.Updates[j].Ref })
+
+	iter, err := ov.mem.IterEncodedObjects(plumbing.AnyObject)
+	if err != nil {
+		return nil, err
+	}
+	if err := iter.ForEach(func(obj plumbing.EncodedObject) error {
+		r, err := obj.Reader()
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		plan.Objects = append(plan.Objects, planObject{
+			Type: obj.Type().String(),
+			ID:   obj.Hash().String(),
+			Data: data,
+		})
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	sort.Slice(plan.Objects, func(i, j int) bool { return plan.Objects[i].ID < plan.Objects[j].ID })
+	return plan, nil
+}
+
+// writeFastImportStream writes the objects written to ov and the
+// updates of trans to name, as a stream for `git fast-import`.
+func writeFastImportStream(name string, ov *overlayStorage, trans *RefTransaction) error {
+	var refs []*plumbing.Reference
+	for _, n := range trans.sortedNames() {
+		u := trans.updates[n]
+		if u.NewID.IsZero() {
+			return fmt.Errorf("%s: fast-import streams cannot delete refs; use --plan", n)
+		}
+		refs = append(refs, plumbing.NewHashReference(n, u.NewID))
+	}
+	objs := make([]plumbing.EncodedObject, 0, len(ov.mem.Objects))
+	for _, obj := range ov.mem.Objects {
+		objs = append(objs, obj)
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if err := gitutil.WriteFastImport(f, ov, objs, refs); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (p *syncPlan) write(name string) error {
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(name, data, 0o644)
+}
+
+func readSyncPlan(name string) (*syncPlan, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	p := &syncPlan{}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return p, nil
+}
+
+// apply writes the plan's objects into the repository, and returns
+// the ref updates. It fails if any ref moved since the plan was made.
+func (p *syncPlan) apply(repo *git.Repository) (*RefTransaction, error) {
+	for _, o := range p.Objects {
+		t, err := plumbing.ParseObjectType(o.Type)
+		if err != nil {
+			return nil, err
+		}
+		obj := repo.Storer.NewEncodedObject()
+		obj.SetType(t)
+		w, err := obj.Writer()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(o.Data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		if obj.Hash().String() != o.ID {
+			return nil, fmt.Errorf("object %s: content hashes to %s", o.ID, obj.Hash())
+		}
+		if _, err := repo.Storer.SetEncodedObject(obj); err != nil {
+			return nil, err
+		}
+	}
+
+	trans := newRefTransaction()
+	for _, u := range p.Updates {
+		name := plumbing.ReferenceName(u.Ref)
+		cur := ""
+		if ref, err := repo.Reference(name, false); err == nil {
+			cur = ref.Hash().String()
+		}
+		if cur != u.Old {
+			return nil, fmt.Errorf("%s is at %q, but the plan expects %q", name, cur, u.Old)
+		}
+		update := &RefUpdate{}
+		if u.Old != "" {
+			update.OldID = plumbing.NewHash(u.Old)
+		}
+		if u.New != "" {
+			update.NewID = plumbing.NewHash(u.New)
+		}
+		trans.updates[name] = update
+	}
+	return trans, nil
+}
+
+// applyMain applies plans written by syncing with --plan.
+func applyMain(args []string) error {
+	fs := flag.NewFlagSet("apply", flag.ExitOnError)
+	repoDir := fs.String("repo", "", "all-users repo")
+	var sf storageFlags
+	sf.register(fs)
+	fs.Parse(args)
+	if *repoDir == "" || fs.NArg() != 1 {
+		return fmt.Errorf("usage: apply --repo REPO PLAN-FILE")
+	}
+
+	repo, err := sf.open(*repoDir)
+	if err != nil {
+		return err
+	}
+	if err := finishPendingTransaction(repo.Storer); err != nil {
+		return err
+	}
+	plan, err := readSyncPlan(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	trans, err := plan.apply(repo)
+	if err != nil {
+		return err
+	}
+	if err := printPlan(os.Stdout, repo, trans); err != nil {
+		return err
+	}
+	if err := UpdateRepo(repo.Storer, trans); err != nil {
+		return err
+	}
+	log.Printf("applied %d ref updates", len(trans.updates))
+	return nil
+}
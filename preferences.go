@@ -0,0 +1,132 @@
+//    Copyright 2023, Google LLC
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/format/config"
+	gerrit "github.com/hanwen/go-gerrit"
+	"golang.org/x/time/rate"
+)
+
+// preferenceSections maps the sections of preferences.config to the
+// REST endpoint serving them.
+var preferenceSections = []struct {
+	section  string
+	endpoint string
+}{
+	{"general", "preferences"},
+	{"diff", "preferences.diff"},
+	{"edit", "preferences.edit"},
+}
+
+// camelCase converts REST field names (change_table) to config keys
+// (changeTable).
+func camelCase(s string) string {
+	parts := strings.Split(s, "_")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] != "" {
+			parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
+
+// scalarValue renders a JSON string, number or boolean as a config
+// value.
+func scalarValue(raw json.RawMessage) (string, bool) {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s, true
+	}
+	var v interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return "", false
+	}
+	switch v.(type) {
+	case bool, float64:
+		return string(raw), true
+	}
+	return "", false
+}
+
+// addPreferences adds the preferences from a REST reply to cfg.
+func addPreferences(cfg *config.Config, section string, prefs map[string]json.RawMessage) error {
+	var keys []string
+	for k := range prefs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		raw := prefs[k]
+		if k == "my" {
+			// The "My" menu is stored as [my "name"] subsections.
+			var items []gerrit.TopMenuItemInfo
+			if err := json.Unmarshal(raw, &items); err != nil {
+				return fmt.Errorf("%s.my: %v", section, err)
+			}
+			for _, it := range items {
+				cfg.SetOption("my", it.Name, "url", it.URL)
+				if it.Target != "" {
+					cfg.SetOption("my", it.Name, "target", it.Target)
+				}
+				if it.ID != "" {
+					cfg.SetOption("my", it.Name, "id", it.ID)
+				}
+			}
+			continue
+		}
+
+		if val, ok := scalarValue(raw); ok {
+			cfg.SetOption(section, "", camelCase(k), val)
+			continue
+		}
+
+		var list []json.RawMessage
+		if err := json.Unmarshal(raw, &list); err != nil {
+			// Nested objects have no config representation.
+			continue
+		}
+		for _, elt := range list {
+			if val, ok := scalarValue(elt); ok {
+				cfg.AddOption(section, "", camelCase(k), val)
+			}
+		}
+	}
+	return nil
+}
+
+// getPreferences fetches general, diff and edit preferences, and
+// returns them in Gerrit's preferences.config format.
+func getPreferences(lim *rate.Limiter, cl *gerrit.Client, id string) (*config.Config, error) {
+	cfg := config.New()
+	for _, ps := range preferenceSections {
+		lim.Wait(context.Background())
+		prefs := map[string]json.RawMessage{}
+		if _, err := cl.Call("GET", fmt.Sprintf("accounts/%s/%s", id, ps.endpoint), nil, &prefs); err != nil {
+			return nil, err
+		}
+		if err := addPreferences(cfg, ps.section, prefs); err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
@@ -0,0 +1,84 @@
+//    Copyright 2023, Google LLC
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// syncProgress is stored in the --progress-file at every checkpoint.
+// Accounts are processed in ID order, so a resumed run can skip
+// everything up to LastAccountID.
+type syncProgress struct {
+	LastAccountID int
+
+	// Refs holds the refs written by checkpoints so far, and their
+	// values. An empty value is a deleted ref.
+	Refs map[string]string
+}
+
+func readSyncProgress(name string) (*syncProgress, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	p := &syncProgress{}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return p, nil
+}
+
+func (p *syncProgress) write(name string) error {
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(name, data)
+}
+
+// record adds the updates of a checkpoint.
+func (p *syncProgress) record(trans *RefTransaction) {
+	if p.Refs == nil {
+		p.Refs = map[string]string{}
+	}
+	for name, u := range trans.updates {
+		val := ""
+		if !u.NewID.IsZero() {
+			val = u.NewID.String()
+		}
+		p.Refs[name.String()] = val
+	}
+}
+
+// check warns about refs that changed after the checkpoint was
+// written, eg. by another process.
+func (p *syncProgress) check(repo *git.Repository) {
+	for name, want := range p.Refs {
+		got := ""
+		if ref, err := repo.Reference(plumbing.ReferenceName(name), false); err == nil {
+			got = ref.Hash().String()
+		}
+		if got != want {
+			log.Printf("warning: %s is at %q, but the last checkpoint wrote %q", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+//    Copyright 2023, Google LLC
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"log"
+	"sort"
+	"strconv"
+
+	git "github.com/go-git/go-git/v5"
+	gerrit "github.com/hanwen/go-gerrit"
+)
+
+// missingAccounts returns the requested account IDs that the server
+// did not return.
+func missingAccounts(requested []string, found []gerrit.AccountDetailInfo) []int {
+	have := map[int]bool{}
+	for _, d := range found {
+		have[d.AccountID] = true
+	}
+
+	var result []int
+	for _, s := range requested {
+		id, err := strconv.Atoi(s)
+		if err != nil {
+			log.Printf("cannot prune %q: not an account ID", s)
+			continue
+		}
+		if !have[id] {
+			result = append(result, id)
+		}
+	}
+	sort.Ints(result)
+	return result
+}
+
+// unlistedAccounts returns the IDs of local accounts that are absent
+// from a listing of all accounts on the server.
+func unlistedAccounts(repo *git.Repository, all []gerrit.AccountDetailInfo) ([]int, error) {
+	accounts, err := readLocalAccounts(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	var requested []string
+	for _, a := range accounts {
+		requested = append(requested, strconv.Itoa(a.ID))
+	}
+	return missingAccounts(requested, all), nil
+}
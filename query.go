@@ -0,0 +1,126 @@
+//    Copyright 2023, Google LLC
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	gerrit "github.com/hanwen/go-gerrit"
+	"golang.org/x/time/rate"
+)
+
+// accountQueryLimit is the page size for account queries. Gerrit's
+// default query limit for non-admins is 500.
+const accountQueryLimit = 500
+
+// queryAccounts runs an account query, following pagination, and
+// returns the accounts with details and all emails.
+func queryAccounts(lim *rate.Limiter, cl *gerrit.Client, query string) ([]gerrit.AccountDetailInfo, error) {
+	var result []gerrit.AccountDetailInfo
+	for {
+		v := url.Values{}
+		v.Set("q", query)
+		v.Add("o", "DETAILS")
+		v.Add("o", "ALL_EMAILS")
+		v.Set("n", strconv.Itoa(accountQueryLimit))
+		if len(result) > 0 {
+			v.Set("S", strconv.Itoa(len(result)))
+		}
+
+		lim.Wait(context.Background())
+		var page []gerrit.AccountDetailInfo
+		if _, err := cl.Call("GET", "accounts/?"+v.Encode(), nil, &page); err != nil {
+			return nil, err
+		}
+		result = append(result, page...)
+		if len(page) == 0 || !page[len(page)-1].MoreAccounts {
+			break
+		}
+	}
+	return result, nil
+}
+
+// allAccountsQuery matches every account, including inactive ones.
+const allAccountsQuery = "is:active OR is:inactive"
+
+// idsQuery returns a query matching the given account IDs. Without an
+// explicit is:active or is:inactive, Gerrit only returns active
+// accounts.
+func idsQuery(ids []string) string {
+	return "(" + strings.Join(ids, " OR ") + ") AND (" + allAccountsQuery + ")"
+}
+
+// serviceUserFilter selects whether service users (bots) are synced.
+type serviceUserFilter string
+
+const (
+	includeServiceUsers serviceUserFilter = "include"
+	excludeServiceUsers serviceUserFilter = "exclude"
+	onlyServiceUsers    serviceUserFilter = "only"
+)
+
+const serviceUserTag = "SERVICE_USER"
+
+func parseServiceUserFilter(s string) (serviceUserFilter, error) {
+	switch f := serviceUserFilter(s); f {
+	case includeServiceUsers, excludeServiceUsers, onlyServiceUsers:
+		return f, nil
+	}
+	return "", fmt.Errorf("--service-users must be include, exclude or only, got %q", s)
+}
+
+// query restricts an account query according to the filter.
+func (f serviceUserFilter) query(q string) string {
+	switch f {
+	case excludeServiceUsers:
+		return "(" + q + ") -is:serviceuser"
+	case onlyServiceUsers:
+		return "(" + q + ") is:serviceuser"
+	}
+	return q
+}
+
+// match applies the filter to an account fetched without a query.
+func (f serviceUserFilter) match(d *gerrit.AccountDetailInfo) bool {
+	isService := false
+	for _, t := range d.Tags {
+		isService = isService || t == serviceUserTag
+	}
+	switch f {
+	case excludeServiceUsers:
+		return !isService
+	case onlyServiceUsers:
+		return isService
+	}
+	return true
+}
+
+// parseSince parses the argument of --since, either a date or an RFC
+// 3339 timestamp.
+func parseSince(s string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("--since: want 2006-01-02 or RFC 3339, got %q", s)
+	}
+	return t, nil
+}
@@ -0,0 +1,176 @@
+//    Copyright 2023, Google LLC
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+
+	git "github.com/go-git/go-git/v5"
+	gerrit "github.com/hanwen/go-gerrit"
+	"golang.org/x/time/rate"
+)
+
+// rebuildExternalIDs regenerates refs/meta/external-ids from scratch,
+// on top of its current history. Only accounts that have a user ref
+// are kept. The readable notes are kept, under the note name derived
+// from their key; for accounts in fetched, they are updated from the
+// server, keeping passwords if keepPasswords is set, and removed if
+// the server no longer reports them.
+func rebuildExternalIDs(repo *git.Repository, trans *RefTransaction, keys externalIDKeys, fetched map[int][]gerrit.AccountExternalIdInfo, keepPasswords bool) error {
+	accounts, err := localAccountIDs(repo)
+	if err != nil {
+		return err
+	}
+	parent, err := readRefCommit(repo, externalIDsRef)
+	if err != nil {
+		return err
+	}
+	old, err := commitNoteMap(parent)
+	if err != nil {
+		// The tree itself may be broken; then only the server
+		// data can be used.
+		log.Printf("%s: %v; starting from an empty notemap", externalIDsRef, err)
+		old, err = commitNoteMap(nil)
+		if err != nil {
+			return err
+		}
+	}
+	notes, err := commitNoteMap(nil)
+	if err != nil {
+		return err
+	}
+	notes.Layout = old.Layout
+	// stale holds the notes of fetched accounts that the server
+	// has not reported yet.
+	stale := map[string]*localExternalID{}
+
+	for _, n := range old.Names() {
+		id, _ := old.Get(n)
+		e, err := parseExternalIDNote(repo.Storer, n, id)
+		if err != nil {
+			log.Printf("dropping unreadable note: %v", err)
+			continue
+		}
+		if !accounts[e.AccountID] {
+			log.Printf("dropping external ID %s of account %d, which has no user ref", e.Key, e.AccountID)
+			continue
+		}
+		name := keys.noteName(e.Key)
+		if name != n {
+			log.Printf("moving external ID %s from note %s to %s", e.Key, n, name)
+		}
+		notes.Set(name, id)
+		if _, ok := fetched[e.AccountID]; ok {
+			stale[name] = e
+		}
+	}
+
+	var ids []int
+	for id := range fetched {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		for _, e := range fetched[id] {
+			name := keys.noteName(e.Identity)
+			if err := updateExternalIDNote(repo.Storer, notes, name, id, e, keepPasswords); err != nil {
+				return err
+			}
+			delete(stale, name)
+		}
+	}
+	var names []string
+	for name := range stale {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		log.Printf("removing external ID %s of account %d, which the server no longer reports", stale[name].Key, stale[name].AccountID)
+		notes.Remove(name)
+	}
+
+	nr := &notesRef{
+		name:   externalIDsRef,
+		parent: parent,
+		notes:  notes,
+	}
+	return nr.commit(repo.Storer, trans, newSig(), "rebuild external IDs")
+}
+
+func rebuildExternalIDsMain(args []string) error {
+	fs := flag.NewFlagSet("rebuild-external-ids", flag.ExitOnError)
+	repoDir := fs.String("repo", "", "all-users repo")
+	var sf storageFlags
+	sf.register(fs)
+	var server serverFlags
+	server.register(fs, "")
+	caseInsensitiveUserNames := fs.Bool("username-case-insensitive", false, caseInsensitiveUserNamesUsage)
+	keepPasswords := fs.Bool("keep-passwords", false, "keep the hashed HTTP passwords of external IDs fetched from the server; by default they are removed")
+	dryRun := fs.Bool("dry-run", false, "print the ref update rather than applying it")
+	fs.Parse(args)
+	if *repoDir == "" {
+		return fmt.Errorf("must specify --repo")
+	}
+
+	repo, err := sf.open(*repoDir)
+	if err != nil {
+		return err
+	}
+	if !*dryRun {
+		if err := finishPendingTransaction(repo.Storer); err != nil {
+			return err
+		}
+	}
+
+	// Without a server, the existing notes are re-keyed and
+	// filtered.
+	fetched := map[int][]gerrit.AccountExternalIdInfo{}
+	if server.url != "" {
+		client, err := server.client()
+		if err != nil {
+			return err
+		}
+		accounts, err := localAccountIDs(repo)
+		if err != nil {
+			return err
+		}
+		lim := rate.NewLimiter(8, 4)
+		for id := range accounts {
+			lim.Wait(context.Background())
+			extIDs, _, err := client.Accounts.GetAccountExternalIDs(strconv.Itoa(id))
+			if err != nil {
+				return fmt.Errorf("account %d: %v", id, err)
+			}
+			fetched[id] = extIDs
+		}
+		log.Printf("fetched external IDs of %d accounts", len(fetched))
+	}
+
+	trans := newRefTransaction()
+	keys := externalIDKeys{CaseInsensitiveUserNames: *caseInsensitiveUserNames}
+	if err := rebuildExternalIDs(repo, trans, keys, fetched, *keepPasswords); err != nil {
+		return err
+	}
+	if *dryRun {
+		return printPlan(os.Stdout, repo, trans)
+	}
+	return UpdateRepo(repo.Storer, trans)
+}
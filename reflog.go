@@ -0,0 +1,105 @@
+//    Copyright 2023, Google LLC
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/storage"
+	"github.com/hanwen/allusersync/gitutil"
+)
+
+// reflogCommand names the command in reflog messages.
+var reflogCommand = "sync"
+
+// dotGitFS returns the .git directory that st writes to, looking
+// through the gitutil wrappers, or nil if st is not backed by a
+// filesystem, eg. the overlay of a dry run.
+func dotGitFS(st interface{}) billy.Filesystem {
+	for {
+		switch s := st.(type) {
+		case interface{ Unwrap() storage.Storer }:
+			st = s.Unwrap()
+		case interface{ Filesystem() billy.Filesystem }:
+			return s.Filesystem()
+		default:
+			return nil
+		}
+	}
+}
+
+// gitKeepsRefs returns whether st leaves refs, and so the reflog, to
+// git, as for reftable.
+func gitKeepsRefs(st interface{}) bool {
+	for {
+		switch s := st.(type) {
+		case *gitutil.GitRefStorer:
+			return true
+		case interface{ Unwrap() storage.Storer }:
+			st = s.Unwrap()
+		default:
+			return false
+		}
+	}
+}
+
+// dropReflog removes the reflog of name, eg. because the ref's history
+// was rewritten and the old entries should not keep it alive.
+func dropReflog(st interface{}, name plumbing.ReferenceName) error {
+	fs := dotGitFS(st)
+	if fs == nil || gitKeepsRefs(st) {
+		return nil
+	}
+	if err := fs.Remove(path.Join("logs", name.String())); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// writeReflog records a ref update in logs/REF, in the format of git's
+// reflog, so git reflog shows what we did. As in git, deleting a ref
+// deletes its reflog.
+func writeReflog(st interface{}, name plumbing.ReferenceName, old, new plumbing.Hash, msg string) error {
+	fs := dotGitFS(st)
+	if fs == nil || gitKeepsRefs(st) {
+		return nil
+	}
+	if new.IsZero() {
+		return dropReflog(st, name)
+	}
+	p := path.Join("logs", name.String())
+
+	// The reflog tells when the refs really moved, so it doesn't
+	// use --timestamp.
+	sig := newSig()
+	now := time.Now()
+	line := fmt.Sprintf("%s %s %s <%s> %d %s\tallusersync %s: %s\n",
+		old, new, sig.Name, sig.Email, now.Unix(), now.Format("-0700"), reflogCommand, msg)
+
+	f, err := fs.OpenFile(p, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write([]byte(line)); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
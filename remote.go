@@ -0,0 +1,209 @@
+//    Copyright 2023, Google LLC
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/storage"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/hanwen/allusersync/gitutil"
+)
+
+// syncRefSpecs fetch the refs that a sync reads and writes.
+var syncRefSpecs = []config.RefSpec{
+	"+refs/users/*:refs/users/*",
+	"+refs/meta/*:refs/meta/*",
+	"+refs/groups/*:refs/groups/*",
+	"+refs/starred-changes/*:refs/starred-changes/*",
+	"+refs/draft-comments/*:refs/draft-comments/*",
+}
+
+// unpushedRef points to a blob, in the format of
+// pendingTransactionRef, listing the refs that --push has yet to push
+// and their IDs on the remote. It is written before the refs change
+// locally, and removed once a push succeeds, so the next run retries a
+// push that failed.
+const unpushedRef = plumbing.ReferenceName("refs/meta/allusersync-unpushed")
+
+// remoteFlags select a remote All-Users repository to sync without a
+// local repository, or to refresh the local one from, and how to
+// authenticate to it.
+type remoteFlags struct {
+	url       string
+	fetch     string
+	push      string
+	nonAtomic bool
+	basic     string
+}
+
+func (rf *remoteFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&rf.url, "remote", "", "instead of --repo, sync the All-Users repository at this https:// or ssh:// URL: fetch its refs into memory, and push the updates back")
+	fs.StringVar(&rf.fetch, "fetch", "", "before syncing, fetch the refs of --repo from this remote, a remote name from its config or a URL, overwriting local refs; for when --repo is a cache of the real All-Users repository")
+	fs.StringVar(&rf.push, "push", "", "after syncing, push the updated refs of --repo to this remote, a remote name from its config or a URL. Refs only move if the remote has them where --repo had them before the sync")
+	fs.BoolVar(&rf.nonAtomic, "push-non-atomic", false, "if the remote cannot update several refs atomically, push them one by one rather than failing. A push that fails halfway then leaves some refs of the remote updated; the next push finishes it")
+	fs.StringVar(&rf.basic, "remote-basic", "", "USER:PASSWORD for --remote, --fetch or --push over HTTP(S); over SSH, the SSH agent is used")
+}
+
+// auth returns the credentials for the remote, or nil to use those
+// in the URL or the SSH agent.
+func (rf *remoteFlags) auth() transport.AuthMethod {
+	if rf.basic == "" {
+		return nil
+	}
+	user, password, _ := strings.Cut(rf.basic, ":")
+	return &githttp.BasicAuth{Username: user, Password: password}
+}
+
+// open fetches the refs of the remote into an in-memory repository.
+func (rf *remoteFlags) open(sf *storageFlags) (*git.Repository, error) {
+	var st storage.Storer = memory.NewStorage()
+	if sf.validateObjects {
+		st = gitutil.NewValidatingStorer(st)
+	}
+	repo, err := git.Init(st, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := fetchRefs(repo, rf.url, rf.auth()); err != nil {
+		return nil, fmt.Errorf("fetch %s: %v", rf.url, err)
+	}
+	// Finishing it here would not push it.
+	if _, err := repo.Reference(pendingTransactionRef, false); err == nil {
+		return nil, fmt.Errorf("%s has %s from an interrupted run; finish it with a sync of a clone", rf.url, pendingTransactionRef)
+	}
+	return repo, nil
+}
+
+// remoteURL returns the URL of the remote called name in the config
+// of repo, or else name itself.
+func remoteURL(repo *git.Repository, name string) (string, error) {
+	r, err := repo.Remote(name)
+	if err == git.ErrRemoteNotFound {
+		return name, nil
+	} else if err != nil {
+		return "", err
+	}
+	return r.Config().URLs[0], nil
+}
+
+// fetchRefs fetches the syncRefSpecs from url into repo, overwriting
+// refs that differ.
+func fetchRefs(repo *git.Repository, url string, auth transport.AuthMethod) error {
+	r := git.NewRemote(repo.Storer, &config.RemoteConfig{Name: "origin", URLs: []string{url}})
+	err := r.Fetch(&git.FetchOptions{
+		RefSpecs: syncRefSpecs,
+		Auth:     auth,
+		Tags:     git.NoTags,
+		Force:    true,
+	})
+	var noMatch git.NoMatchingRefSpecError
+	if err == git.NoErrAlreadyUpToDate || err == transport.ErrEmptyRemoteRepository || errors.As(err, &noMatch) {
+		return nil
+	}
+	return err
+}
+
+// pushTransaction pushes the updates of trans to url, leasing the refs
+// at the old IDs of trans, and returns the number of refs pushed. With
+// nonAtomic, refs are pushed one by one to remotes that cannot push
+// them atomically.
+func pushTransaction(st storage.Storer, url string, auth transport.AuthMethod, trans *RefTransaction, nonAtomic bool) (int, error) {
+	var changes []gitutil.RefChange
+	for _, name := range trans.sortedNames() {
+		u := trans.updates[name]
+		// Merged checkpoints may have moved a ref back.
+		if u.OldID == u.NewID {
+			continue
+		}
+		changes = append(changes, gitutil.RefChange{Name: name, Old: u.OldID, New: u.NewID})
+	}
+	err := gitutil.PushRefs(st, url, auth, changes)
+	if !nonAtomic || !errors.Is(err, gitutil.ErrNotAtomic) {
+		return len(changes), err
+	}
+	log.Printf("warning: %s does not support atomic pushes; pushing %d refs one by one", url, len(changes))
+	for i, ch := range changes {
+		if err := gitutil.PushRefs(st, url, auth, []gitutil.RefChange{ch}); err != nil {
+			return i, fmt.Errorf("after pushing %d of %d refs: %w", i, len(changes), err)
+		}
+	}
+	return len(changes), nil
+}
+
+// recordUnpushed adds the refs of tr to unpushedRef, expecting them on
+// the remote at their old IDs. Refs that are recorded already keep the
+// ID recorded first.
+func recordUnpushed(st storage.Storer, tr *RefTransaction) error {
+	rec, err := readTransactionRef(st, unpushedRef)
+	if err != nil {
+		return err
+	}
+	if rec == nil {
+		rec = newRefTransaction()
+	}
+	for name, u := range tr.updates {
+		if _, ok := rec.updates[name]; !ok {
+			rec.updates[name] = &RefUpdate{OldID: u.OldID, NewID: u.NewID}
+		}
+	}
+	id, err := gitutil.SaveBlob(st, encodeTransaction(rec))
+	if err != nil {
+		return err
+	}
+	return st.SetReference(plumbing.NewHashReference(unpushedRef, id))
+}
+
+// pushUnpushed pushes the refs of unpushedRef to url, at their current
+// local IDs, leasing them at the recorded IDs. Once the push succeeds,
+// unpushedRef is removed. It returns the number of refs pushed.
+func pushUnpushed(st storage.Storer, url string, auth transport.AuthMethod, nonAtomic bool) (int, error) {
+	rec, err := readTransactionRef(st, unpushedRef)
+	if err != nil || rec == nil {
+		return 0, err
+	}
+	// Merges and --force may have changed the updates after they
+	// were recorded, so push what the refs are now.
+	for name, u := range rec.updates {
+		if u.NewID, err = currentRef(st, name); err != nil {
+			return 0, err
+		}
+	}
+	n, err := pushTransaction(st, url, auth, rec, nonAtomic)
+	if err != nil {
+		return 0, err
+	}
+	return n, st.RemoveReference(unpushedRef)
+}
+
+// dropUnpushed removes unpushedRef, for when the local refs were
+// replaced by those of the remote. It returns the number of refs that
+// were recorded.
+func dropUnpushed(st storage.Storer) (int, error) {
+	rec, err := readTransactionRef(st, unpushedRef)
+	if err != nil || rec == nil {
+		return 0, err
+	}
+	return len(rec.updates), st.RemoveReference(unpushedRef)
+}
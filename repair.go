@@ -0,0 +1,147 @@
+//    Copyright 2023, Google LLC
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/hanwen/allusersync/gitutil"
+)
+
+// anyUserRefRE matches user refs with any shard, including wrong ones.
+var anyUserRefRE = regexp.MustCompile(`^refs/users/([0-9]+)/([0-9]+)$`)
+
+// misplacedUserRefs returns the user refs whose shard is not the
+// account ID modulo 100. Gerrit does not find these accounts.
+func misplacedUserRefs(repo *git.Repository) ([]*plumbing.Reference, error) {
+	iter, err := repo.References()
+	if err != nil {
+		return nil, err
+	}
+	var result []*plumbing.Reference
+	if err := iter.ForEach(func(ref *plumbing.Reference) error {
+		m := anyUserRefRE.FindStringSubmatch(ref.Name().String())
+		if m == nil || ref.Type() != plumbing.HashReference {
+			return nil
+		}
+		id, err := strconv.Atoi(m[2])
+		if err != nil {
+			return err
+		}
+		// Refs that have no valid place, such as ID 0, are
+		// left alone.
+		if want, err := gitutil.UserRefName(id); err == nil && ref.Name() != want {
+			result = append(result, ref)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name() < result[j].Name() })
+	return result, nil
+}
+
+// moveMisplacedUserRefs adds updates to trans that move misplaced refs
+// to their shard. A ref is only dropped if its shard already has the
+// same commit; if it has a different one, the ref is left alone and
+// returned as a conflict.
+func moveMisplacedUserRefs(repo *git.Repository, trans *RefTransaction, refs []*plumbing.Reference) ([]string, error) {
+	var conflicts []string
+	for _, ref := range refs {
+		m := anyUserRefRE.FindStringSubmatch(ref.Name().String())
+		id, err := strconv.Atoi(m[2])
+		if err != nil {
+			return nil, err
+		}
+		want, err := gitutil.UserRefName(id)
+		if err != nil {
+			return nil, err
+		}
+		cur, err := currentRef(repo.Storer, want)
+		if err != nil {
+			return nil, err
+		}
+		if u := trans.updates[want]; u != nil {
+			cur = u.NewID
+		}
+		switch cur {
+		case plumbing.ZeroHash:
+			trans.updates[want] = &RefUpdate{NewID: ref.Hash()}
+		case ref.Hash():
+		default:
+			conflicts = append(conflicts, fmt.Sprintf("%s: %s has %s", ref.Name(), want, cur))
+			continue
+		}
+		trans.updates[ref.Name()] = &RefUpdate{OldID: ref.Hash()}
+	}
+	return conflicts, nil
+}
+
+func repairMain(args []string) error {
+	fs := flag.NewFlagSet("repair", flag.ExitOnError)
+	repoDir := fs.String("repo", "", "all-users repo")
+	var sf storageFlags
+	sf.register(fs)
+	dryRun := fs.Bool("dry-run", false, "only list misplaced refs")
+	fs.Parse(args)
+	if *repoDir == "" {
+		return fmt.Errorf("must specify --repo")
+	}
+
+	repo, err := sf.open(*repoDir)
+	if err != nil {
+		return err
+	}
+	if !*dryRun {
+		if err := finishPendingTransaction(repo.Storer); err != nil {
+			return err
+		}
+	}
+
+	refs, err := misplacedUserRefs(repo)
+	if err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		fmt.Printf("misplaced: %s\n", ref.Name())
+	}
+	if *dryRun || len(refs) == 0 {
+		return nil
+	}
+
+	trans := newRefTransaction()
+	conflicts, err := moveMisplacedUserRefs(repo, trans, refs)
+	if err != nil {
+		return err
+	}
+	if err := UpdateRepo(repo.Storer, trans); err != nil {
+		return err
+	}
+	log.Printf("moved %d refs", len(refs)-len(conflicts))
+	if len(conflicts) > 0 {
+		for _, c := range conflicts {
+			log.Printf("conflict: %s", c)
+		}
+		return fmt.Errorf("%d refs not moved", len(conflicts))
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+//    Copyright 2023, Google LLC
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	gerrit "github.com/hanwen/go-gerrit"
+	"golang.org/x/text/unicode/norm"
+)
+
+// sanitizeName makes a name from an identity provider fit for
+// account.config: invalid UTF-8 is replaced, line breaks and tabs
+// become spaces, other control characters are dropped, and the result
+// is trimmed and NFC-normalized.
+func sanitizeName(s string) string {
+	s = strings.ToValidUTF8(s, "\uFFFD")
+	s = strings.Map(func(r rune) rune {
+		if !unicode.IsControl(r) {
+			return r
+		}
+		if unicode.IsSpace(r) {
+			return ' '
+		}
+		return -1
+	}, s)
+	return norm.NFC.String(strings.TrimSpace(s))
+}
+
+// sanitizeAccountDetails sanitizes the free-form fields of d in place,
+// and describes what was changed.
+func sanitizeAccountDetails(d *gerrit.AccountDetailInfo) []string {
+	var changes []string
+	for _, f := range []struct {
+		key string
+		val *string
+	}{
+		{"fullName", &d.Name},
+		{"displayName", &d.DisplayName},
+		{"status", &d.Status},
+	} {
+		if clean := sanitizeName(*f.val); clean != *f.val {
+			changes = append(changes, fmt.Sprintf("%s %q -> %q", f.key, *f.val, clean))
+			*f.val = clean
+		}
+	}
+	return changes
+}
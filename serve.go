@@ -0,0 +1,186 @@
+//    Copyright 2023, Google LLC
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+	gerrit "github.com/hanwen/go-gerrit"
+)
+
+// identityServer serves a read-only subset of Gerrit's accounts REST
+// API from the local repository.
+type identityServer struct {
+	repo *git.Repository
+
+	mu sync.RWMutex
+	ix *identityIndex
+}
+
+func (s *identityServer) reload() error {
+	ix, err := loadIdentityIndex(s.repo)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ix = ix
+	return nil
+}
+
+func (s *identityServer) index() *identityIndex {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.ix
+}
+
+func (ix *identityIndex) accountInfo(a *localAccount) *gerrit.AccountInfo {
+	info := &gerrit.AccountInfo{
+		AccountID:   a.ID,
+		Name:        a.option("fullName"),
+		DisplayName: a.option("displayName"),
+		Email:       a.option("preferredEmail"),
+		Status:      a.option("status"),
+		Inactive:    !a.Active(),
+	}
+	for _, e := range ix.extIDs[a.ID] {
+		if strings.HasPrefix(e.Key, "username:") {
+			info.Username = strings.TrimPrefix(e.Key, "username:")
+		}
+	}
+	return info
+}
+
+// resolve finds accounts by numeric ID, email or username, like
+// Gerrit's account identifiers.
+func (ix *identityIndex) resolve(id string) []*localAccount {
+	if n, err := strconv.Atoi(id); err == nil {
+		if a := ix.byID(n); a != nil {
+			return []*localAccount{a}
+		}
+		return nil
+	}
+	if strings.Contains(id, "@") {
+		return ix.byEmailAddress(id)
+	}
+	if a := ix.byUsername(id); a != nil {
+		return []*localAccount{a}
+	}
+	return nil
+}
+
+func writeGerritJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	fmt.Fprintf(w, ")]}'\n")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("encode: %v", err)
+	}
+}
+
+// externalIDInfo is Gerrit's AccountExternalIdInfo without trusted:
+// the repository doesn't record whether an identity is trusted, so we
+// leave the field out, as Gerrit does where it doesn't apply.
+type externalIDInfo struct {
+	Identity     string `json:"identity"`
+	EmailAddress string `json:"email_address,omitempty"`
+}
+
+func (s *identityServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "read-only", http.StatusMethodNotAllowed)
+		return
+	}
+
+	p := strings.TrimPrefix(r.URL.Path, "/a/")
+	p = strings.TrimPrefix(p, "/")
+	components := strings.Split(strings.TrimSuffix(p, "/"), "/")
+	if len(components) < 2 || components[0] != "accounts" {
+		http.NotFound(w, r)
+		return
+	}
+
+	ix := s.index()
+	found := ix.resolve(components[1])
+	if len(found) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	if len(found) > 1 {
+		http.Error(w, fmt.Sprintf("ambiguous account %q", components[1]), http.StatusConflict)
+		return
+	}
+	a := found[0]
+
+	switch strings.Join(components[2:], "/") {
+	case "", "detail":
+		writeGerritJSON(w, ix.accountInfo(a))
+	case "external.ids":
+		result := []externalIDInfo{}
+		for _, e := range ix.extIDs[a.ID] {
+			result = append(result, externalIDInfo{
+				Identity:     e.Key,
+				EmailAddress: e.Email,
+			})
+		}
+		writeGerritJSON(w, result)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func serveMain(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	repoDir := fs.String("repo", "", "all-users repo")
+	var sf storageFlags
+	sf.register(fs)
+	addr := fs.String("addr", "localhost:8081", "address to listen on")
+	reload := fs.Duration("reload", time.Minute, "interval for rereading the repository")
+	fs.Parse(args)
+	if *repoDir == "" {
+		return fmt.Errorf("must specify --repo")
+	}
+
+	repo, err := sf.open(*repoDir)
+	if err != nil {
+		return err
+	}
+
+	srv := &identityServer{repo: repo}
+	if err := srv.reload(); err != nil {
+		return err
+	}
+
+	if *reload > 0 {
+		go func() {
+			for range time.Tick(*reload) {
+				if err := srv.reload(); err != nil {
+					log.Printf("reload: %v", err)
+				}
+			}
+		}()
+	}
+
+	log.Printf("serving on %s", *addr)
+	return http.ListenAndServe(*addr, srv)
+}
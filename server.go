@@ -0,0 +1,51 @@
+//    Copyright 2023, Google LLC
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"strings"
+
+	gerrit "github.com/hanwen/go-gerrit"
+)
+
+// serverFlags select the Gerrit server and how to authenticate.
+type serverFlags struct {
+	url    string
+	basic  string
+	cookie string
+}
+
+func (sf *serverFlags) register(fs *flag.FlagSet, defaultURL string) {
+	fs.StringVar(&sf.url, "url", defaultURL, "")
+	fs.StringVar(&sf.basic, "basic", "", "USER:PASSWORD for basic auth.")
+	fs.StringVar(&sf.cookie, "cookie", "", "value for the 'o' auth cookie. Use for googlesource.com")
+}
+
+// client returns an authenticated client for the server.
+func (sf *serverFlags) client() (*gerrit.Client, error) {
+	client, err := gerrit.NewClient(sf.url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if sf.basic != "" {
+		fields := strings.Split(sf.basic, ":")
+		client.Authentication.SetBasicAuth(fields[0], fields[1])
+	} else if sf.cookie != "" {
+		client.Authentication.SetCookieAuth("o", sf.cookie)
+	}
+	return client, nil
+}
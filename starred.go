@@ -0,0 +1,124 @@
+//    Copyright 2023, Google LLC
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/hanwen/allusersync/gitutil"
+	gerrit "github.com/hanwen/go-gerrit"
+	"golang.org/x/time/rate"
+)
+
+var starredRefRE = regexp.MustCompile(`^refs/starred-changes/[0-9]{2}/([0-9]+)/([0-9]+)$`)
+
+// starredRefName returns refs/starred-changes/CD/ABCD/ACCOUNTID.
+func starredRefName(change, account int) plumbing.ReferenceName {
+	return plumbing.ReferenceName(fmt.Sprintf("refs/starred-changes/%02d/%d/%d", change%100, change, account))
+}
+
+// starLabel is the content of a starred-changes ref blob, as written
+// by Gerrit's StarredChangesUtil.
+const starLabel = "star"
+
+// getStarredChanges returns the change numbers starred by the
+// account. Gerrit only shows starred changes to their owner, so if we
+// are not allowed to see them, nil is returned.
+func getStarredChanges(lim *rate.Limiter, cl *gerrit.Client, id string) ([]int, error) {
+	lim.Wait(context.Background())
+	changes, reply, err := cl.Accounts.GetStarredChanges(id)
+	if reply != nil && (reply.StatusCode == http.StatusForbidden || reply.StatusCode == http.StatusNotFound) {
+		log.Printf("account %s: cannot read starred changes: %v", id, err)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result := []int{}
+	if changes != nil {
+		for _, c := range *changes {
+			result = append(result, c.Number)
+		}
+	}
+	sort.Ints(result)
+	return result, nil
+}
+
+// readStarredRefs returns the starred-changes refs per account ID.
+func readStarredRefs(repo *git.Repository) (map[int][]plumbing.ReferenceName, error) {
+	iter, err := repo.References()
+	if err != nil {
+		return nil, err
+	}
+	result := map[int][]plumbing.ReferenceName{}
+	if err := iter.ForEach(func(ref *plumbing.Reference) error {
+		m := starredRefRE.FindStringSubmatch(ref.Name().String())
+		if m == nil {
+			return nil
+		}
+		id, err := strconv.Atoi(m[2])
+		if err != nil {
+			return err
+		}
+		result[id] = append(result[id], ref.Name())
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// updateStarredRefs schedules updates so the account's
+// starred-changes refs match the given changes.
+func updateStarredRefs(st storer.EncodedObjectStorer, repo *git.Repository, trans *RefTransaction, account int, old []plumbing.ReferenceName, changes []int) error {
+	id, err := gitutil.SaveBlob(st, []byte(starLabel))
+	if err != nil {
+		return err
+	}
+
+	want := map[plumbing.ReferenceName]bool{}
+	for _, c := range changes {
+		name := starredRefName(c, account)
+		want[name] = true
+		update := &RefUpdate{NewID: id}
+		if ref, err := repo.Reference(name, false); err == nil {
+			if ref.Hash() == id {
+				continue
+			}
+			update.OldID = ref.Hash()
+		}
+		trans.updates[name] = update
+	}
+	for _, name := range old {
+		if !want[name] {
+			ref, err := repo.Reference(name, false)
+			if err != nil {
+				return err
+			}
+			trans.updates[name] = &RefUpdate{OldID: ref.Hash()}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+//    Copyright 2023, Google LLC
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+type countEntry struct {
+	Key   string
+	Count int
+}
+
+// sortedCounts returns the map entries ordered by descending count.
+func sortedCounts(m map[string]int) []countEntry {
+	var r []countEntry
+	for k, v := range m {
+		r = append(r, countEntry{k, v})
+	}
+	sort.Slice(r, func(i, j int) bool {
+		if r[i].Count != r[j].Count {
+			return r[i].Count > r[j].Count
+		}
+		return r[i].Key < r[j].Key
+	})
+	return r
+}
+
+type repoStats struct {
+	Accounts         int
+	InactiveAccounts int
+	ExternalIDs      int
+
+	// Schemes counts external IDs by scheme (eg. "mailto").
+	Schemes map[string]int
+
+	// Buckets counts notes by the notemap directory that holds them.
+	Buckets map[string]int
+
+	// Refs counts refs by namespace (eg. "refs/users").
+	Refs map[string]int
+}
+
+func refNamespace(name plumbing.ReferenceName) string {
+	components := strings.SplitN(name.String(), "/", 3)
+	if len(components) < 3 {
+		return name.String()
+	}
+	return strings.Join(components[:2], "/")
+}
+
+func computeStats(repo *git.Repository) (*repoStats, error) {
+	st := &repoStats{
+		Schemes: map[string]int{},
+		Buckets: map[string]int{},
+		Refs:    map[string]int{},
+	}
+
+	accounts, err := readLocalAccounts(repo)
+	if err != nil {
+		return nil, err
+	}
+	st.Accounts = len(accounts)
+	for _, a := range accounts {
+		if !a.Active() {
+			st.InactiveAccounts++
+		}
+	}
+
+	extIDs, err := readLocalExternalIDs(repo)
+	if err != nil {
+		return nil, err
+	}
+	st.ExternalIDs = len(extIDs)
+	for _, e := range extIDs {
+		scheme := e.Key
+		if idx := strings.Index(scheme, ":"); idx >= 0 {
+			scheme = scheme[:idx]
+		}
+		st.Schemes[scheme]++
+
+		bucket := path.Dir(e.Path)
+		if bucket == "." {
+			bucket = "(root)"
+		}
+		st.Buckets[bucket]++
+	}
+
+	iter, err := repo.References()
+	if err != nil {
+		return nil, err
+	}
+	if err := iter.ForEach(func(ref *plumbing.Reference) error {
+		if !strings.HasPrefix(ref.Name().String(), "refs/") {
+			return nil
+		}
+		st.Refs[refNamespace(ref.Name())]++
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return st, nil
+}
+
+func statsMain(args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	repoDir := fs.String("repo", "", "all-users repo")
+	var sf storageFlags
+	sf.register(fs)
+	topN := fs.Int("buckets", 5, "number of largest note buckets to show")
+	fs.Parse(args)
+	if *repoDir == "" {
+		return fmt.Errorf("must specify --repo")
+	}
+
+	repo, err := sf.open(*repoDir)
+	if err != nil {
+		return err
+	}
+
+	st, err := computeStats(repo)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("accounts: %d (active %d, inactive %d)\n", st.Accounts, st.Accounts-st.InactiveAccounts, st.InactiveAccounts)
+	fmt.Printf("external IDs: %d\n", st.ExternalIDs)
+	for _, e := range sortedCounts(st.Schemes) {
+		fmt.Printf("  %s: %d\n", e.Key, e.Count)
+	}
+	fmt.Printf("largest note buckets:\n")
+	for i, e := range sortedCounts(st.Buckets) {
+		if i >= *topN {
+			break
+		}
+		fmt.Printf("  %s: %d\n", e.Key, e.Count)
+	}
+	fmt.Printf("refs:\n")
+	for _, e := range sortedCounts(st.Refs) {
+		fmt.Printf("  %s: %d\n", e.Key, e.Count)
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+//    Copyright 2023, Google LLC
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"compress/zlib"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/osfs"
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/storage"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+	"github.com/hanwen/allusersync/gitutil"
+)
+
+// storageFlags tune the go-git filesystem storer.
+type storageFlags struct {
+	objectCacheMiB       int
+	maxOpenPacks         int
+	largeObjectThreshold int64
+	exclusive            bool
+	packObjects          bool
+	dedupCache           int
+	validateObjects      bool
+	packedRefs           bool
+	compression          int
+	fastImport           bool
+	backend              string
+}
+
+func (sf *storageFlags) register(fs *flag.FlagSet) {
+	fs.IntVar(&sf.objectCacheMiB, "object-cache", int(cache.DefaultMaxSize/cache.MiByte), "size of the decoded object cache in MiB")
+	fs.IntVar(&sf.maxOpenPacks, "max-open-packs", 0, "number of packfiles to keep open between reads; 0 reopens them for each read")
+	fs.Int64Var(&sf.largeObjectThreshold, "large-object-threshold", 0, "objects larger than this many bytes are streamed rather than read into memory; 0 means no limit")
+	fs.BoolVar(&sf.exclusive, "exclusive-access", false, "assume the repository is not modified by other processes while we run")
+	fs.BoolVar(&sf.packObjects, "pack-objects", true, "write new objects as one packfile before updating refs, rather than as loose objects")
+	fs.IntVar(&sf.dedupCache, "dedup-cache", 1<<16, "number of recently written object IDs to remember, saving existence checks for repeated objects; 0 disables")
+	fs.BoolVar(&sf.validateObjects, "validate-objects", false, "check the objects we write for corruption, as git fsck would, before writing them")
+	fs.IntVar(&sf.compression, "compression", zlib.DefaultCompression, "zlib level (0-9) of the objects we write; 0 saves the most CPU on big imports, at the cost of disk until a repack. -1 is zlib's default; other levels also skip delta compression in packs")
+	fs.BoolVar(&sf.fastImport, "fast-import", false, "write new objects by piping them to git fast-import, which is much faster than go-git for initial imports of big servers")
+	fs.StringVar(&sf.backend, "backend", "go-git", "how to write objects and refs: go-git, or git-cli, which runs git unpack-objects, git mktree and git update-ref, for exact compatibility with the installed git")
+	fs.BoolVar(&sf.packedRefs, "packed-refs", false, "write ref updates in one go to packed-refs, using git's lock files, rather than as loose refs")
+}
+
+// open opens the repository at dir, which is either a bare
+// repository or a directory containing .git.
+func (sf *storageFlags) open(dir string) (*git.Repository, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(dir); err != nil {
+		if os.IsNotExist(err) {
+			return nil, git.ErrRepositoryNotExists
+		}
+		return nil, err
+	}
+
+	var dot, wt billy.Filesystem
+	gitDir := dir
+	if fi, err := os.Stat(filepath.Join(dir, ".git")); err != nil {
+		dot = osfs.New(dir)
+	} else if fi.IsDir() {
+		gitDir = filepath.Join(dir, ".git")
+		dot = osfs.New(gitDir)
+		wt = osfs.New(dir)
+	} else {
+		// .git file pointing elsewhere; leave that to go-git.
+		return git.PlainOpen(dir)
+	}
+
+	st := filesystem.NewStorageWithOptions(dot,
+		cache.NewObjectLRU(cache.FileSize(sf.objectCacheMiB)*cache.MiByte),
+		filesystem.Options{
+			ExclusiveAccess:      sf.exclusive,
+			MaxOpenDescriptors:   sf.maxOpenPacks,
+			LargeObjectThreshold: sf.largeObjectThreshold,
+		})
+	if err := gitutil.CheckCompression(sf.compression); err != nil {
+		return nil, fmt.Errorf("--compression: %v", err)
+	}
+	switch sf.backend {
+	case "go-git":
+	case "git-cli":
+		// go-git would not see the objects that git writes.
+		if sf.exclusive {
+			return nil, fmt.Errorf("--backend=git-cli cannot be combined with --exclusive-access")
+		}
+		if sf.fastImport || sf.packedRefs {
+			return nil, fmt.Errorf("--backend=git-cli leaves objects and refs to git; drop --fast-import and --packed-refs")
+		}
+	default:
+		return nil, fmt.Errorf("--backend: want go-git or git-cli, got %q", sf.backend)
+	}
+	if sf.fastImport {
+		if !sf.packObjects {
+			return nil, fmt.Errorf("--fast-import needs --pack-objects")
+		}
+		// go-git would not see the packs that git writes.
+		if sf.exclusive {
+			return nil, fmt.Errorf("--fast-import cannot be combined with --exclusive-access")
+		}
+	}
+	var s storage.Storer = st
+	switch {
+	case sf.backend == "git-cli":
+		// The batch is written with a few git processes, rather
+		// than one per object.
+		bs := gitutil.NewBatchStorer(s)
+		bs.Compression = sf.compression
+		bs.GitCLI = gitDir
+		s = bs
+	case sf.packObjects:
+		bs := gitutil.NewBatchStorer(s)
+		bs.Compression = sf.compression
+		if sf.fastImport {
+			bs.FastImport = gitDir
+		}
+		s = bs
+	case sf.compression != zlib.DefaultCompression:
+		if sf.exclusive {
+			return nil, fmt.Errorf("--compression for loose objects cannot be combined with --exclusive-access")
+		}
+		s = gitutil.NewLooseStorer(s, dot, sf.compression)
+	}
+	if sf.dedupCache > 0 {
+		s = gitutil.NewDedupStorer(s, sf.dedupCache)
+	}
+	if sf.validateObjects {
+		s = gitutil.NewValidatingStorer(s)
+	}
+
+	// go-git only knows loose and packed refs; it would read no refs
+	// from a reftable repository, and write loose refs that git
+	// ignores.
+	format, err := gitutil.RefStorage(dot)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case format == "reftable":
+		if sf.packedRefs {
+			return nil, fmt.Errorf("--packed-refs: %s uses reftable", dir)
+		}
+		gs := gitutil.NewGitRefStorer(s, gitDir)
+		gs.ReflogMessage = "allusersync " + reflogCommand
+		if _, err := gs.Reference(plumbing.HEAD); err != nil && err != plumbing.ErrReferenceNotFound {
+			return nil, fmt.Errorf("%s uses reftable, which needs git 2.45 or later: %v", dir, err)
+		}
+		s = gs
+	case sf.backend == "git-cli":
+		gs := gitutil.NewGitRefStorer(s, gitDir)
+		gs.ReflogMessage = "allusersync " + reflogCommand
+		s = gs
+	case sf.packedRefs:
+		s = gitutil.NewPackedRefsStorer(s, dot)
+	}
+	return git.Open(s, wt)
+}
+
+// initRepository creates a bare repository at dir if dir doesn't
+// exist or is empty, with the given ref storage format, and reports
+// whether it did. Objects use SHA-1, the only format go-git reads.
+func initRepository(dir, refFormat string) (bool, error) {
+	if refFormat != "files" && refFormat != "reftable" {
+		return false, fmt.Errorf("--ref-format: want files or reftable, got %q", refFormat)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	if len(entries) > 0 {
+		return false, nil
+	}
+	if refFormat == "reftable" {
+		if err := gitutil.InitReftable(dir); err != nil {
+			return false, fmt.Errorf("init %s: reftable needs git 2.45 or later: %v", dir, err)
+		}
+		return true, nil
+	}
+	if _, err := git.PlainInit(dir, true); err != nil {
+		return false, fmt.Errorf("init %s: %v", dir, err)
+	}
+	return true, nil
+}
@@ -0,0 +1,209 @@
+//    Copyright 2023, Google LLC
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/format/config"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/hanwen/allusersync/gitutil"
+	gerrit "github.com/hanwen/go-gerrit"
+)
+
+// syncStateRef records the last full listing of the server, so later
+// runs can be incremental.
+const syncStateRef = plumbing.ReferenceName("refs/meta/sync-state")
+
+const syncStateFile = "sync-state.config"
+
+// syncState is the cursor stored in syncStateRef.
+type syncState struct {
+	// LastSync is when the last complete sync started.
+	LastSync time.Time
+
+	// MaxAccountID is the highest account ID seen. Gerrit
+	// allocates IDs from a sequence, so newer accounts have higher
+	// IDs.
+	MaxAccountID int
+
+	commit *object.Commit
+}
+
+// readSyncState returns the stored sync state. If there is none, the
+// zero state is returned.
+func readSyncState(repo *git.Repository) (*syncState, error) {
+	st := &syncState{}
+	c, err := readRefCommit(repo, syncStateRef)
+	if err != nil || c == nil {
+		return st, err
+	}
+	st.commit = c
+
+	cfg, err := gitutil.LoadCommitConfig(repo.Storer, c, syncStateFile)
+	if err != nil {
+		return nil, err
+	} else if cfg == nil {
+		return st, nil
+	}
+	sec := cfg.Section("sync")
+	if v := sec.Option("lastSync"); v != "" {
+		st.LastSync, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if v := sec.Option("maxAccountId"); v != "" {
+		st.MaxAccountID, err = strconv.Atoi(v)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return st, nil
+}
+
+// save adds an update of syncStateRef to trans.
+func (st *syncState) save(repo *git.Repository, trans *RefTransaction, sig object.Signature) error {
+	cfg := config.New()
+	cfg.SetOption("sync", "", "lastSync", st.LastSync.UTC().Format(time.RFC3339))
+	cfg.SetOption("sync", "", "maxAccountId", strconv.Itoa(st.MaxAccountID))
+	blob, err := gitutil.SaveConfig(repo.Storer, cfg)
+	if err != nil {
+		return err
+	}
+	tree, err := gitutil.SaveTree(repo.Storer, []object.TreeEntry{{
+		Name: syncStateFile,
+		Mode: filemode.Regular,
+		Hash: blob,
+	}})
+	if err != nil {
+		return err
+	}
+
+	c := &object.Commit{
+		Author:    sig,
+		Committer: sig,
+		Message:   "update sync state",
+		TreeHash:  tree,
+	}
+	if st.commit != nil {
+		c.ParentHashes = []plumbing.Hash{st.commit.Hash}
+	}
+	id, err := gitutil.SaveCommit(repo.Storer, c)
+	if err != nil {
+		return err
+	}
+	update := &RefUpdate{NewID: id}
+	if st.commit != nil {
+		update.OldID = st.commit.Hash
+	}
+	trans.updates[syncStateRef] = update
+	return nil
+}
+
+// changedAccounts returns the accounts from a listing of the server
+// that need to be fetched completely: accounts that are new since the
+// last sync, or whose account.config fields, username or emails differ
+// from the repository. Changes that don't show in the listing, such as
+// preferences, GPG keys or external IDs without an email, are only
+// picked up by a full sync.
+func changedAccounts(repo *git.Repository, st *syncState, details []gerrit.AccountDetailInfo) ([]gerrit.AccountDetailInfo, error) {
+	accounts, err := readLocalAccounts(repo)
+	if err != nil {
+		return nil, err
+	}
+	byID := map[int]*localAccount{}
+	for _, a := range accounts {
+		byID[a.ID] = a
+	}
+	extIDs, err := loadNotesRef(repo, externalIDsRef)
+	if err != nil {
+		return nil, err
+	}
+	localExtIDs, err := externalIDsByAccount(repo.Storer, extIDs.notes)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []gerrit.AccountDetailInfo
+	for _, d := range details {
+		local := byID[d.AccountID]
+		if local == nil || d.AccountID > st.MaxAccountID || d.RegisteredOn.After(st.LastSync) ||
+			accountConfigChanged(local, accountConfig(&d)) ||
+			identitiesChanged(local, localExtIDs[d.AccountID], &d.AccountInfo) {
+			result = append(result, d)
+		}
+	}
+	return result, nil
+}
+
+// identitiesChanged returns true if the username or emails that the
+// listing (with DETAILS and ALL_EMAILS) has for an account differ from
+// its external IDs in the repository. Like Gerrit, the emails are
+// those of the external IDs plus the preferred email.
+func identitiesChanged(local *localAccount, extIDs []*localExternalID, info *gerrit.AccountInfo) bool {
+	username := ""
+	emails := map[string]bool{}
+	if e := local.option("preferredEmail"); e != "" {
+		emails[e] = true
+	}
+	for _, e := range extIDs {
+		if strings.HasPrefix(e.Key, "username:") {
+			username = strings.TrimPrefix(e.Key, "username:")
+		}
+		if e.Email != "" {
+			emails[e.Email] = true
+		}
+	}
+	if username != info.Username {
+		return true
+	}
+
+	listed := map[string]bool{}
+	for _, e := range append([]string{info.Email}, info.SecondaryEmails...) {
+		if e != "" {
+			listed[e] = true
+		}
+	}
+	if len(listed) != len(emails) {
+		return true
+	}
+	for e := range listed {
+		if !emails[e] {
+			return true
+		}
+	}
+	return false
+}
+
+// accountConfigChanged returns true if the local account.config
+// differs from cfg in any of the keys that we write.
+func accountConfigChanged(local *localAccount, cfg *config.Config) bool {
+	owned := map[gitutil.ConfigKey]bool{}
+	for _, k := range gitutil.SectionKeys("account", accountConfigKeys...) {
+		owned[k] = true
+	}
+	for _, c := range gitutil.DiffConfig(local.Config, cfg) {
+		if owned[c.Key] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,88 @@
+//    Copyright 2023, Google LLC
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"log"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/format/config"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/hanwen/allusersync/gitutil"
+)
+
+// writeTombstone marks a deleted account on its user ref rather than
+// removing the ref, so its history stays available. The account is
+// deactivated and gets "deleted = true" in account.config; other
+// files are kept.
+func writeTombstone(repo *git.Repository, trans *RefTransaction, sig object.Signature, id int) error {
+	name, err := gitutil.UserRefName(id)
+	if err != nil {
+		return err
+	}
+	ref, err := repo.Reference(name, false)
+	if err == plumbing.ErrReferenceNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	acc, err := readLocalAccount(repo, ref)
+	if err != nil {
+		return err
+	}
+	tree, err := acc.Commit.Tree()
+	if err != nil {
+		return err
+	}
+
+	cfg := acc.Config
+	if cfg == nil {
+		cfg = config.New()
+	}
+	cfg.SetOption("account", "", "active", "false")
+	cfg.SetOption("account", "", "deleted", "true")
+	blob, err := gitutil.SaveConfig(repo.Storer, cfg)
+	if err != nil {
+		return err
+	}
+	treeID, err := gitutil.PatchTree(repo.Storer, tree, []object.TreeEntry{{
+		Name: "account.config",
+		Mode: filemode.Regular,
+		Hash: blob,
+	}})
+	if err != nil {
+		return err
+	}
+	if treeID == acc.Commit.TreeHash {
+		return nil
+	}
+
+	log.Printf("writing tombstone for account %d", id)
+	commitID, err := gitutil.SaveCommit(repo.Storer, &object.Commit{
+		Author:       sig,
+		Committer:    sig,
+		Message:      "delete account",
+		TreeHash:     treeID,
+		ParentHashes: []plumbing.Hash{acc.Commit.Hash},
+	})
+	if err != nil {
+		return err
+	}
+	trans.updates[name] = &RefUpdate{OldID: ref.Hash(), NewID: commitID}
+	return nil
+}
@@ -0,0 +1,186 @@
+//    Copyright 2023, Google LLC
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/storage"
+	"github.com/hanwen/allusersync/gitutil"
+)
+
+// pendingTransactionRef points to a blob listing the updates of a
+// transaction while its refs are being flipped. If it exists, a
+// previous run died halfway, and the transaction should be finished
+// before doing anything else.
+const pendingTransactionRef = plumbing.ReferenceName("refs/meta/allusersync-pending")
+
+// sortedNames returns the names of the updated refs in order.
+func (tr *RefTransaction) sortedNames() []plumbing.ReferenceName {
+	var names []plumbing.ReferenceName
+	for name := range tr.updates {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
+	return names
+}
+
+// encodeTransaction writes one "OLD NEW NAME" line per update.
+func encodeTransaction(tr *RefTransaction) []byte {
+	var buf bytes.Buffer
+	for _, name := range tr.sortedNames() {
+		u := tr.updates[name]
+		fmt.Fprintf(&buf, "%s %s %s\n", u.OldID, u.NewID, name)
+	}
+	return buf.Bytes()
+}
+
+// decodeTransaction reads the blob of ref, as written by
+// encodeTransaction.
+func decodeTransaction(ref plumbing.ReferenceName, data []byte) (*RefTransaction, error) {
+	tr := newRefTransaction()
+	for i, l := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		if l == "" {
+			continue
+		}
+		fields := strings.Fields(l)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s: line %d: malformed update %q", ref, i+1, l)
+		}
+		tr.updates[plumbing.ReferenceName(fields[2])] = &RefUpdate{
+			OldID: plumbing.NewHash(fields[0]),
+			NewID: plumbing.NewHash(fields[1]),
+		}
+	}
+	return tr, nil
+}
+
+// writePendingTransaction records tr in pendingTransactionRef. It
+// fails if another transaction is pending.
+func writePendingTransaction(st storage.Storer, tr *RefTransaction) error {
+	if err := checkRef(st, pendingTransactionRef, plumbing.ZeroHash); err != nil {
+		return fmt.Errorf("another transaction is pending: %w", err)
+	}
+	id, err := gitutil.SaveBlob(st, encodeTransaction(tr))
+	if err != nil {
+		return err
+	}
+	return st.SetReference(plumbing.NewHashReference(pendingTransactionRef, id))
+}
+
+// readPendingTransaction returns the pending transaction, or nil if
+// there is none.
+func readPendingTransaction(st storage.Storer) (*RefTransaction, error) {
+	return readTransactionRef(st, pendingTransactionRef)
+}
+
+// readTransactionRef returns the transaction recorded in the blob of
+// name, or nil if the ref does not exist.
+func readTransactionRef(st storage.Storer, name plumbing.ReferenceName) (*RefTransaction, error) {
+	ref, err := st.Reference(name)
+	if err == plumbing.ErrReferenceNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	obj, err := st.EncodedObject(plumbing.BlobObject, ref.Hash())
+	if err != nil {
+		return nil, err
+	}
+	r, err := obj.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return decodeTransaction(name, data)
+}
+
+// finishPendingTransaction completes a transaction that a previous
+// run left halfway. Refs that are still at their old value are moved
+// to the new value. Refs that are at neither were changed by someone
+// else since, and are left alone.
+func finishPendingTransaction(st storage.Storer) error {
+	tr, err := readPendingTransaction(st)
+	if err != nil || tr == nil {
+		return err
+	}
+	log.Printf("finishing interrupted transaction of %d refs", len(tr.updates))
+	for _, name := range tr.sortedNames() {
+		u := tr.updates[name]
+		cur, err := currentRef(st, name)
+		if err != nil {
+			return err
+		}
+		switch cur {
+		case u.NewID:
+		case u.OldID:
+			if err := setRef(st, name, u, "finish interrupted update"); err != nil {
+				return err
+			}
+		default:
+			log.Printf("warning: %s changed since the interrupted transaction; leaving it at %s", name, cur)
+		}
+	}
+	return st.RemoveReference(pendingTransactionRef)
+}
+
+// rollbackError is returned if a transaction failed, and some of the
+// refs it had already written could not be restored.
+type rollbackError struct {
+	Err    error
+	Failed []string
+}
+
+func (e *rollbackError) Error() string {
+	return fmt.Sprintf("%v; could not roll back:\n  %s", e.Err, strings.Join(e.Failed, "\n  "))
+}
+
+func (e *rollbackError) Unwrap() error {
+	return e.Err
+}
+
+// rollback restores the given refs of tr, which were written before
+// the update failed with err. If that succeeds, the pending
+// transaction is removed and err is returned. Otherwise the pending
+// transaction is kept, so the next run finishes it.
+func rollback(st storage.Storer, tr *RefTransaction, applied []plumbing.ReferenceName, err error) error {
+	var failed []string
+	for _, name := range applied {
+		u := tr.updates[name]
+		if rerr := setRef(st, name, &RefUpdate{OldID: u.NewID, NewID: u.OldID}, "roll back"); rerr != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", name, rerr))
+		}
+	}
+	if len(failed) > 0 {
+		return &rollbackError{Err: err, Failed: failed}
+	}
+	if rerr := st.RemoveReference(pendingTransactionRef); rerr != nil {
+		return fmt.Errorf("%v; rolled back, but: %v", err, rerr)
+	}
+	if len(applied) > 0 {
+		log.Printf("rolled back %d refs", len(applied))
+	}
+	return err
+}
@@ -0,0 +1,136 @@
+//    Copyright 2023, Google LLC
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+	"golang.org/x/time/rate"
+)
+
+// sampleIDs returns n of the IDs, chosen with the given seed, in
+// ascending order. If n is 0 or at least len(ids), all IDs are
+// returned.
+func sampleIDs(ids idSet, n int, seed int64) []int {
+	var result []int
+	for id := range ids {
+		result = append(result, id)
+	}
+	sort.Ints(result)
+	if n > 0 && n < len(result) {
+		r := rand.New(rand.NewSource(seed))
+		r.Shuffle(len(result), func(i, j int) { result[i], result[j] = result[j], result[i] })
+		result = result[:n]
+		sort.Ints(result)
+	}
+	return result
+}
+
+// verifyMain fetches accounts and prints the ref updates a sync would
+// make for them. The new objects are kept in memory, so the
+// repository is not changed.
+func verifyMain(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	repoDir := fs.String("repo", "", "all-users repo")
+	var sf storageFlags
+	sf.register(fs)
+	var server serverFlags
+	server.register(fs, "http://localhost:8080/")
+	sample := fs.Int("sample", 0, "verify this many randomly chosen local accounts; 0 verifies all of them")
+	seed := fs.Int64("seed", time.Now().UnixNano(), "random seed for --sample, to repeat a sample")
+	caseInsensitiveUserNames := fs.Bool("username-case-insensitive", false, caseInsensitiveUserNamesUsage)
+	fs.Parse(args)
+	if *repoDir == "" {
+		return fmt.Errorf("usage: verify --repo REPO [ACCOUNT-ID...]")
+	}
+
+	base, err := sf.open(*repoDir)
+	if err != nil {
+		return err
+	}
+	if tr, err := readPendingTransaction(base.Storer); err != nil {
+		return err
+	} else if tr != nil {
+		return fmt.Errorf("%s exists: a previous run was interrupted; run a sync to finish it", pendingTransactionRef)
+	}
+	repo, err := git.Open(newOverlayStorage(base.Storer), nil)
+	if err != nil {
+		return err
+	}
+
+	var ids []int
+	if fs.NArg() > 0 {
+		for _, a := range fs.Args() {
+			id, err := strconv.Atoi(a)
+			if err != nil {
+				return fmt.Errorf("account ID %q: %v", a, err)
+			}
+			ids = append(ids, id)
+		}
+	} else {
+		local, err := localAccountIDs(repo)
+		if err != nil {
+			return err
+		}
+		ids = sampleIDs(local, *sample, *seed)
+		if *sample > 0 {
+			log.Printf("verifying %d of %d accounts (--seed %d)", len(ids), len(local), *seed)
+		}
+	}
+
+	client, err := server.client()
+	if err != nil {
+		return err
+	}
+	lim := rate.NewLimiter(8, 4)
+	var infos []*AccountInfo
+	var gone []int
+	for _, id := range ids {
+		info, err := getAccountDetails(lim, client, strconv.Itoa(id), &fetchOptions{})
+		if err != nil {
+			return fmt.Errorf("account %d: %v", id, err)
+		}
+		if info == nil {
+			gone = append(gone, id)
+			continue
+		}
+		infos = append(infos, info)
+	}
+
+	trans := newRefTransaction()
+	opts := &saveOptions{
+		Keys:       externalIDKeys{CaseInsensitiveUserNames: *caseInsensitiveUserNames},
+		Collisions: preferLowerID,
+	}
+	if err := saveAccountDetails(infos, gone, opts, repo, trans); err != nil {
+		return err
+	}
+	if err := printPlan(os.Stdout, repo, trans); err != nil {
+		return err
+	}
+	if len(trans.updates) > 0 {
+		return fmt.Errorf("%d refs differ from the server", len(trans.updates))
+	}
+	log.Printf("%d accounts match the server", len(ids))
+	return nil
+}